@@ -0,0 +1,153 @@
+package engineio
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// BroadcastOptions selects the sockets of a broadcast: those in any of Rooms,
+// or every socket if there are none, minus the ones with an id in Except.
+type BroadcastOptions struct {
+	Rooms  []string `json:"rooms,omitempty"`
+	Except []string `json:"except,omitempty"`
+}
+
+// Adapter keeps room membership and delivers broadcasts for a Server. The
+// default MemoryAdapter only knows the sockets of its process; set the
+// "adapter" option to reach the sockets of other nodes too, for example with
+// a BusAdapter.
+type Adapter interface {
+	// Add and Remove are called as sockets open and close.
+	Add(socket *Socket)
+	Remove(socket *Socket)
+
+	Join(socket *Socket, room string)
+	Leave(socket *Socket, room string)
+	Rooms(socket *Socket) []string
+
+	// Sockets returns the sockets of this process selected by opts.
+	Sockets(opts BroadcastOptions) []*Socket
+	// Broadcast sends pkts to every socket selected by opts. The packets are
+	// shared by the sockets and must not be modified.
+	Broadcast(pkts []*parser.Packet, opts BroadcastOptions)
+
+	Close() error
+}
+
+// MemoryAdapter is the in-process Adapter.
+type MemoryAdapter struct {
+	lock    sync.Mutex
+	sockets map[string]*Socket
+	rooms   map[string]map[string]*Socket
+	sids    map[string]map[string]bool
+}
+
+func NewMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{
+		sockets: make(map[string]*Socket),
+		rooms:   make(map[string]map[string]*Socket),
+		sids:    make(map[string]map[string]bool),
+	}
+}
+
+func (adapter *MemoryAdapter) Add(socket *Socket) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	adapter.sockets[socket.id] = socket
+}
+
+func (adapter *MemoryAdapter) Remove(socket *Socket) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	for room := range adapter.sids[socket.id] {
+		adapter.leave(socket.id, room)
+	}
+	delete(adapter.sids, socket.id)
+	delete(adapter.sockets, socket.id)
+}
+
+// Join adds socket to room, unless it was removed already.
+func (adapter *MemoryAdapter) Join(socket *Socket, room string) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	if adapter.sockets[socket.id] != socket {
+		return
+	}
+	members := adapter.rooms[room]
+	if members == nil {
+		members = make(map[string]*Socket)
+		adapter.rooms[room] = members
+	}
+	members[socket.id] = socket
+	rooms := adapter.sids[socket.id]
+	if rooms == nil {
+		rooms = make(map[string]bool)
+		adapter.sids[socket.id] = rooms
+	}
+	rooms[room] = true
+}
+
+func (adapter *MemoryAdapter) Leave(socket *Socket, room string) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	adapter.leave(socket.id, room)
+}
+
+// leave must be called with lock held.
+func (adapter *MemoryAdapter) leave(id, room string) {
+	delete(adapter.sids[id], room)
+	if members := adapter.rooms[room]; members != nil {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(adapter.rooms, room)
+		}
+	}
+}
+
+func (adapter *MemoryAdapter) Rooms(socket *Socket) []string {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	rooms := make([]string, 0, len(adapter.sids[socket.id]))
+	for room := range adapter.sids[socket.id] {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (adapter *MemoryAdapter) Sockets(opts BroadcastOptions) []*Socket {
+	targets := make(map[string]*Socket)
+	adapter.lock.Lock()
+	if len(opts.Rooms) == 0 {
+		for id, socket := range adapter.sockets {
+			targets[id] = socket
+		}
+	} else {
+		for _, room := range opts.Rooms {
+			for id, socket := range adapter.rooms[room] {
+				targets[id] = socket
+			}
+		}
+	}
+	adapter.lock.Unlock()
+	for _, id := range opts.Except {
+		delete(targets, id)
+	}
+	sockets := make([]*Socket, 0, len(targets))
+	for _, socket := range targets {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+func (adapter *MemoryAdapter) Broadcast(pkts []*parser.Packet, opts BroadcastOptions) {
+	for _, socket := range adapter.Sockets(opts) {
+		socket.SendPackets(pkts...)
+	}
+}
+
+func (adapter *MemoryAdapter) Close() error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package engineio
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SocketInfo is a snapshot of a socket for the admin handler.
+type SocketInfo struct {
+	ID            string     `json:"id"`
+	Transport     string     `json:"transport"`
+	Upgraded      bool       `json:"upgraded"`
+	ReadyState    ReadyState `json:"readyState"`
+	Suspended     bool       `json:"suspended"`
+	RemoteAddr    string     `json:"remoteAddr"`
+	ConnectedAt   time.Time  `json:"connectedAt"`
+	Buffered      int        `json:"buffered"`
+	LastHeartbeat time.Time  `json:"lastHeartbeat"`
+}
+
+// SocketDetails adds the handshake and rooms of a socket to its SocketInfo.
+type SocketDetails struct {
+	SocketInfo
+	Handshake Handshake `json:"handshake"`
+	Rooms     []string  `json:"rooms"`
+}
+
+// Info returns a snapshot of the socket's state.
+func (socket *Socket) Info() SocketInfo {
+	info := SocketInfo{
+		ID:          socket.id,
+		RemoteAddr:  socket.handshake.RemoteAddr,
+		ConnectedAt: socket.handshake.Time,
+	}
+	socket.stateLock.Lock()
+	info.Transport = socket.Transport.Name()
+	info.Upgraded = socket.upgraded
+	info.ReadyState = socket.readyState
+	info.Suspended = socket.suspended
+	info.Buffered = len(socket.writeBuffer)
+	info.LastHeartbeat = socket.lastHeartbeat
+	socket.stateLock.Unlock()
+	return info
+}
+
+// AdminStats describes the load of the server process.
+type AdminStats struct {
+	Sockets    int    `json:"sockets"`
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heapAlloc"`
+	HeapInuse  uint64 `json:"heapInuse"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"numGC"`
+}
+
+// AdminHandler serves the state of a server's sockets as JSON, for
+// debugging production servers. Mount it apart from the engine.io path,
+// under a prefix stripped with http.StripPrefix:
+//
+//	GET    /sockets       lists the sockets, oldest first
+//	GET    /sockets/<id>  details one socket
+//	DELETE /sockets/<id>  closes a socket
+//	GET    /stats         reports memory and goroutine counts
+//
+// Every request must pass the auth hook. The credentials among the handshake
+// headers, such as Cookie and Authorization, are redacted.
+type AdminHandler struct {
+	srv  *Server
+	auth func(*http.Request) bool
+}
+
+// NewAdminHandler returns an admin handler for srv. auth decides whether a
+// request is allowed; with a nil auth, none is.
+func NewAdminHandler(srv *Server, auth func(*http.Request) bool) *AdminHandler {
+	return &AdminHandler{srv: srv, auth: auth}
+}
+
+func (admin *AdminHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if admin.auth == nil || !admin.auth(req) {
+		adminError(res, http.StatusForbidden, "forbidden")
+		return
+	}
+	path := strings.Trim(req.URL.Path, "/")
+	switch {
+	case path == "stats":
+		if req.Method != "GET" {
+			adminError(res, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		admin.stats(res)
+	case path == "sockets":
+		if req.Method != "GET" {
+			adminError(res, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		admin.list(res)
+	case strings.HasPrefix(path, "sockets/"):
+		socket := admin.srv.getClient(strings.TrimPrefix(path, "sockets/"))
+		if socket == nil {
+			adminError(res, http.StatusNotFound, "socket not found")
+			return
+		}
+		switch req.Method {
+		case "GET":
+			writeJSON(res, http.StatusOK, &SocketDetails{
+				SocketInfo: socket.Info(),
+				Handshake:  redactHandshake(socket.Handshake()),
+				Rooms:      socket.Rooms(),
+			})
+		case "DELETE":
+			debug("admin: closing socket", socket.id)
+			socket.Close()
+			res.WriteHeader(http.StatusNoContent)
+		default:
+			adminError(res, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		adminError(res, http.StatusNotFound, "not found")
+	}
+}
+
+// redactedHeaders carry credentials, so the admin handler never shows their
+// values.
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+func redactHandshake(hs Handshake) Handshake {
+	header := hs.Header.Clone()
+	for _, key := range redactedHeaders {
+		if _, ok := header[key]; ok {
+			header[key] = []string{"[redacted]"}
+		}
+	}
+	hs.Header = header
+	return hs
+}
+
+func (admin *AdminHandler) list(res http.ResponseWriter) {
+	admin.srv.clientsLock.Lock()
+	sockets := make([]*Socket, 0, len(admin.srv.Clients))
+	for _, socket := range admin.srv.Clients {
+		sockets = append(sockets, socket)
+	}
+	admin.srv.clientsLock.Unlock()
+
+	infos := make([]SocketInfo, len(sockets))
+	for i, socket := range sockets {
+		infos[i] = socket.Info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].ConnectedAt.Equal(infos[j].ConnectedAt) {
+			return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	writeJSON(res, http.StatusOK, map[string]interface{}{"count": len(infos), "sockets": infos})
+}
+
+func (admin *AdminHandler) stats(res http.ResponseWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(res, http.StatusOK, &AdminStats{
+		Sockets:    admin.srv.ClientsCount(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		HeapInuse:  mem.HeapInuse,
+		Sys:        mem.Sys,
+		NumGC:      mem.NumGC,
+	})
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		adminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(data)
+}
+
+func adminError(res http.ResponseWriter, status int, msg string) {
+	data, _ := json.Marshal(map[string]string{"message": msg})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(data)
+}
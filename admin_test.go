@@ -0,0 +1,88 @@
+package engineio
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func adminRequest(t *testing.T, admin http.Handler, method, path string, v interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	srv := NewServer(nil)
+	sockets, _ := roomPipes(t, srv, 2)
+	sockets[1].Join("r")
+	admin := NewAdminHandler(srv, func(req *http.Request) bool {
+		return req.Header.Get("Authorization") == "Bearer secret"
+	})
+
+	var list struct {
+		Count   int          `json:"count"`
+		Sockets []SocketInfo `json:"sockets"`
+	}
+	expect(t, adminRequest(t, admin, "GET", "/sockets", &list) == 200, "list should succeed")
+	expect(t, list.Count == 2 && len(list.Sockets) == 2, "every socket should be listed:", list.Count)
+	for _, info := range list.Sockets {
+		expect(t, info.Transport == "memory" && info.ReadyState == StateOpen, "listed socket should be open:", info)
+	}
+
+	var details struct {
+		ID         string    `json:"id"`
+		ReadyState string    `json:"readyState"`
+		Handshake  Handshake `json:"handshake"`
+		Rooms      []string  `json:"rooms"`
+	}
+	expect(t, adminRequest(t, admin, "GET", "/sockets/"+sockets[1].ID(), &details) == 200, "details should succeed")
+	expect(t, details.ID == sockets[1].ID() && details.ReadyState == "open", "details should describe the socket:", details)
+	expect(t, len(details.Rooms) == 1 && details.Rooms[0] == "r", "details should list rooms:", details.Rooms)
+
+	expect(t, adminRequest(t, admin, "GET", "/sockets/nope", nil) == 404, "unknown socket should 404")
+	closed := onClose(sockets[0])
+	expect(t, adminRequest(t, admin, "DELETE", "/sockets/"+sockets[0].ID(), nil) == 204, "close should succeed")
+	expect(t, wait(t, closed) == "forced close", "socket should be force closed")
+
+	var stats AdminStats
+	expect(t, adminRequest(t, admin, "GET", "/stats", &stats) == 200, "stats should succeed")
+	expect(t, stats.Goroutines > 0 && stats.HeapAlloc > 0, "stats should report the process:", stats)
+
+	req := httptest.NewRequest("GET", "/sockets", nil)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	expect(t, rec.Code == 403, "unauthorized request should be rejected")
+}
+
+func TestAdminHandlerRedactsHeaders(t *testing.T) {
+	srv, addr := listen(t, nil)
+	sockets := onConnection(srv)
+	get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}}, http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=secret"},
+		"User-Agent":    {"test"},
+	})
+	socket := waitSocket(t, sockets)
+	admin := NewAdminHandler(srv, func(req *http.Request) bool { return true })
+
+	var details struct {
+		Handshake Handshake `json:"handshake"`
+	}
+	expect(t, adminRequest(t, admin, "GET", "/sockets/"+socket.ID(), &details) == 200, "details should succeed")
+	header := details.Handshake.Header
+	expect(t, header.Get("Authorization") == "[redacted]" && header.Get("Cookie") == "[redacted]",
+		"credentials should be redacted:", header)
+	expect(t, header.Get("User-Agent") == "test", "other headers should be shown:", header)
+	expect(t, socket.Header().Get("Cookie") == "session=secret", "the socket's headers should be left alone")
+}
@@ -0,0 +1,318 @@
+// Package bench generates load against an engine.io server and measures it.
+//
+// Each client sends messages of the form "<seq>:<padding>" and expects the
+// server to echo them back, which gives the round-trip time. NewEchoServer
+// returns such a server, for running in-process with RunHandler.
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/client"
+)
+
+type Options struct {
+	// Clients is the number of concurrent clients.
+	Clients int
+	// Transports are the transports clients open with, handed out in
+	// turn: {"polling", "websocket"} opens half of them over each.
+	Transports []string
+	// Upgrade lets polling clients upgrade to websocket.
+	Upgrade bool
+	// Rate is the number of messages each client sends per second. With 0,
+	// clients only connect.
+	Rate float64
+	// Size is the size of the messages in bytes.
+	Size int
+	// Duration is how long the run lasts, from the start of the handshakes.
+	Duration time.Duration
+	// Path is the engine.io endpoint, "/engine.io/" by default.
+	Path   string
+	Header http.Header
+
+	// Admin is the address of the server's admin handler, if any, to read
+	// its stats before the run and at its end, while the clients are still
+	// connected. A path is taken relative to the
+	// server's address. AdminHeader is sent along, for authentication.
+	Admin       string
+	AdminHeader http.Header
+}
+
+// Latencies summarizes a set of durations.
+type Latencies struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func newLatencies(ds []time.Duration) Latencies {
+	if len(ds) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(q float64) time.Duration {
+		return ds[int(q*float64(len(ds)-1))]
+	}
+	return Latencies{Count: len(ds), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: ds[len(ds)-1]}
+}
+
+func (l Latencies) String() string {
+	return fmt.Sprintf("n=%d p50=%v p90=%v p99=%v max=%v", l.Count, l.P50, l.P90, l.P99, l.Max)
+}
+
+type Report struct {
+	Clients   int
+	Connected int
+	Upgraded  int
+	Sent      int
+	Received  int
+	Handshake Latencies
+	RoundTrip Latencies
+	// Errors counts failed handshakes and early closes by reason.
+	Errors map[string]int
+	// Before and Loaded are the server's stats before the clients connect and
+	// at the end of the run, if Options.Admin is set.
+	Before *engineio.AdminStats
+	Loaded *engineio.AdminStats
+}
+
+func (report *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "clients:   %d connected of %d, %d upgraded\n", report.Connected, report.Clients, report.Upgraded)
+	fmt.Fprintf(&b, "messages:  %d sent, %d received\n", report.Sent, report.Received)
+	fmt.Fprintf(&b, "handshake: %v\n", report.Handshake)
+	fmt.Fprintf(&b, "roundtrip: %v\n", report.RoundTrip)
+	reasons := make([]string, 0, len(report.Errors))
+	for reason := range report.Errors {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "error:     %s: %d\n", reason, report.Errors[reason])
+	}
+	for _, s := range []struct {
+		name  string
+		stats *engineio.AdminStats
+	}{{"before", report.Before}, {"loaded", report.Loaded}} {
+		if s.stats != nil {
+			fmt.Fprintf(&b, "server %-7s sockets=%d goroutines=%d heapAlloc=%dKiB sys=%dKiB\n", s.name+":",
+				s.stats.Sockets, s.stats.Goroutines, s.stats.HeapAlloc/1024, s.stats.Sys/1024)
+		}
+	}
+	return b.String()
+}
+
+// run is the state shared by the clients of a run.
+type run struct {
+	opts   *Options
+	addr   string
+	lock   sync.Mutex
+	report *Report
+	shakes []time.Duration
+	trips  []time.Duration
+}
+
+// Run opens opts.Clients clients against the server at addr, lets them send
+// messages for opts.Duration, closes them and reports.
+func Run(addr string, opts *Options) (*Report, error) {
+	if opts.Clients <= 0 {
+		return nil, fmt.Errorf("bench: no clients")
+	}
+	if len(opts.Transports) == 0 {
+		opts.Transports = []string{"polling"}
+	}
+	r := &run{opts: opts, addr: addr, report: &Report{Clients: opts.Clients, Errors: make(map[string]int)}}
+	admin := opts.Admin
+	if strings.HasPrefix(admin, "/") {
+		admin = strings.TrimSuffix(addr, "/") + admin
+	}
+	var err error
+	if len(admin) > 0 {
+		if r.report.Before, err = adminStats(admin, opts.AdminHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	end := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Clients; i++ {
+		wg.Add(1)
+		go func(transport string) {
+			defer wg.Done()
+			r.client(transport, end)
+		}(opts.Transports[i%len(opts.Transports)])
+	}
+	time.Sleep(opts.Duration)
+	if len(admin) > 0 {
+		r.report.Loaded, err = adminStats(admin, opts.AdminHeader)
+	}
+	close(end)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	r.report.Handshake = newLatencies(r.shakes)
+	r.report.RoundTrip = newLatencies(r.trips)
+	return r.report, nil
+}
+
+// RunHandler runs against handler, served from this process.
+func RunHandler(handler http.Handler, opts *Options) (*Report, error) {
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	return Run(ts.URL, opts)
+}
+
+func (r *run) fail(reason string) {
+	r.lock.Lock()
+	r.report.Errors[reason]++
+	r.lock.Unlock()
+}
+
+func (r *run) client(transport string, end chan bool) {
+	transports := []string{transport}
+	if transport == "polling" && r.opts.Upgrade {
+		transports = append(transports, "websocket")
+	}
+	c, err := client.New(r.addr, &client.Options{
+		Path:       r.opts.Path,
+		Transports: transports,
+		NoUpgrade:  !r.opts.Upgrade,
+		Header:     r.opts.Header,
+	})
+	if err != nil {
+		r.fail("handshake: " + err.Error())
+		return
+	}
+
+	var lock sync.Mutex
+	sentAt := make(map[int]time.Time)
+	c.On("message", func(data []byte) {
+		i := bytes.IndexByte(data, ':')
+		if i < 0 {
+			return
+		}
+		seq, err := strconv.Atoi(string(data[:i]))
+		if err != nil {
+			return
+		}
+		lock.Lock()
+		at, ok := sentAt[seq]
+		delete(sentAt, seq)
+		lock.Unlock()
+		if ok {
+			r.lock.Lock()
+			r.report.Received++
+			r.trips = append(r.trips, time.Since(at))
+			r.lock.Unlock()
+		}
+	})
+	upgraded := make(chan bool, 1)
+	c.On("upgrade", func(string) {
+		upgraded <- true
+	})
+
+	start := time.Now()
+	if err := c.Open(); err != nil {
+		r.fail("handshake: " + err.Error())
+		return
+	}
+	r.lock.Lock()
+	r.report.Connected++
+	r.shakes = append(r.shakes, time.Since(start))
+	r.lock.Unlock()
+
+	var tick <-chan time.Time
+	if r.opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for seq := 0; ; seq++ {
+		select {
+		case <-tick:
+			msg := []byte(strconv.Itoa(seq) + ":")
+			if len(msg) < r.opts.Size {
+				msg = append(msg, bytes.Repeat([]byte{'x'}, r.opts.Size-len(msg))...)
+			}
+			lock.Lock()
+			sentAt[seq] = time.Now()
+			lock.Unlock()
+			if c.Send(msg) == nil {
+				r.lock.Lock()
+				r.report.Sent++
+				r.lock.Unlock()
+			}
+		case <-c.Done():
+			r.fail(c.CloseReason())
+			return
+		case <-end:
+			select {
+			case <-upgraded:
+				r.lock.Lock()
+				r.report.Upgraded++
+				r.lock.Unlock()
+			default:
+			}
+			c.Close()
+			return
+		}
+	}
+}
+
+func adminStats(addr string, header http.Header) (*engineio.AdminStats, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bench: admin stats returned %d", res.StatusCode)
+	}
+	stats := new(engineio.AdminStats)
+	if err := json.NewDecoder(res.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// NewEchoServer returns a server echoing every message, and a handler serving
+// it under "/engine.io/" with an admin handler open to every request under
+// "/admin/", for benchmarking in-process.
+func NewEchoServer(opts engineio.Options) (*engineio.Server, http.Handler) {
+	srv := engineio.NewServer(opts)
+	srv.On("connection", func(socket *engineio.Socket) {
+		socket.On("message", func(data []byte, isBin bool) {
+			if isBin {
+				socket.SendBin(data)
+			} else {
+				socket.Send(data)
+			}
+		})
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/engine.io/", srv)
+	mux.Handle("/admin/", http.StripPrefix("/admin", engineio.NewAdminHandler(srv, func(*http.Request) bool {
+		return true
+	})))
+	return srv, mux
+}
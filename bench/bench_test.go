@@ -0,0 +1,51 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	srv, handler := NewEchoServer(nil)
+	defer srv.Close()
+	report, err := RunHandler(handler, &Options{
+		Clients:    6,
+		Transports: []string{"polling", "websocket"},
+		Upgrade:    true,
+		Rate:       50,
+		Size:       64,
+		Duration:   300 * time.Millisecond,
+		Admin:      "/admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Connected != 6 || len(report.Errors) != 0 {
+		t.Error("every client should connect without errors:", report)
+	}
+	if report.Sent == 0 || report.Received == 0 || report.RoundTrip.Count != report.Received {
+		t.Error("messages should be echoed:", report)
+	}
+	if report.Before == nil || report.Loaded == nil || report.Loaded.Sockets != 6 {
+		t.Error("server stats should be read:", report)
+	}
+}
+
+func BenchmarkEcho(b *testing.B) {
+	srv, handler := NewEchoServer(nil)
+	defer srv.Close()
+	for i := 0; i < b.N; i++ {
+		report, err := RunHandler(handler, &Options{
+			Clients:    50,
+			Transports: []string{"websocket"},
+			Rate:       100,
+			Size:       128,
+			Duration:   time.Second,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(report.RoundTrip.P99.Microseconds()), "p99-µs")
+		b.ReportMetric(float64(report.Handshake.P50.Microseconds()), "handshake-p50-µs")
+	}
+}
@@ -0,0 +1,138 @@
+package engineio
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// Bus is a publish/subscribe channel between the nodes of a cluster, such as
+// Redis or NATS pub/sub. Every message published on a channel must reach
+// every subscriber of that channel, including the publisher's own.
+type Bus interface {
+	Publish(channel string, msg []byte) error
+	// Subscribe calls fn with each message published on channel until
+	// unsubscribe is called.
+	Subscribe(channel string, fn func(msg []byte)) (unsubscribe func(), err error)
+}
+
+// MemoryBus is a Bus within one process, for tests and for running several
+// servers side by side. Publish delivers to the subscribers before it
+// returns.
+type MemoryBus struct {
+	lock sync.Mutex
+	subs map[string]map[int]func([]byte)
+	next int
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subs: make(map[string]map[int]func([]byte))}
+}
+
+func (bus *MemoryBus) Publish(channel string, msg []byte) error {
+	bus.lock.Lock()
+	fns := make([]func([]byte), 0, len(bus.subs[channel]))
+	for _, fn := range bus.subs[channel] {
+		fns = append(fns, fn)
+	}
+	bus.lock.Unlock()
+	for _, fn := range fns {
+		fn(append([]byte(nil), msg...))
+	}
+	return nil
+}
+
+func (bus *MemoryBus) Subscribe(channel string, fn func([]byte)) (func(), error) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.subs[channel] == nil {
+		bus.subs[channel] = make(map[int]func([]byte))
+	}
+	id := bus.next
+	bus.next++
+	bus.subs[channel][id] = fn
+	return func() {
+		bus.lock.Lock()
+		defer bus.lock.Unlock()
+		delete(bus.subs[channel], id)
+	}, nil
+}
+
+// BusAdapter is an Adapter for a cluster. Rooms are kept per node, and
+// broadcasts are published on a Bus so that every node delivers them to its
+// own sockets.
+type BusAdapter struct {
+	*MemoryAdapter
+
+	bus         Bus
+	channel     string
+	node        string
+	unsubscribe func()
+}
+
+type busMessage struct {
+	Node    string           `json:"node"`
+	Opts    BroadcastOptions `json:"opts"`
+	Packets []*parser.Packet `json:"packets"`
+}
+
+// NewBusAdapter subscribes to channel on bus. Every node of the cluster must
+// use the same channel.
+func NewBusAdapter(bus Bus, channel string) (*BusAdapter, error) {
+	node := make([]byte, 8)
+	if _, err := rand.Read(node); err != nil {
+		return nil, err
+	}
+	adapter := &BusAdapter{
+		MemoryAdapter: NewMemoryAdapter(),
+		bus:           bus,
+		channel:       channel,
+		node:          hex.EncodeToString(node),
+	}
+	unsubscribe, err := bus.Subscribe(channel, adapter.onMessage)
+	if err != nil {
+		return nil, err
+	}
+	adapter.unsubscribe = unsubscribe
+	return adapter, nil
+}
+
+// Broadcast delivers pkts to the sockets of this node and publishes them for
+// the others.
+func (adapter *BusAdapter) Broadcast(pkts []*parser.Packet, opts BroadcastOptions) {
+	adapter.MemoryAdapter.Broadcast(pkts, opts)
+	msg, err := json.Marshal(&busMessage{Node: adapter.node, Opts: opts, Packets: pkts})
+	if err != nil {
+		debug("bus adapter: encoding broadcast:", err)
+		return
+	}
+	if err := adapter.bus.Publish(adapter.channel, msg); err != nil {
+		debug("bus adapter: publishing broadcast:", err)
+	}
+}
+
+func (adapter *BusAdapter) onMessage(data []byte) {
+	var msg busMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		debug("bus adapter: bad message:", err)
+		return
+	}
+	if msg.Node == adapter.node {
+		return
+	}
+	pkts := make([]*parser.Packet, 0, len(msg.Packets))
+	for _, pkt := range msg.Packets {
+		if pkt != nil {
+			pkts = append(pkts, parser.Shared(*pkt))
+		}
+	}
+	adapter.MemoryAdapter.Broadcast(pkts, msg.Opts)
+}
+
+func (adapter *BusAdapter) Close() error {
+	adapter.unsubscribe()
+	return nil
+}
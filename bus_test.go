@@ -0,0 +1,60 @@
+package engineio
+
+import (
+	"testing"
+)
+
+func busServers(t *testing.T, bus Bus, n int) []*Server {
+	t.Helper()
+	servers := make([]*Server, n)
+	for i := range servers {
+		adapter, err := NewBusAdapter(bus, "eio")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = NewServer(Options{"adapter": adapter})
+	}
+	return servers
+}
+
+func TestBusBroadcast(t *testing.T) {
+	servers := busServers(t, NewMemoryBus(), 2)
+	_, pipes0 := roomPipes(t, servers[0], 1)
+	_, pipes1 := roomPipes(t, servers[1], 2)
+	servers[0].Broadcast([]byte("all"))
+	for _, pipe := range append(pipes0, pipes1...) {
+		expect(t, string(nextPacket(t, pipe).Data) == "all", "every node should deliver the broadcast")
+		expectNothing(t, pipe)
+	}
+}
+
+func TestBusRooms(t *testing.T) {
+	servers := busServers(t, NewMemoryBus(), 2)
+	sockets0, pipes0 := roomPipes(t, servers[0], 1)
+	sockets1, pipes1 := roomPipes(t, servers[1], 2)
+	sockets0[0].Join("r")
+	sockets1[0].Join("r")
+	sockets1[1].Join("r")
+
+	servers[0].To("r").Except(sockets1[1].ID()).SendBin([]byte{7})
+	pkt := nextPacket(t, pipes0[0])
+	expect(t, pkt.IsBin && pkt.Data[0] == 7, "local member should get the message")
+	pkt = nextPacket(t, pipes1[0])
+	expect(t, pkt.IsBin && pkt.Data[0] == 7, "remote member should get the message")
+	expectNothing(t, pipes1[1])
+
+	expect(t, len(servers[1].To("r").Sockets()) == 2, "Sockets should only list local members")
+}
+
+func TestBusClose(t *testing.T) {
+	bus := NewMemoryBus()
+	servers := busServers(t, bus, 2)
+	_, pipes := roomPipes(t, servers[1], 1)
+	servers[1].Close()
+	<-pipes[0].Done()
+	servers[0].Broadcast([]byte("gone"))
+	expectNothing(t, pipes[0])
+	bus.lock.Lock()
+	expect(t, len(bus.subs["eio"]) == 1, "closed server should unsubscribe")
+	bus.lock.Unlock()
+}
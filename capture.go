@@ -0,0 +1,97 @@
+package engineio
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// CaptureRecord is one packet of a capture. A capture file holds one record
+// per line, as JSON:
+//
+//	{"time":"2024-05-01T10:00:00.123Z","sid":"3","transport":"polling","dir":"in","raw":"NGhp"}
+//
+// dir is "in" for packets from the client and "out" for packets to it. raw
+// is the packet as the parser encodes it for the transport, base64 encoded
+// in the JSON: binary packets of transports without binary support are in
+// their "b" base64 form.
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Sid       string    `json:"sid"`
+	Transport string    `json:"transport"`
+	Dir       string    `json:"dir"`
+	Raw       []byte    `json:"raw"`
+}
+
+// Packet decodes the raw bytes of the record.
+func (rec *CaptureRecord) Packet() parser.Packet {
+	return parser.DecodePacket(rec.Raw)
+}
+
+// Capture writes the packets of sockets to a capture file. Set the "capture"
+// option to capture every socket of a server, or call Socket.Capture for
+// one. It may be shared by many sockets.
+type Capture struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	err  error
+}
+
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing the capture. Records are dropped after
+// it.
+func (capture *Capture) Err() error {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	return capture.err
+}
+
+func (capture *Capture) record(rec *CaptureRecord) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if capture.err == nil {
+		capture.err = capture.enc.Encode(rec)
+	}
+}
+
+// ReadCapture reads every record of a capture file.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var recs []CaptureRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Capture starts writing the packets of the socket to capture, or stops with
+// nil.
+func (socket *Socket) Capture(capture *Capture) {
+	socket.post(func() {
+		socket.capture = capture
+	})
+}
+
+func (socket *Socket) capturePacket(dir string, transport Transport, packet *parser.Packet) {
+	if socket.capture == nil {
+		return
+	}
+	socket.capture.record(&CaptureRecord{
+		Time:      socket.server.clock.Now(),
+		Sid:       socket.id,
+		Transport: transport.Name(),
+		Dir:       dir,
+		Raw:       parser.AppendPacket(nil, packet, transport.getSupportsBinary()),
+	})
+}
@@ -0,0 +1,720 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kaicheng/engineio/parser"
+	"github.com/kaicheng/events"
+)
+
+// Options configures a Client. The zero value opens with polling and upgrades
+// to websocket when the server offers it.
+type Options struct {
+	// Path is the engine.io endpoint, "/engine.io/" by default.
+	Path string
+	// Transports lists the transports to use. The first one opens the
+	// connection, later ones are upgrade candidates.
+	Transports []string
+	// NoUpgrade keeps the client on its opening transport.
+	NoUpgrade bool
+	// B64 asks the server to send binary data base64 encoded.
+	B64 bool
+	// JSONP polls the way browsers without CORS do: responses are wrapped
+	// in a script call and data is posted as a form. It implies B64.
+	JSONP bool
+	// NoHeartbeat stops the client from sending pings, to test server side
+	// ping timeouts.
+	NoHeartbeat bool
+	// EIO is the protocol version sent to the server, 3 by default. The
+	// client only speaks version 3; others are for testing how servers
+	// answer them.
+	EIO int
+
+	Query      url.Values
+	Header     http.Header
+	HTTPClient *http.Client
+}
+
+type Handshake struct {
+	Sid          string   `json:"sid"`
+	Upgrades     []string `json:"upgrades"`
+	PingInterval int      `json:"pingInterval"`
+	PingTimeout  int      `json:"pingTimeout"`
+}
+
+var (
+	ErrClosed       = errors.New("client: closed")
+	ErrBadHandshake = errors.New("client: bad handshake")
+)
+
+// Client is an engine.io client. It emits the following events:
+//
+//	"open"      after the handshake
+//	"packet"    func(*parser.Packet) for every packet received
+//	"message"   func(data []byte, isBin bool)
+//	"upgrade"   func(transport string) once an upgrade completes
+//	"close"     func(reason string)
+type Client struct {
+	events.EventEmitter
+
+	Handshake Handshake
+
+	opts *Options
+	base *url.URL
+	http *http.Client
+
+	// sendLock serializes writes.
+	sendLock  sync.Mutex
+	stateLock sync.Mutex
+	transport string
+	ws        *websocket.Conn
+
+	openCancel context.CancelFunc
+	upgrading  bool
+	pollCancel context.CancelFunc
+	pausePoll  chan bool
+	pollDone   chan bool
+
+	// While the transport is being switched, sends are queued and go out
+	// over the new transport. Both are guarded by sendLock.
+	switching   bool
+	switchQueue []*parser.Packet
+
+	pingIntervalTimer *time.Timer
+	pingTimeoutTimer  *time.Timer
+
+	closing bool
+	closed  chan bool
+	reason  string
+}
+
+func New(rawurl string, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Scheme {
+	case "ws":
+		base.Scheme = "http"
+	case "wss":
+		base.Scheme = "https"
+	}
+	if len(opts.Path) > 0 {
+		base.Path = opts.Path
+	} else if len(base.Path) == 0 || base.Path == "/" {
+		base.Path = "/engine.io/"
+	}
+	if len(opts.Transports) == 0 {
+		opts.Transports = []string{"polling", "websocket"}
+	}
+	if opts.EIO == 0 {
+		opts.EIO = 3
+	}
+	if opts.JSONP {
+		opts.B64 = true
+	}
+
+	c := new(Client)
+	c.opts = opts
+	c.base = base
+	c.http = opts.HTTPClient
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	c.closed = make(chan bool)
+	return c, nil
+}
+
+// Dial creates a client and opens it.
+func Dial(rawurl string, opts *Options) (*Client, error) {
+	c, err := New(rawurl, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Open()
+}
+
+func (c *Client) url(transport string) string {
+	u := *c.base
+	query := u.Query()
+	for k, v := range c.opts.Query {
+		query[k] = v
+	}
+	query.Set("EIO", strconv.Itoa(c.opts.EIO))
+	query.Set("transport", transport)
+	if c.opts.B64 {
+		query.Set("b64", "1")
+	}
+	if c.opts.JSONP && transport == "polling" {
+		query.Set("j", "0")
+	}
+	if len(c.Handshake.Sid) > 0 {
+		query.Set("sid", c.Handshake.Sid)
+	}
+	if transport == "websocket" {
+		if u.Scheme == "https" {
+			u.Scheme = "wss"
+		} else {
+			u.Scheme = "ws"
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Open performs the handshake on the first transport, emits "open" and starts
+// receiving. Register listeners before calling Open to see every packet. If
+// the handshake fails, the client closes with reason "transport error"; if
+// Close is called meanwhile, Open gives up and returns ErrClosed.
+func (c *Client) Open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.stateLock.Lock()
+	if c.isClosed() {
+		c.stateLock.Unlock()
+		return ErrClosed
+	}
+	c.openCancel = cancel
+	c.stateLock.Unlock()
+
+	transport := c.opts.Transports[0]
+	var pkts []parser.Packet
+	var err error
+	switch transport {
+	case "polling":
+		pkts, err = c.poll(ctx)
+	case "websocket":
+		pkts, err = c.openWebSocket(ctx)
+	default:
+		err = fmt.Errorf("client: unknown transport %q", transport)
+	}
+	if err == nil && (len(pkts) == 0 || pkts[0].Type != "open") {
+		err = ErrBadHandshake
+	}
+	if err == nil && json.Unmarshal(pkts[0].Data, &c.Handshake) != nil {
+		err = ErrBadHandshake
+	}
+	if err != nil {
+		if c.isClosed() {
+			return ErrClosed
+		}
+		c.onClose("transport error")
+		return err
+	}
+
+	c.stateLock.Lock()
+	if c.isClosed() {
+		c.stateLock.Unlock()
+		return ErrClosed
+	}
+	c.transport = transport
+	c.stateLock.Unlock()
+	c.Emit("open")
+	c.onHeartbeat(c.pingInterval() + c.pingTimeout())
+	c.setPing()
+	for i := 1; i < len(pkts); i++ {
+		c.onPacket(&pkts[i])
+	}
+
+	if transport == "polling" {
+		c.pausePoll = make(chan bool)
+		c.pollDone = make(chan bool)
+		go c.pollLoop()
+		if !c.opts.NoUpgrade && c.canUpgrade() {
+			go c.Upgrade()
+		}
+	} else {
+		go c.readLoop(c.ws)
+	}
+	return nil
+}
+
+func (c *Client) pingInterval() time.Duration {
+	return time.Duration(c.Handshake.PingInterval) * time.Millisecond
+}
+
+func (c *Client) pingTimeout() time.Duration {
+	return time.Duration(c.Handshake.PingTimeout) * time.Millisecond
+}
+
+func (c *Client) canUpgrade() bool {
+	for _, t := range c.opts.Transports[1:] {
+		if t != "websocket" {
+			continue
+		}
+		for _, u := range c.Handshake.Upgrades {
+			if u == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TransportName returns the name of the transport in use.
+func (c *Client) TransportName() string {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.transport
+}
+
+// Done is closed once the client is closed.
+func (c *Client) Done() <-chan bool {
+	return c.closed
+}
+
+// CloseReason returns why the client closed, once Done is closed.
+func (c *Client) CloseReason() string {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.reason
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) onPacket(pkt *parser.Packet) {
+	if c.isClosed() {
+		return
+	}
+	c.Emit("packet", pkt)
+	c.onHeartbeat(c.pingInterval() + c.pingTimeout())
+
+	switch pkt.Type {
+	case "pong":
+		c.setPing()
+	case "message":
+		c.Emit("message", pkt.Data, pkt.IsBin)
+	case "close":
+		c.onClose("transport close")
+	case "error":
+		c.onClose("parse error")
+	}
+}
+
+func (c *Client) onHeartbeat(timeout time.Duration) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.pingTimeoutTimer != nil {
+		c.pingTimeoutTimer.Stop()
+	}
+	c.pingTimeoutTimer = time.AfterFunc(timeout, func() {
+		c.onClose("ping timeout")
+	})
+}
+
+func (c *Client) setPing() {
+	if c.opts.NoHeartbeat {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.pingIntervalTimer != nil {
+		c.pingIntervalTimer.Stop()
+	}
+	c.pingIntervalTimer = time.AfterFunc(c.pingInterval(), func() {
+		c.SendPacket(&parser.Packet{Type: "ping"})
+		c.onHeartbeat(c.pingTimeout())
+	})
+}
+
+func (c *Client) onClose(reason string) {
+	c.stateLock.Lock()
+	if c.isClosed() {
+		c.stateLock.Unlock()
+		return
+	}
+	if c.closing {
+		// The server may answer our close packet before Close gets here.
+		reason = "forced close"
+	}
+	c.reason = reason
+	close(c.closed)
+	if c.pingIntervalTimer != nil {
+		c.pingIntervalTimer.Stop()
+	}
+	if c.pingTimeoutTimer != nil {
+		c.pingTimeoutTimer.Stop()
+	}
+	if c.openCancel != nil {
+		c.openCancel()
+	}
+	if c.pollCancel != nil {
+		c.pollCancel()
+	}
+	ws := c.ws
+	c.stateLock.Unlock()
+
+	if ws != nil {
+		ws.Close()
+	}
+	c.Emit("close", reason)
+}
+
+// Close sends a close packet and shuts the client down with reason
+// "forced close". Before the handshake completes, there is no one to send
+// the close packet to, so it only cancels the handshake.
+func (c *Client) Close() {
+	if c.isClosed() {
+		return
+	}
+	c.stateLock.Lock()
+	c.closing = true
+	open := len(c.transport) > 0
+	c.stateLock.Unlock()
+	if open {
+		c.SendPacket(&parser.Packet{Type: "close"})
+	}
+	c.onClose("forced close")
+}
+
+func (c *Client) Send(data []byte) error {
+	return c.SendPacket(&parser.Packet{Type: "message", Data: data})
+}
+
+func (c *Client) SendBin(data []byte) error {
+	return c.SendPacket(&parser.Packet{Type: "message", Data: data, IsBin: true})
+}
+
+// SendPacket sends pkts in a single payload when polling, or as one frame
+// each over websocket.
+func (c *Client) SendPacket(pkts ...*parser.Packet) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if c.switching {
+		c.switchQueue = append(c.switchQueue, pkts...)
+		return nil
+	}
+
+	c.stateLock.Lock()
+	transport, ws := c.transport, c.ws
+	c.stateLock.Unlock()
+	if transport == "websocket" {
+		for _, pkt := range pkts {
+			if err := c.writeWebSocket(ws, pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.post(pkts)
+}
+
+func (c *Client) post(pkts []*parser.Packet) error {
+	ptrs := make([]*parser.Packet, len(pkts))
+	copy(ptrs, pkts)
+	data := parser.AppendPayload(nil, ptrs, !c.opts.B64)
+	contentType := "text/plain;charset=UTF-8"
+	if c.opts.JSONP {
+		data = []byte(url.Values{"d": {escapeJSONP(string(data))}}.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	} else if len(data) > 0 && data[0] < 0x20 {
+		contentType = "application/octet-stream"
+	}
+	req, err := http.NewRequest("POST", c.url("polling"), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req.Header)
+	req.Header.Set("Content-Type", contentType)
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != 200 {
+		return fmt.Errorf("client: POST returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) setHeaders(header http.Header) {
+	for k, v := range c.opts.Header {
+		header[k] = v
+	}
+}
+
+// poll performs a single polling GET and decodes its payload.
+func (c *Client) poll(ctx context.Context) ([]parser.Packet, error) {
+	req, err := http.NewRequest("GET", c.url("polling"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	c.setHeaders(req.Header)
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("client: GET returned %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var body io.Reader = res.Body
+	if c.opts.JSONP {
+		payload, err := readJSONP(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(payload)
+	}
+
+	pkts := make([]parser.Packet, 0)
+	dec := parser.NewPayloadDecoder(body)
+	for {
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			return pkts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+// escapeJSONP escapes newlines the way browser clients do before putting a
+// payload in a form's textarea, which would normalize them: escaped newlines
+// get another backslash, and real ones become escaped newlines.
+func escapeJSONP(data string) string {
+	data = strings.ReplaceAll(data, `\n`, "\\\n")
+	return strings.ReplaceAll(data, "\n", `\n`)
+}
+
+// readJSONP unwraps the payload from a JSONP response, which calls
+// ___eio[j] with the payload as a JSON string.
+func readJSONP(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndex(data, []byte(");"))
+	if !bytes.HasPrefix(data, []byte("___eio[")) || start < 0 || end < start {
+		return "", fmt.Errorf("client: bad JSONP response %q", data)
+	}
+	var payload string
+	if err := json.Unmarshal(data[start+1:end], &payload); err != nil {
+		return "", err
+	}
+	return payload, nil
+}
+
+func (c *Client) pollLoop() {
+	defer close(c.pollDone)
+	for {
+		select {
+		case <-c.pausePoll:
+			return
+		case <-c.closed:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c.stateLock.Lock()
+		c.pollCancel = cancel
+		c.stateLock.Unlock()
+		pkts, err := c.poll(ctx)
+		cancel()
+		if err != nil {
+			c.onClose("transport error")
+			return
+		}
+		for i := range pkts {
+			c.onPacket(&pkts[i])
+		}
+	}
+}
+
+func (c *Client) openWebSocket(ctx context.Context) ([]parser.Packet, error) {
+	header := http.Header{}
+	c.setHeaders(header)
+	ws, err := dialWebSocket(ctx, c.url("websocket"), header)
+	if err != nil {
+		return nil, err
+	}
+	c.stateLock.Lock()
+	if c.isClosed() {
+		c.stateLock.Unlock()
+		ws.Close()
+		return nil, ErrClosed
+	}
+	c.ws = ws
+	c.stateLock.Unlock()
+
+	pkt, err := readWebSocket(ws)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return []parser.Packet{pkt}, nil
+}
+
+// dialWebSocket dials like websocket.DefaultDialer, but also gives up on the
+// opening handshake once ctx is done, which the dialer only does for the
+// connection itself.
+func dialWebSocket(ctx context.Context, rawurl string, header http.Header) (*websocket.Conn, error) {
+	dialed := make(chan bool)
+	defer close(dialed)
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				// ctx is also done once the dial is over, which leaves the
+				// connection alone.
+				select {
+				case <-dialed:
+				default:
+					conn.Close()
+				}
+			case <-dialed:
+			}
+		}()
+		return conn, nil
+	}
+	ws, _, err := dialer.DialContext(ctx, rawurl, header)
+	return ws, err
+}
+
+func readWebSocket(ws *websocket.Conn) (parser.Packet, error) {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return parser.Packet{}, err
+	}
+	return parser.DecodePacket(data), nil
+}
+
+func (c *Client) writeWebSocket(ws *websocket.Conn, pkt *parser.Packet) error {
+	data := parser.AppendPacket(nil, pkt, !c.opts.B64)
+	msgType := websocket.TextMessage
+	if pkt.IsBin && !c.opts.B64 {
+		msgType = websocket.BinaryMessage
+	}
+	return ws.WriteMessage(msgType, data)
+}
+
+func (c *Client) readLoop(ws *websocket.Conn) {
+	for {
+		pkt, err := readWebSocket(ws)
+		if err != nil {
+			c.onClose("transport close")
+			return
+		}
+		c.onPacket(&pkt)
+	}
+}
+
+// Upgrade switches a polling client to websocket using the probe handshake:
+// ping "probe", wait for pong "probe", pause polling and send "upgrade".
+func (c *Client) Upgrade() error {
+	c.stateLock.Lock()
+	if c.upgrading || c.transport != "polling" {
+		c.stateLock.Unlock()
+		return fmt.Errorf("client: cannot upgrade from %q", c.transport)
+	}
+	c.upgrading = true
+	c.stateLock.Unlock()
+
+	err := c.upgrade()
+	if err != nil {
+		c.stateLock.Lock()
+		c.upgrading = false
+		c.stateLock.Unlock()
+	}
+	return err
+}
+
+func (c *Client) upgrade() error {
+	header := http.Header{}
+	c.setHeaders(header)
+	ws, _, err := websocket.DefaultDialer.Dial(c.url("websocket"), header)
+	if err != nil {
+		return err
+	}
+	if err := c.writeWebSocket(ws, &parser.Packet{Type: "ping", Data: []byte("probe")}); err != nil {
+		ws.Close()
+		return err
+	}
+	pkt, err := readWebSocket(ws)
+	if err != nil || pkt.Type != "pong" || string(pkt.Data) != "probe" {
+		ws.Close()
+		return fmt.Errorf("client: probe failed")
+	}
+
+	c.sendLock.Lock()
+	if c.isClosed() {
+		c.sendLock.Unlock()
+		ws.Close()
+		return ErrClosed
+	}
+	c.switching = true
+	c.sendLock.Unlock()
+	// The server answers the pending poll with a noop once it has seen the
+	// probe, which lets the poll loop stop. Its listeners may send meanwhile,
+	// so the lock isn't held while waiting.
+	close(c.pausePoll)
+	<-c.pollDone
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	queue := c.switchQueue
+	c.switching, c.switchQueue = false, nil
+	err = c.writeWebSocket(ws, &parser.Packet{Type: "upgrade"})
+	for i := 0; err == nil && i < len(queue); i++ {
+		err = c.writeWebSocket(ws, queue[i])
+	}
+	if err != nil {
+		// Polling is already paused, so there is nothing to fall back on.
+		ws.Close()
+		c.onClose("transport error")
+		return err
+	}
+
+	c.stateLock.Lock()
+	if c.isClosed() {
+		// Closed while upgrading; onClose didn't see this websocket.
+		c.stateLock.Unlock()
+		ws.Close()
+		return ErrClosed
+	}
+	c.ws = ws
+	c.transport = "websocket"
+	c.stateLock.Unlock()
+	go c.readLoop(ws)
+	c.Emit("upgrade", "websocket")
+	return nil
+}
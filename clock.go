@@ -0,0 +1,171 @@
+package engineio
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for every socket timer: the ping timeout, the
+// upgrade timeout and the noop ticker used during upgrades. It is set with
+// the "clock" option and defaults to the system clock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, fn func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return time.AfterFunc(d, fn)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// FakeClock is a Clock that only moves when Advance is called, so that tests
+// can drive timeouts deterministically.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	when   time.Time
+	period time.Duration
+	fn     func()
+	c      chan time.Time
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0)}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: clock, fn: fn}
+	clock.add(t, d)
+	return t
+}
+
+func (clock *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: clock, period: d, c: make(chan time.Time, 1)}
+	clock.add(t, d)
+	return fakeTicker{t}
+}
+
+// Pending returns the number of timers and tickers that haven't been stopped
+// or fired yet.
+func (clock *FakeClock) Pending() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.timers)
+}
+
+// Advance moves the clock forward by d. Timers due within d fire in order,
+// on the calling goroutine, each one seeing Now() at its own deadline.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	end := clock.now.Add(d)
+	for len(clock.timers) > 0 && !clock.timers[0].when.After(end) {
+		t := clock.timers[0]
+		clock.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			clock.sort()
+		} else {
+			clock.timers = clock.timers[1:]
+		}
+		now := clock.now
+		clock.lock.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			select {
+			case t.c <- now:
+			default:
+			}
+		}
+
+		clock.lock.Lock()
+	}
+	clock.now = end
+	clock.lock.Unlock()
+}
+
+func (clock *FakeClock) add(t *fakeTimer, d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	t.when = clock.now.Add(d)
+	clock.timers = append(clock.timers, t)
+	clock.sort()
+}
+
+func (clock *FakeClock) sort() {
+	sort.SliceStable(clock.timers, func(i, j int) bool {
+		return clock.timers[i].when.Before(clock.timers[j].when)
+	})
+}
+
+func (t *fakeTimer) Stop() bool {
+	clock := t.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for i, other := range clock.timers {
+		if other == t {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
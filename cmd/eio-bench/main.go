@@ -0,0 +1,76 @@
+// Command eio-bench opens many concurrent clients against an engine.io server
+// that echoes messages, and reports handshake and round-trip latencies,
+// errors by close reason and, with -admin, the server's memory and goroutine
+// counts.
+//
+//	eio-bench -clients 1000 -rate 1 -duration 1m http://localhost:8080
+//	eio-bench -inprocess -clients 200
+//
+// With -inprocess, it runs against an echo server in its own process.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kaicheng/engineio/bench"
+)
+
+func main() {
+	clients := flag.Int("clients", 100, "number of concurrent clients")
+	transports := flag.String("transports", "polling", "comma separated transports handed out to clients in turn")
+	upgrade := flag.Bool("upgrade", false, "let polling clients upgrade to websocket")
+	rate := flag.Float64("rate", 1, "messages per second per client, 0 to only connect")
+	size := flag.Int("size", 64, "message size in bytes")
+	duration := flag.Duration("duration", 10*time.Second, "length of the run")
+	path := flag.String("path", "/engine.io/", "engine.io endpoint")
+	admin := flag.String("admin", "", "address of the server's admin handler, a path is relative to the server")
+	adminAuth := flag.String("admin-auth", "", "Authorization header for the admin handler")
+	inprocess := flag.Bool("inprocess", false, "run against an echo server in this process")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: eio-bench [flags] url")
+		fmt.Fprintln(os.Stderr, "       eio-bench -inprocess [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts := &bench.Options{
+		Clients:    *clients,
+		Transports: strings.Split(*transports, ","),
+		Upgrade:    *upgrade,
+		Rate:       *rate,
+		Size:       *size,
+		Duration:   *duration,
+		Path:       *path,
+		Admin:      *admin,
+	}
+	if len(*adminAuth) > 0 {
+		opts.AdminHeader = http.Header{"Authorization": {*adminAuth}}
+	}
+
+	var report *bench.Report
+	var err error
+	switch {
+	case *inprocess && flag.NArg() == 0:
+		srv, handler := bench.NewEchoServer(nil)
+		if len(opts.Admin) == 0 {
+			opts.Admin = "/admin"
+		}
+		report, err = bench.RunHandler(handler, opts)
+		srv.Close()
+	case !*inprocess && flag.NArg() == 1:
+		report, err = bench.Run(flag.Arg(0), opts)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "eio-bench:", err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+}
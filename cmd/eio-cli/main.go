@@ -0,0 +1,165 @@
+// Command eio-cli connects to an engine.io server, prints the handshake and
+// every packet it receives, and sends the lines of its standard input as
+// messages. It is meant for poking at deployments by hand.
+//
+//	eio-cli [flags] http://localhost:8080
+//
+// Each line read is sent as a text message, except lines starting with
+// "bin ", whose rest is decoded as hex and sent as a binary message. Binary
+// packets received are hex dumped. The command exits when standard input
+// ends or the connection closes.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kaicheng/engineio/client"
+	"github.com/kaicheng/engineio/parser"
+)
+
+// multiFlag collects the values of a flag given several times.
+type multiFlag []string
+
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// out serializes the output of the packet listeners and the input loop.
+var out sync.Mutex
+
+func printf(format string, args ...interface{}) {
+	out.Lock()
+	defer out.Unlock()
+	fmt.Printf(format, args...)
+}
+
+func main() {
+	transport := flag.String("transport", "upgrade", "polling, websocket, or upgrade for polling then websocket")
+	path := flag.String("path", "/engine.io/", "engine.io endpoint")
+	eio := flag.Int("eio", 3, "protocol version sent in the EIO query parameter")
+	b64 := flag.Bool("b64", false, "ask for binary data base64 encoded")
+	pings := flag.Bool("pings", false, "print pings and pongs too")
+	var queries, headers multiFlag
+	flag.Var(&queries, "query", "extra query parameter as key=value, may be repeated")
+	flag.Var(&headers, "header", "extra header as \"Key: value\", may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: eio-cli [flags] url")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := &client.Options{Path: *path, EIO: *eio, B64: *b64, Query: url.Values{}, Header: http.Header{}}
+	switch *transport {
+	case "polling", "websocket":
+		opts.Transports = []string{*transport}
+	case "upgrade":
+		opts.Transports = []string{"polling", "websocket"}
+	default:
+		fatal(fmt.Errorf("unknown transport %q", *transport))
+	}
+	for _, q := range queries {
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 {
+			fatal(fmt.Errorf("bad query parameter %q", q))
+		}
+		opts.Query.Add(kv[0], kv[1])
+	}
+	for _, h := range headers {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			fatal(fmt.Errorf("bad header %q", h))
+		}
+		opts.Header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	c, err := client.New(flag.Arg(0), opts)
+	if err != nil {
+		fatal(err)
+	}
+	c.On("open", func() {
+		hs := c.Handshake
+		printf("* connected over %s: sid=%s upgrades=%v pingInterval=%dms pingTimeout=%dms\n",
+			c.TransportName(), hs.Sid, hs.Upgrades, hs.PingInterval, hs.PingTimeout)
+	})
+	c.On("packet", func(pkt *parser.Packet) {
+		if !*pings && (pkt.Type == "ping" || pkt.Type == "pong") {
+			return
+		}
+		printf("< %s", describe(pkt))
+	})
+	c.On("upgrade", func(transport string) {
+		printf("* upgraded to %s\n", transport)
+	})
+	if err := c.Open(); err != nil {
+		fatal(err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				c.Close()
+				return
+			}
+			if err := send(c, line); err != nil {
+				printf("! %v\n", err)
+			}
+		case <-c.Done():
+			printf("* closed: %s\n", c.CloseReason())
+			return
+		}
+	}
+}
+
+func send(c *client.Client, line string) error {
+	if strings.HasPrefix(line, "bin ") {
+		data, err := hex.DecodeString(strings.Join(strings.Fields(line[4:]), ""))
+		if err != nil {
+			return fmt.Errorf("bad hex: %v", err)
+		}
+		return c.SendBin(data)
+	}
+	return c.Send([]byte(line))
+}
+
+// describe formats a packet on one line, or with a hex dump for binary data.
+func describe(pkt *parser.Packet) string {
+	if pkt.IsBin {
+		return fmt.Sprintf("%s (%d bytes)\n%s", pkt.Type, len(pkt.Data), hex.Dump(pkt.Data))
+	}
+	if len(pkt.Data) == 0 {
+		return pkt.Type + "\n"
+	}
+	return fmt.Sprintf("%s %q\n", pkt.Type, pkt.Data)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "eio-cli:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,78 @@
+// Command eio-replay plays a session of a capture file, written by an
+// engineio.Capture, against a server and reports where the server's messages
+// differ from the recorded ones.
+//
+//	eio-replay -url http://localhost:8080 [-session sid] capture.jsonl
+//
+// It exits with status 1 if the replay diverged, and 2 on errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/replay"
+)
+
+func main() {
+	addr := flag.String("url", "", "address of the server")
+	path := flag.String("path", "/engine.io/", "engine.io endpoint")
+	session := flag.String("session", "", "session to replay, the first one of the file by default")
+	list := flag.Bool("list", false, "list the sessions of the file and exit")
+	speed := flag.Float64("speed", 1, "replay speed, 0 sends packets back to back")
+	settle := flag.Duration("settle", time.Second, "time to wait for messages after the last packet")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: eio-replay -url addr [flags] capture.jsonl")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	recs, err := engineio.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		fatal(err)
+	}
+	sessions := replay.Sessions(recs)
+	if *list {
+		for _, sid := range sessions {
+			fmt.Println(sid)
+		}
+		return
+	}
+	if len(*addr) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	sid := *session
+	if len(sid) == 0 {
+		if len(sessions) == 0 {
+			fatal(fmt.Errorf("%s has no sessions", flag.Arg(0)))
+		}
+		sid = sessions[0]
+	}
+
+	report, err := replay.Run(*addr, recs, sid, &replay.Options{Speed: *speed, Settle: *settle, Path: *path})
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Print(report)
+	if report.Diverged() {
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "eio-replay:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,281 @@
+// Package enginetest runs engineio sockets over an in-memory transport, so
+// that code built on Server.On("connection") can be tested without HTTP,
+// ports or sleeps.
+//
+//	srv := engineio.NewServer(nil)
+//	srv.On("connection", handler)
+//	socket, client := enginetest.NewPair(srv)
+//	client.Send([]byte("hello"))
+//	reply, err := client.NextMessage(time.Second)
+package enginetest
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/parser"
+	"github.com/kaicheng/events"
+)
+
+var (
+	ErrTimeout = errors.New("enginetest: timed out")
+	ErrClosed  = errors.New("enginetest: closed")
+)
+
+// Client is the client end of a pair. Everything it sends goes through the
+// simulated network, which can be slowed down with SetDelay or made to lose
+// packets with SetDropping.
+type Client struct {
+	Sid string
+
+	pipe *engineio.Pipe
+
+	lock     sync.Mutex
+	delay    time.Duration
+	dropping bool
+
+	up      chan delayed
+	packets chan *parser.Packet
+	quit    chan bool
+	eof     chan bool
+	once    sync.Once
+}
+
+type delayed struct {
+	at   time.Time
+	pkts []*parser.Packet
+}
+
+// NewPair opens a socket on srv over an in-memory transport and returns it
+// along with the client end. The server's "connection" listeners have run by
+// the time it returns, and the handshake packet has been consumed.
+func NewPair(srv *engineio.Server) (*engineio.Socket, *Client) {
+	c := &Client{
+		pipe:    engineio.NewPipe(),
+		up:      make(chan delayed, 64),
+		packets: make(chan *parser.Packet, 1024),
+		quit:    make(chan bool),
+		eof:     make(chan bool),
+	}
+	c.pipe.Filter = func([]*parser.Packet) bool {
+		_, dropping := c.network()
+		return !dropping
+	}
+	go c.readLoop()
+	go c.writeLoop()
+
+	socket := srv.Handshake(c.pipe, nil)
+
+	if pkt, err := c.Next(time.Second); err == nil && pkt.Type == "open" {
+		var handshake struct {
+			Sid string `json:"sid"`
+		}
+		json.Unmarshal(pkt.Data, &handshake)
+		c.Sid = handshake.Sid
+	}
+	return socket, c
+}
+
+// SetDelay delays every packet by d, in both directions. Order is kept.
+func (c *Client) SetDelay(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.delay = d
+}
+
+// SetDropping makes the network silently lose every packet, in both
+// directions, until it is called again with false.
+func (c *Client) SetDropping(b bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropping = b
+}
+
+func (c *Client) network() (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.delay, c.dropping
+}
+
+func (c *Client) Send(data []byte) error {
+	return c.Inject(&parser.Packet{Type: "message", Data: data})
+}
+
+func (c *Client) SendBin(data []byte) error {
+	return c.Inject(&parser.Packet{Type: "message", Data: data, IsBin: true})
+}
+
+// Inject sends raw packets to the server, e.g. pings or malformed ones.
+func (c *Client) Inject(pkts ...*parser.Packet) error {
+	select {
+	case <-c.quit:
+		return ErrClosed
+	case <-c.pipe.Done():
+		return ErrClosed
+	default:
+	}
+	delay, dropping := c.network()
+	if dropping {
+		return nil
+	}
+	select {
+	case c.up <- delayed{time.Now().Add(delay), pkts}:
+		return nil
+	case <-c.quit:
+		return ErrClosed
+	case <-c.pipe.Done():
+		return ErrClosed
+	}
+}
+
+// Next returns the next packet from the server, whatever its type.
+func (c *Client) Next(timeout time.Duration) (*parser.Packet, error) {
+	select {
+	case pkt := <-c.packets:
+		return pkt, nil
+	case <-c.eof:
+		select {
+		case pkt := <-c.packets:
+			return pkt, nil
+		default:
+			return nil, ErrClosed
+		}
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// NextMessage returns the data of the next message from the server, skipping
+// other packets.
+func (c *Client) NextMessage(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pkt, err := c.Next(deadline.Sub(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		if pkt.Type == "message" {
+			return pkt.Data, nil
+		}
+	}
+}
+
+// Close sends a close packet, as a client closing cleanly would.
+func (c *Client) Close() {
+	c.Inject(&parser.Packet{Type: "close"})
+}
+
+// Disconnect drops the connection without a close packet. The server sees
+// a "transport close".
+func (c *Client) Disconnect() {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+	c.pipe.Hangup()
+}
+
+// Closed is closed once the connection is gone, from either end, and every
+// packet sent before that has been received.
+func (c *Client) Closed() <-chan bool {
+	return c.eof
+}
+
+func (c *Client) readLoop() {
+	defer close(c.eof)
+	for {
+		select {
+		case pkts := <-c.pipe.Out():
+			c.deliver(pkts)
+		case <-c.quit:
+			return
+		case <-c.pipe.Done():
+			// Packets sent before the close still arrive.
+			for {
+				select {
+				case pkts := <-c.pipe.Out():
+					c.deliver(pkts)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) deliver(pkts []*parser.Packet) {
+	at := time.Now()
+	delay, _ := c.network()
+	time.Sleep(at.Add(delay).Sub(time.Now()))
+	for _, pkt := range pkts {
+		c.packets <- pkt
+	}
+}
+
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case d := <-c.up:
+			time.Sleep(d.at.Sub(time.Now()))
+			for _, pkt := range d.pkts {
+				c.pipe.Receive(pkt)
+			}
+		case <-c.quit:
+			return
+		case <-c.pipe.Done():
+			return
+		}
+	}
+}
+
+// Waiter records the emissions of an event, so that a test can wait for one
+// without racing the emitter. Create it before triggering the event.
+type Waiter struct {
+	ch chan bool
+}
+
+func NewWaiter(emitter events.EventEmitterInt, event string) *Waiter {
+	w := &Waiter{ch: make(chan bool, 64)}
+	emitter.On(event, func() {
+		select {
+		case w.ch <- true:
+		default:
+		}
+	})
+	return w
+}
+
+// Wait blocks until the event has been emitted once more than the previous
+// calls to Wait have seen, or timeout passes.
+func (w *Waiter) Wait(timeout time.Duration) error {
+	select {
+	case <-w.ch:
+		return nil
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+// CloseWaiter waits for a socket to close and reports the reason.
+type CloseWaiter struct {
+	ch chan string
+}
+
+func NewCloseWaiter(socket *engineio.Socket) *CloseWaiter {
+	w := &CloseWaiter{ch: make(chan string, 1)}
+	socket.Once("close", func(reason string) {
+		w.ch <- reason
+	})
+	return w
+}
+
+func (w *CloseWaiter) Wait(timeout time.Duration) (string, error) {
+	select {
+	case reason := <-w.ch:
+		return reason, nil
+	case <-time.After(timeout):
+		return "", ErrTimeout
+	}
+}
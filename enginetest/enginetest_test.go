@@ -0,0 +1,153 @@
+package enginetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/parser"
+)
+
+const timeout = 5 * time.Second
+
+func expect(t *testing.T, res bool, msgs ...interface{}) {
+	t.Helper()
+	if !res {
+		t.Error(msgs...)
+	}
+}
+
+func echoServer(opts engineio.Options) *engineio.Server {
+	srv := engineio.NewServer(opts)
+	srv.On("connection", func(socket *engineio.Socket) {
+		socket.On("message", func(data []byte, isBin bool) {
+			if isBin {
+				socket.SendBin(data)
+			} else {
+				socket.Send(data)
+			}
+		})
+	})
+	return srv
+}
+
+func TestPairHandshake(t *testing.T) {
+	srv := echoServer(nil)
+	socket, c := NewPair(srv)
+	expect(t, len(c.Sid) > 0, "client should get a sid")
+	expect(t, srv.Clients[c.Sid] == socket, "server should know the socket")
+	expect(t, srv.ClientsCount() == 1, "server should count the socket")
+	expect(t, socket.TransportName() == "memory", "transport should be memory")
+}
+
+func TestPairMessages(t *testing.T) {
+	_, c := NewPair(echoServer(nil))
+	c.Send([]byte("hello"))
+	c.SendBin([]byte{0, 1, 2})
+	msg, err := c.NextMessage(timeout)
+	expect(t, err == nil && string(msg) == "hello", "want hello, got", string(msg), err)
+	pkt, err := c.Next(timeout)
+	expect(t, err == nil && pkt.IsBin && string(pkt.Data) == "\x00\x01\x02", "want binary echo, got", pkt, err)
+}
+
+func TestPairHeartbeat(t *testing.T) {
+	socket, c := NewPair(echoServer(nil))
+	heartbeats := NewWaiter(socket, "heartbeat")
+	c.Inject(&parser.Packet{Type: "ping", Data: []byte("probe")})
+	expect(t, heartbeats.Wait(timeout) == nil, "server should see a heartbeat")
+	pkt, err := c.Next(timeout)
+	expect(t, err == nil && pkt.Type == "pong", "want pong, got", pkt, err)
+}
+
+func TestPairCloseByServer(t *testing.T) {
+	socket, c := NewPair(echoServer(nil))
+	closed := NewCloseWaiter(socket)
+	socket.Send([]byte("bye"))
+	socket.Close()
+	reason, _ := closed.Wait(timeout)
+	expect(t, reason == "forced close", "server reason should be forced close, got", reason)
+	msg, err := c.NextMessage(timeout)
+	expect(t, err == nil && string(msg) == "bye", "packets sent before close should arrive", err)
+	_, err = c.Next(timeout)
+	expect(t, err == ErrClosed, "client should see the close, got", err)
+	expect(t, c.Send([]byte("late")) == ErrClosed, "send after close should fail")
+}
+
+func TestPairCloseByClient(t *testing.T) {
+	srv := echoServer(nil)
+	socket, c := NewPair(srv)
+	closed := NewCloseWaiter(socket)
+	c.Close()
+	reason, _ := closed.Wait(timeout)
+	expect(t, reason == "transport close", "server reason should be transport close, got", reason)
+	expect(t, srv.ClientsCount() == 0, "server should forget the socket")
+}
+
+func TestPairDisconnect(t *testing.T) {
+	socket, c := NewPair(echoServer(nil))
+	closed := NewCloseWaiter(socket)
+	c.Disconnect()
+	reason, _ := closed.Wait(timeout)
+	expect(t, reason == "transport close", "server reason should be transport close, got", reason)
+}
+
+func TestPairDropping(t *testing.T) {
+	socket, c := NewPair(engineio.NewServer(nil))
+	messages := NewWaiter(socket, "message")
+	c.SetDropping(true)
+	drained := NewWaiter(socket, "drain")
+	c.Send([]byte("lost"))
+	socket.Send([]byte("lost"))
+	// Send only queues the message; it is dropped once flushed.
+	expect(t, drained.Wait(timeout) == nil, "server should flush")
+	c.SetDropping(false)
+	socket.Send([]byte("kept"))
+	msg, _ := c.NextMessage(timeout)
+	expect(t, string(msg) == "kept", "dropped message should not arrive, got", string(msg))
+	expect(t, messages.Wait(10*time.Millisecond) == ErrTimeout, "server should not get the dropped message")
+}
+
+func TestPairDelay(t *testing.T) {
+	_, c := NewPair(echoServer(nil))
+	c.SetDelay(20 * time.Millisecond)
+	start := time.Now()
+	for _, msg := range []string{"a", "b", "c"} {
+		c.Send([]byte(msg))
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		msg, err := c.NextMessage(timeout)
+		expect(t, err == nil && string(msg) == want, "want", want, "got", string(msg), err)
+	}
+	expect(t, time.Since(start) >= 40*time.Millisecond, "round trip should take both delays")
+}
+
+func TestPairPingTimeout(t *testing.T) {
+	clock := engineio.NewFakeClock()
+	socket, _ := NewPair(engineio.NewServer(engineio.Options{"pingInterval": 100, "pingTimeout": 100, "clock": clock}))
+	closed := NewCloseWaiter(socket)
+	clock.Advance(200 * time.Millisecond)
+	reason, _ := closed.Wait(timeout)
+	expect(t, reason == "ping timeout", "want ping timeout, got", reason)
+}
+
+func TestPairSendOrder(t *testing.T) {
+	socket, c := NewPair(engineio.NewServer(nil))
+	const senders, count = 4, 50
+	for g := 0; g < senders; g++ {
+		go func(g int) {
+			for i := 0; i < count; i++ {
+				socket.Send([]byte{byte(g), byte(i)})
+			}
+		}(g)
+	}
+	next := make([]int, senders)
+	for n := 0; n < senders*count; n++ {
+		msg, err := c.NextMessage(timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, i := int(msg[0]), int(msg[1])
+		expect(t, i == next[g], "sender", g, "want", next[g], "got", i)
+		next[g] = i + 1
+	}
+}
@@ -0,0 +1,282 @@
+package engineio
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+	"github.com/kaicheng/events"
+)
+
+// Faults configures a FaultTransport. Rates are probabilities between 0 and
+// 1, applied to every packet in both directions.
+type Faults struct {
+	// Latency, plus up to Jitter more, delays every packet on the server's
+	// clock. Order is kept.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	DropRate      float64
+	DuplicateRate float64
+	// ReorderRate holds a packet back until after the next one in the same
+	// direction. A held back packet that nothing follows is never delivered.
+	ReorderRate float64
+
+	// CloseAfter closes the transport abruptly once that many packets have
+	// gone through it. Zero means never.
+	CloseAfter int
+	// CloseRate is the chance of an abrupt close on each packet.
+	CloseRate float64
+
+	// Seed seeds the random source, to replay a run. Zero picks one.
+	Seed int64
+}
+
+// FaultTransport wraps a Transport and injects the network faults described
+// by Faults. Wrap the transports of a server with the "wrapTransport"
+// option:
+//
+//	srv := NewServer(Options{"wrapTransport": func(t Transport) Transport {
+//		return NewFaultTransport(t, &Faults{DropRate: 0.1})
+//	}})
+type FaultTransport struct {
+	events.EventEmitter
+
+	inner  Transport
+	faults Faults
+
+	lock    sync.Mutex
+	rand    *rand.Rand
+	count   int
+	closed  bool
+	heldIn  *parser.Packet
+	heldOut *parser.Packet
+
+	clock    Clock
+	delayIn  delayQueue
+	delayOut delayQueue
+}
+
+// delayQueue runs delayed deliveries in the order they were made. Each timer
+// runs the oldest pending delivery rather than its own, under run, so that
+// timers firing together can't swap packets.
+type delayQueue struct {
+	run     sync.Mutex
+	pending []func()
+	last    time.Time
+}
+
+func NewFaultTransport(inner Transport, faults *Faults) *FaultTransport {
+	trans := &FaultTransport{inner: inner, faults: *faults, clock: realClock{}}
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	trans.rand = rand.New(rand.NewSource(seed))
+
+	inner.On("packet", trans.onInnerPacket)
+	inner.On("drain", func() {
+		trans.Emit("drain")
+	})
+	inner.On("close", func() {
+		trans.Emit("close")
+	})
+	inner.On("error", func(err interface{}) {
+		trans.Emit("error", err)
+	})
+	inner.On("headers", func(header http.Header) {
+		trans.Emit("headers", header)
+	})
+	inner.On("stateChange", func(old, state ReadyState) {
+		trans.Emit("stateChange", old, state)
+	})
+	return trans
+}
+
+// Inner returns the wrapped transport.
+func (trans *FaultTransport) Inner() Transport {
+	return trans.inner
+}
+
+func (trans *FaultTransport) chance(rate float64) bool {
+	return rate > 0 && trans.rand.Float64() < rate
+}
+
+// later runs fn once the latency of this packet has passed, after the
+// deliveries queued in q before it. It runs fn right away when nothing
+// delays it.
+func (trans *FaultTransport) later(q *delayQueue, fn func()) {
+	trans.lock.Lock()
+	d := trans.faults.Latency
+	if trans.faults.Jitter > 0 {
+		d += time.Duration(trans.rand.Int63n(int64(trans.faults.Jitter)))
+	}
+	now := trans.clock.Now()
+	due := now.Add(d)
+	if due.Before(q.last) {
+		due = q.last
+	}
+	q.last = due
+	q.pending = append(q.pending, fn)
+	trans.lock.Unlock()
+
+	next := func() {
+		q.run.Lock()
+		defer q.run.Unlock()
+		trans.lock.Lock()
+		fn := q.pending[0]
+		q.pending = q.pending[1:]
+		trans.lock.Unlock()
+		fn()
+	}
+	if due.After(now) {
+		trans.clock.AfterFunc(due.Sub(now), next)
+	} else {
+		// Everything queued before is due as well.
+		next()
+	}
+}
+
+// apply runs pkts through the faults. held is the packet held back in this
+// direction. It reports whether the transport should now close abruptly.
+func (trans *FaultTransport) apply(pkts []*parser.Packet, held **parser.Packet) ([]*parser.Packet, bool) {
+	trans.lock.Lock()
+	defer trans.lock.Unlock()
+	if trans.closed {
+		return nil, false
+	}
+	out := make([]*parser.Packet, 0, len(pkts)+1)
+	for _, pkt := range pkts {
+		trans.count++
+		if trans.faults.CloseAfter > 0 && trans.count >= trans.faults.CloseAfter ||
+			trans.chance(trans.faults.CloseRate) {
+			debug("fault: closing transport")
+			trans.closed = true
+			return out, true
+		}
+		if trans.chance(trans.faults.DropRate) {
+			debug("fault: dropping", pkt.Type)
+			continue
+		}
+		if *held == nil && trans.chance(trans.faults.ReorderRate) {
+			debug("fault: holding back", pkt.Type)
+			*held = pkt
+			continue
+		}
+		out = append(out, pkt)
+		if trans.chance(trans.faults.DuplicateRate) {
+			debug("fault: duplicating", pkt.Type)
+			out = append(out, pkt)
+		}
+		if *held != nil {
+			out = append(out, *held)
+			*held = nil
+		}
+	}
+	return out, false
+}
+
+func (trans *FaultTransport) abort() {
+	trans.inner.close(nil)
+	trans.inner.onClose()
+}
+
+func (trans *FaultTransport) onInnerPacket(pkt *parser.Packet) {
+	pkts, abort := trans.apply([]*parser.Packet{pkt}, &trans.heldIn)
+	trans.later(&trans.delayIn, func() {
+		for _, pkt := range pkts {
+			trans.Emit("packet", pkt)
+		}
+		if abort {
+			trans.abort()
+		}
+	})
+}
+
+func (trans *FaultTransport) send(pkts []*parser.Packet) {
+	out, abort := trans.apply(pkts, &trans.heldOut)
+	if len(out) == 0 {
+		// Polling has already handed us its pending request, which must be
+		// answered.
+		out = append(out, &noopPkt)
+	}
+	trans.later(&trans.delayOut, func() {
+		trans.inner.send(out)
+		if abort {
+			trans.abort()
+		}
+	})
+}
+
+func (trans *FaultTransport) setReadyState(state ReadyState) bool {
+	return trans.inner.setReadyState(state)
+}
+
+func (trans *FaultTransport) readyState() ReadyState {
+	return trans.inner.readyState()
+}
+
+func (trans *FaultTransport) tryWritable(do, def func()) {
+	trans.inner.tryWritable(do, def)
+}
+
+func (trans *FaultTransport) onRequest(req *Request) {
+	trans.inner.onRequest(req)
+}
+
+func (trans *FaultTransport) close(fn func()) {
+	trans.inner.close(fn)
+}
+
+func (trans *FaultTransport) onError(msg, desc string) {
+	trans.inner.onError(msg, desc)
+}
+
+func (trans *FaultTransport) onPacket(pkt *parser.Packet) {
+	trans.inner.onPacket(pkt)
+}
+
+func (trans *FaultTransport) onData(data []byte) {
+	trans.inner.onData(data)
+}
+
+func (trans *FaultTransport) onClose() {
+	trans.inner.onClose()
+}
+
+func (trans *FaultTransport) Name() string {
+	return trans.inner.Name()
+}
+
+func (trans *FaultTransport) setSid(sid string) {
+	trans.inner.setSid(sid)
+}
+
+func (trans *FaultTransport) setMaxHTTPBufferSize(size int) {
+	trans.inner.setMaxHTTPBufferSize(size)
+}
+
+func (trans *FaultTransport) setLenientPayload(b bool) {
+	trans.inner.setLenientPayload(b)
+}
+
+func (trans *FaultTransport) setPollTimeout(d time.Duration, clock Clock) {
+	trans.inner.setPollTimeout(d, clock)
+}
+
+func (trans *FaultTransport) setClock(clock Clock) {
+	trans.lock.Lock()
+	trans.clock = clock
+	trans.lock.Unlock()
+	trans.inner.setClock(clock)
+}
+
+func (trans *FaultTransport) setSupportsBinary(b bool) {
+	trans.inner.setSupportsBinary(b)
+}
+
+func (trans *FaultTransport) getSupportsBinary() bool {
+	return trans.inner.getSupportsBinary()
+}
@@ -0,0 +1,190 @@
+package engineio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio/client"
+	"github.com/kaicheng/engineio/parser"
+)
+
+func faultServer(faults *Faults) *Server {
+	return NewServer(Options{"wrapTransport": func(t Transport) Transport {
+		return NewFaultTransport(t, faults)
+	}})
+}
+
+// nextFlush returns the types and data of the next flush out of pipe.
+func nextFlush(t *testing.T, pipe *Pipe) []string {
+	t.Helper()
+	select {
+	case pkts := <-pipe.Out():
+		res := make([]string, len(pkts))
+		for i, pkt := range pkts {
+			res[i] = pkt.Type + ":" + string(pkt.Data)
+		}
+		return res
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	return nil
+}
+
+func receive(pipe *Pipe, msgs ...string) {
+	for _, msg := range msgs {
+		pipe.Receive(&parser.Packet{Type: "message", Data: []byte(msg)})
+	}
+}
+
+func messages(socket *Socket) chan string {
+	ch := make(chan string, 16)
+	socket.On("message", func(data []byte) {
+		ch <- string(data)
+	})
+	return ch
+}
+
+func TestFaultDrop(t *testing.T) {
+	pipe := NewPipe()
+	socket := faultServer(&Faults{DropRate: 1}).Handshake(pipe, nil)
+	msgs := messages(socket)
+	flush := nextFlush(t, pipe)
+	expect(t, len(flush) == 1 && flush[0] == "noop:", "open should be dropped for a noop:", flush)
+	receive(pipe, "a")
+	select {
+	case msg := <-msgs:
+		t.Error("message should be dropped:", msg)
+	default:
+	}
+}
+
+func TestFaultDuplicate(t *testing.T) {
+	pipe := NewPipe()
+	socket := faultServer(&Faults{DuplicateRate: 1}).Handshake(pipe, nil)
+	msgs := messages(socket)
+	nextFlush(t, pipe)
+	socket.Send([]byte("a"))
+	flush := nextFlush(t, pipe)
+	expect(t, len(flush) == 2 && flush[0] == "message:a" && flush[1] == "message:a", "want a twice, got", flush)
+	receive(pipe, "b")
+	expect(t, <-msgs == "b" && <-msgs == "b", "server should get b twice")
+}
+
+func TestFaultReorder(t *testing.T) {
+	pipe := NewPipe()
+	socket := faultServer(&Faults{ReorderRate: 1}).Handshake(pipe, nil)
+	msgs := messages(socket)
+	flush := nextFlush(t, pipe)
+	expect(t, len(flush) == 1 && flush[0] == "noop:", "open should be held back:", flush)
+	socket.Send([]byte("a"))
+	flush = nextFlush(t, pipe)
+	expect(t, len(flush) == 2 && flush[0] == "message:a" && flush[1][:5] == "open:", "open should follow a:", flush)
+	receive(pipe, "b", "c")
+	expect(t, <-msgs == "c" && <-msgs == "b", "b should be held back until after c")
+}
+
+func TestFaultLatency(t *testing.T) {
+	clock := NewFakeClock()
+	srv := NewServer(Options{"clock": clock, "wrapTransport": func(t Transport) Transport {
+		return NewFaultTransport(t, &Faults{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	}})
+	pipe := NewPipe()
+	socket := srv.Handshake(pipe, nil)
+	msgs := messages(socket)
+	// The ping timeout and the open packet.
+	waitPending(t, clock, 2)
+	receive(pipe, "a", "b", "c")
+	select {
+	case <-pipe.Out():
+		t.Fatal("open should be delayed")
+	case msg := <-msgs:
+		t.Fatal("message should be delayed:", msg)
+	default:
+	}
+	clock.Advance(20 * time.Millisecond)
+	flush := nextFlush(t, pipe)
+	expect(t, len(flush) == 1 && flush[0][:5] == "open:", "open should arrive in time:", flush)
+	for _, want := range []string{"a", "b", "c"} {
+		expect(t, waitString(t, msgs) == want, "messages should keep their order")
+	}
+}
+
+func TestFaultCloseAfter(t *testing.T) {
+	pipe := NewPipe()
+	socket := faultServer(&Faults{CloseAfter: 3}).Handshake(pipe, nil)
+	closed := make(chan string, 1)
+	socket.On("close", func(reason string) {
+		closed <- reason
+	})
+	nextFlush(t, pipe)
+	receive(pipe, "a", "b")
+	expect(t, <-closed == "transport close", "socket should see transport close")
+	<-pipe.Done()
+}
+
+func TestFaultSeed(t *testing.T) {
+	run := func() []string {
+		pipe := NewPipe()
+		trans := NewFaultTransport(pipe, &Faults{DropRate: 0.3, DuplicateRate: 0.3, ReorderRate: 0.3, Seed: 42})
+		res := make([]string, 0)
+		trans.On("packet", func(pkt *parser.Packet) {
+			res = append(res, string(pkt.Data))
+		})
+		for i := 0; i < 50; i++ {
+			receive(pipe, string(rune('a'+i%26)))
+		}
+		return res
+	}
+	a, b := run(), run()
+	expect(t, len(a) == len(b), "same seed should give the same faults")
+	for i := range a {
+		expect(t, a[i] == b[i], "same seed should give the same faults at", i)
+	}
+}
+
+func wrapWebSocket(faults *Faults) func(Transport) Transport {
+	return func(t Transport) Transport {
+		if t.Name() == "websocket" {
+			return NewFaultTransport(t, faults)
+		}
+		return t
+	}
+}
+
+func TestFaultUpgradeAbort(t *testing.T) {
+	// The websocket dies right after the probe, before the upgrade packet.
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"clock": clock, "pollTimeout": 0, "wrapTransport": wrapWebSocket(&Faults{CloseAfter: 2})})
+	conns := onConnection(srv)
+	c := dial(t, addr, &client.Options{NoUpgrade: true, NoHeartbeat: true})
+	msgs := onMessage(c)
+	socket := waitSocket(t, conns)
+	expect(t, c.Upgrade() != nil, "upgrade should fail")
+	expect(t, socket.ReadyState() == StateOpen, "socket should stay open")
+	expect(t, !socket.Upgraded() && socket.TransportName() == "polling", "socket should stay on polling")
+	// Only the ping timeout should be left.
+	waitPending(t, clock, 1)
+	socket.Send([]byte("still here"))
+	expect(t, waitString(t, msgs) == "still here", "polling should keep working")
+}
+
+func TestFaultUpgradeLatency(t *testing.T) {
+	srv, addr := listen(t, Options{"wrapTransport": wrapWebSocket(&Faults{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})})
+	conns := onConnection(srv)
+	c := dial(t, addr, &client.Options{NoUpgrade: true})
+	msgs := onMessage(c)
+	socket := waitSocket(t, conns)
+	upgraded := make(chan bool, 1)
+	socket.On("upgrade", func() {
+		upgraded <- true
+	})
+	expect(t, c.Upgrade() == nil, "upgrade should succeed")
+	wait(t, upgraded)
+	for i := 0; i < 5; i++ {
+		socket.Send([]byte{byte('0' + i)})
+	}
+	for i := 0; i < 5; i++ {
+		got := waitString(t, msgs)
+		expect(t, got == string(rune('0'+i)), "want", i, "got", got)
+	}
+}
@@ -0,0 +1,41 @@
+package engineio
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Handshake describes the request that opened a socket. It is taken once,
+// when the socket opens, and is safe to keep, log or hand to authorization
+// code.
+type Handshake struct {
+	ID         string      `json:"id"`
+	Transport  string      `json:"transport"`
+	RemoteAddr string      `json:"remoteAddr"`
+	URL        string      `json:"url"`
+	Secure     bool        `json:"secure"`
+	Header     http.Header `json:"header"`
+	Query      url.Values  `json:"query"`
+	Time       time.Time   `json:"time"`
+}
+
+func newHandshake(id string, transport Transport, req *Request, now time.Time) Handshake {
+	hs := Handshake{
+		ID:        id,
+		Transport: transport.Name(),
+		Header:    http.Header{},
+		Query:     url.Values{},
+		Time:      now,
+	}
+	for k, v := range req.Query {
+		hs.Query[k] = append([]string(nil), v...)
+	}
+	if req.httpReq != nil {
+		hs.RemoteAddr = req.httpReq.RemoteAddr
+		hs.URL = req.httpReq.URL.String()
+		hs.Secure = req.httpReq.TLS != nil
+		hs.Header = req.httpReq.Header.Clone()
+	}
+	return hs
+}
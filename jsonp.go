@@ -1,11 +1,15 @@
 package engineio
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
 )
 
-// FIXME: just space holder for jsonp. Not tested.
-
+// JSONP is polling for clients that can't make cross-origin requests: it
+// answers polls with a script calling ___eio[j] with the payload as a JSON
+// string, and takes data posted as the d field of a form.
 type JSONP struct {
 	Polling
 
@@ -21,10 +25,14 @@ func (jsonp *JSONP) InitJSONP(req *Request) {
 	jsonp.foot = ");"
 
 	jsonp.Polling.doWrite = func(req *Request, data []byte) {
-		debug(fmt.Sprintf("jsonp writing \"%s\"", string(data)))
+		if eioDebug {
+			debug(fmt.Sprintf("jsonp writing \"%s\"", string(data)))
+		}
 
-		// FIXME: stringify
-		content := jsonp.head + string(data) + jsonp.foot
+		// json.Marshal escapes U+2028 and U+2029, which end a line in
+		// JavaScript source.
+		js, _ := json.Marshal(string(data))
+		content := jsonp.head + string(js) + jsonp.foot
 		contentLength := fmt.Sprintf("%d", len(content))
 		res := req.res
 		res.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
@@ -34,7 +42,7 @@ func (jsonp *JSONP) InitJSONP(req *Request) {
 
 		jsonp.headers(req)
 		res.WriteHeader(200)
-		res.Write(data)
+		res.Write([]byte(content))
 	}
 
 	jsonp.Polling.headers = func(req *Request) {
@@ -44,9 +52,41 @@ func (jsonp *JSONP) InitJSONP(req *Request) {
 
 		jsonp.Emit("headers", res.Header())
 	}
+
+	jsonp.Polling.payload = func(req *Request) (io.Reader, error) {
+		// ParseForm caps the body at 10MB on its own.
+		if err := req.httpReq.ParseForm(); err != nil {
+			return nil, err
+		}
+		return strings.NewReader(unescapeJSONP(req.httpReq.PostForm.Get("d"))), nil
+	}
 }
 
-func (jsonp *JSONP) onData(data []byte) {
-	// TODO: add DoS protection
-	jsonp.Polling.onData(data)
+// setSupportsBinary keeps binary data base64 encoded, as the payload has to
+// be a string.
+func (jsonp *JSONP) setSupportsBinary(b bool) {
+	jsonp.Polling.setSupportsBinary(false)
+}
+
+// unescapeJSONP undoes the escaping clients apply to keep the newlines of a
+// payload intact in a form: an escaped newline stands for a newline, and an
+// escaped escaped newline for an escaped newline.
+func unescapeJSONP(data string) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\\' && i+1 < len(data) {
+			if data[i+1] == 'n' {
+				b.WriteByte('\n')
+				i++
+				continue
+			}
+			if data[i+1] == '\\' && i+2 < len(data) && data[i+2] == 'n' {
+				b.WriteString(`\n`)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
 }
@@ -0,0 +1,92 @@
+package engineio
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kaicheng/engineio/client"
+)
+
+func jsonpOnly() *client.Options {
+	return &client.Options{Transports: []string{"polling"}, NoUpgrade: true, JSONP: true}
+}
+
+func listenJSONP(t *testing.T) (*Server, string) {
+	return listen(t, Options{"allowUpgrades": false, "transports": []interface{}{"polling"}})
+}
+
+func TestJSONPHandshake(t *testing.T) {
+	srv, addr := listenJSONP(t)
+	conns := onConnection(srv)
+	dial(t, addr, jsonpOnly())
+	socket := waitSocket(t, conns)
+	jsonp, ok := socket.Transport.(*JSONP)
+	expect(t, ok && socket.TransportName() == "polling", "should open with polling JSONP:", socket.Transport)
+	expect(t, jsonp.head == "___eio[0](", "head should call the client's callback:", jsonp.head)
+}
+
+func TestJSONPMessages(t *testing.T) {
+	srv, addr := listenJSONP(t)
+	srv.On("connection", func(socket *Socket) {
+		socket.On("message", func(msg []byte) {
+			socket.Send(msg)
+		})
+	})
+	c := newClient(t, addr, jsonpOnly())
+	msgs := onMessage(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// Newlines are escaped in the form; escaped newlines must survive too.
+	for _, msg := range []string{"a", "b\nc", `d\ne`, " </script>"} {
+		c.Send([]byte(msg))
+		got := waitString(t, msgs)
+		expect(t, got == msg, "want", msg, "got", got)
+	}
+}
+
+func TestJSONPBinary(t *testing.T) {
+	binaryData := []byte{0, 1, 2, 3, 4}
+	srv, addr := listenJSONP(t)
+	srv.On("connection", func(socket *Socket) {
+		socket.On("message", func(data []byte, isBin bool) {
+			if isBin {
+				socket.SendBin(data)
+			}
+		})
+	})
+	c := newClient(t, addr, jsonpOnly())
+	msgs := make(chan bool, 1)
+	c.On("message", func(data []byte, isBin bool) {
+		msgs <- isBin && bytes.Equal(data, binaryData)
+	})
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c.SendBin(binaryData)
+	expect(t, wait(t, msgs).(bool), "binary data should make the round trip")
+}
+
+func TestJSONPCloseByServer(t *testing.T) {
+	srv, addr := listenJSONP(t)
+	conns := onConnection(srv)
+	c := dial(t, addr, jsonpOnly())
+	clientClose := onClose(c)
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	socket.Close()
+	expect(t, waitString(t, serverClose) == "forced close", "server reason should be forced close")
+	expect(t, waitString(t, clientClose) == "transport close", "client reason should be transport close")
+}
+
+func TestJSONPCloseByClient(t *testing.T) {
+	srv, addr := listenJSONP(t)
+	conns := onConnection(srv)
+	c := dial(t, addr, jsonpOnly())
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	c.Send([]byte("a"))
+	c.Close()
+	expect(t, c.CloseReason() == "forced close", "client reason should be forced close")
+	expect(t, waitString(t, serverClose) == "transport close", "server reason should be transport close")
+}
@@ -0,0 +1,335 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var (
+	ErrBadPayload      = errors.New("parser: bad payload")
+	ErrPacketTooLarge  = errors.New("parser: packet too large")
+	ErrPayloadTooLarge = errors.New("parser: payload too large")
+)
+
+// maxLengthDigits bounds the length prefix of a single packet in both the
+// text and the binary framing.
+const maxLengthDigits = 10
+
+// PayloadDecoder decodes a payload incrementally from an io.Reader, so that
+// only one packet at a time is held in memory.
+type PayloadDecoder struct {
+	// MaxPacketSize limits the encoded size of a single packet. Zero means
+	// no limit.
+	MaxPacketSize int
+	// MaxPayloadSize limits the number of bytes read from the underlying
+	// reader. Zero means no limit.
+	MaxPayloadSize int
+	// Lenient makes the text framing fall back to length prefixes counted
+	// in bytes, as sent by legacy Go clients, for packets that do not parse
+	// with the spec's UTF-16 counting: those that end neither at the end of
+	// the payload nor at another length prefix.
+	Lenient bool
+
+	src     *pushbackReader
+	r       *bufio.Reader
+	read    int
+	started bool
+	binary  bool
+	marker  byte
+	err     error
+}
+
+func NewPayloadDecoder(r io.Reader) *PayloadDecoder {
+	src := &pushbackReader{r: r}
+	return &PayloadDecoder{src: src, r: bufio.NewReader(src)}
+}
+
+// pushbackReader reads the bytes pushed back by the decoder before the rest
+// of the payload.
+type pushbackReader struct {
+	back []byte
+	r    io.Reader
+}
+
+func (pr *pushbackReader) Read(p []byte) (int, error) {
+	if len(pr.back) > 0 {
+		n := copy(p, pr.back)
+		pr.back = pr.back[n:]
+		return n, nil
+	}
+	return pr.r.Read(p)
+}
+
+// Next returns the next packet of the payload. It returns io.EOF once the
+// payload is exhausted. On any other error the returned packet is the parser
+// error packet, and all further calls return the same error.
+func (dec *PayloadDecoder) Next() (Packet, error) {
+	if dec.err != nil {
+		if dec.err == io.EOF {
+			return Packet{}, io.EOF
+		}
+		return errPkt, dec.err
+	}
+
+	pkt, err := dec.next()
+	if err != nil {
+		dec.err = err
+		if err != io.EOF {
+			return errPkt, err
+		}
+	}
+	return pkt, err
+}
+
+func (dec *PayloadDecoder) next() (Packet, error) {
+	for {
+		c, err := dec.readByte()
+		if err == io.EOF {
+			if !dec.started {
+				// An empty payload is an error, same as DecodePayload.
+				return Packet{}, ErrBadPayload
+			}
+			return Packet{}, io.EOF
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		if !dec.started {
+			dec.started = true
+			dec.binary = int(c) < 0x20
+		}
+
+		var length int
+		if dec.binary {
+			dec.marker = c
+			length, err = dec.readBinaryLength()
+		} else {
+			length, err = dec.readTextLength(c)
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		if length == 0 {
+			continue
+		}
+		if dec.MaxPacketSize > 0 && length > dec.MaxPacketSize {
+			return Packet{}, ErrPacketTooLarge
+		}
+
+		var data []byte
+		if dec.binary {
+			data, err = dec.readFull(length)
+		} else {
+			data, err = dec.readText(length)
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		var pkt Packet
+		if dec.binary {
+			pkt = decodeFramedPacket(dec.marker, data)
+		} else {
+			pkt = DecodePacket(data)
+		}
+		if isErrPkt(&pkt) {
+			return Packet{}, ErrBadPayload
+		}
+		return pkt, nil
+	}
+}
+
+// readTextLength parses the "<digits>:" prefix of the text framing. first is
+// the already consumed first digit.
+func (dec *PayloadDecoder) readTextLength(first byte) (int, error) {
+	length := 0
+	digits := 0
+	for c := first; c != ':'; {
+		if c < '0' || c > '9' || digits >= maxLengthDigits {
+			return 0, ErrBadPayload
+		}
+		length = length*10 + int(c-'0')
+		digits++
+
+		var err error
+		if c, err = dec.readByte(); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	if digits == 0 {
+		return 0, ErrBadPayload
+	}
+	return length, nil
+}
+
+// readBinaryLength parses the "<digits>\xff" prefix of the binary framing. The
+// string/binary marker has already been consumed.
+func (dec *PayloadDecoder) readBinaryLength() (int, error) {
+	length := 0
+	digits := 0
+	for {
+		c, err := dec.readByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if c == 255 {
+			break
+		}
+		if c > 9 || digits >= maxLengthDigits {
+			return 0, ErrBadPayload
+		}
+		length = length*10 + int(c)
+		digits++
+	}
+	if length <= 0 {
+		return 0, ErrBadPayload
+	}
+	return length, nil
+}
+
+// readText reads a text packet of the given length in UTF-16 code units.
+func (dec *PayloadDecoder) readText(units int) ([]byte, error) {
+	data, err := dec.readUnits(units)
+	if !dec.Lenient || (err == nil && dec.atPacketBoundary()) {
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	// A length in bytes never covers more of the payload than the same
+	// length in code units, so the packet is a prefix of what was read.
+	if len(data) < units {
+		if err == nil {
+			err = ErrBadPayload
+		}
+		return nil, err
+	}
+	dec.unread(data[units:])
+	return data[:units], nil
+}
+
+// readUnits reads up to the given number of UTF-16 code units. On error it
+// returns what it read along with the error.
+func (dec *PayloadDecoder) readUnits(units int) ([]byte, error) {
+	data := make([]byte, 0, minInt(units, 4096))
+	for n := 0; n < units; {
+		r, size, err := dec.r.ReadRune()
+		if err != nil {
+			return data, unexpectedEOF(err)
+		}
+		if dec.MaxPayloadSize > 0 && dec.read+size > dec.MaxPayloadSize {
+			dec.r.UnreadRune()
+			return data, ErrPayloadTooLarge
+		}
+		if dec.MaxPacketSize > 0 && len(data)+size > dec.MaxPacketSize {
+			dec.r.UnreadRune()
+			return data, ErrPacketTooLarge
+		}
+		dec.read += size
+		if r == utf8.RuneError && size == 1 {
+			dec.r.UnreadRune()
+			c, _ := dec.r.ReadByte()
+			data = append(data, c)
+		} else {
+			data = utf8.AppendRune(data, r)
+		}
+		n += runeUTF16Len(r)
+		if n > units {
+			// The last rune needs a surrogate pair but only one unit is left.
+			return data, ErrBadPayload
+		}
+	}
+	return data, nil
+}
+
+// unread puts data back in front of the rest of the payload.
+func (dec *PayloadDecoder) unread(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	buffered, _ := dec.r.Peek(dec.r.Buffered())
+	back := make([]byte, 0, len(data)+len(buffered)+len(dec.src.back))
+	back = append(back, data...)
+	back = append(back, buffered...)
+	dec.src.back = append(back, dec.src.back...)
+	dec.r.Reset(dec.src)
+	dec.read -= len(data)
+}
+
+// atPacketBoundary reports whether the reader is at the end of the payload or
+// at the "<digits>:" prefix of another packet.
+func (dec *PayloadDecoder) atPacketBoundary() bool {
+	next, err := dec.r.Peek(maxLengthDigits + 1)
+	if len(next) == 0 && err != nil {
+		return true
+	}
+	for i, c := range next {
+		if c == ':' {
+			return i > 0
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return false
+}
+
+func (dec *PayloadDecoder) readByte() (byte, error) {
+	if err := dec.consume(1); err != nil {
+		return 0, err
+	}
+	c, err := dec.r.ReadByte()
+	if err != nil {
+		dec.read--
+	}
+	return c, err
+}
+
+func (dec *PayloadDecoder) readFull(n int) ([]byte, error) {
+	if err := dec.consume(n); err != nil {
+		return nil, err
+	}
+	// Grow with the data actually read rather than trusting the length
+	// prefix, which comes from the client.
+	buf := bytes.NewBuffer(make([]byte, 0, minInt(n, 4096)))
+	if _, err := io.CopyN(buf, dec.r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// consume accounts for n more bytes against MaxPayloadSize before they are
+// read, so that an oversized payload is rejected without buffering it.
+func (dec *PayloadDecoder) consume(n int) error {
+	if dec.MaxPayloadSize > 0 && dec.read+n > dec.MaxPayloadSize {
+		if n == 1 {
+			// Only fail if there really is another byte to read.
+			if _, err := dec.r.Peek(1); err != nil {
+				return err
+			}
+		}
+		return ErrPayloadTooLarge
+	}
+	dec.read += n
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBadPayload
+	}
+	return err
+}
+
+func isErrPkt(pkt *Packet) bool {
+	return pkt.Type == errPkt.Type && string(pkt.Data) == string(errPkt.Data)
+}
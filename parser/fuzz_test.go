@@ -0,0 +1,187 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Seeds taken from the cases in parser_test.go, plus inputs that used to
+// panic.
+var packetSeeds = [][]byte{
+	[]byte("4test"),
+	[]byte("0{\"some\":\"json\"}"),
+	[]byte("1"),
+	[]byte("21"),
+	[]byte("31"),
+	[]byte("4aaa"),
+	[]byte("5"),
+	[]byte(":::"),
+	[]byte("94103"),
+	[]byte("b4AQID"),
+	[]byte{4, 1, 2, 3},
+	[]byte(""),
+	[]byte("b"),
+}
+
+var payloadSeeds = [][]byte{
+	[]byte("1:21:0"),
+	[]byte("2:4a1:2"),
+	[]byte("0:"),
+	[]byte("1!"),
+	[]byte(""),
+	[]byte("))"),
+	[]byte("1:"),
+	[]byte("3:99:"),
+	[]byte("1:aa"),
+	[]byte("1:a2:b"),
+	[]byte("5:4a😀b2:4é"),
+	[]byte("-1:4a"),
+	[]byte{1, 3, 255, 1, 2, 3},
+	[]byte{0, 6, 255, '4', 'h', 'e', 'l', 'l', 'o', 1, 4, 255, 4, 0, 1, 255},
+	[]byte{1, 0, 255},
+	[]byte{1},
+	[]byte{1, 200, 255, 4},
+}
+
+// checkRoundTrip encodes pkts both ways and expects to decode them back.
+func checkRoundTrip(t *testing.T, pkts []*Packet) {
+	for _, supportsBinary := range []bool{false, true} {
+		data := AppendPayload(nil, pkts, supportsBinary)
+		i := 0
+		DecodePayload(data, func(pkt Packet, index, total int) {
+			if i >= len(pkts) {
+				t.Fatalf("decoded extra packet %v from %q", pkt, data)
+			}
+			want := pkts[i]
+			if !packetEqual(&pkt, want) || pkt.IsBin != want.IsBin {
+				t.Fatalf("round trip of %v gave %v (payload %q)", *want, pkt, data)
+			}
+			i++
+		})
+		if len(pkts) > 0 && i != len(pkts) {
+			t.Fatalf("decoded %d of %d packets from %q", i, len(pkts), data)
+		}
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	for _, seed := range packetSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt := DecodePacket(data)
+		if isErrPkt(&pkt) {
+			return
+		}
+		checkRoundTrip(t, []*Packet{&pkt})
+	})
+}
+
+func FuzzDecodeBase64Packet(f *testing.F) {
+	for _, seed := range packetSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt := DecodeBase64Packet(data)
+		if isErrPkt(&pkt) {
+			return
+		}
+		checkRoundTrip(t, []*Packet{&pkt})
+	})
+}
+
+func decodeAll(data []byte, decode func([]byte, DecodePayloadCallback)) ([]*Packet, bool) {
+	pkts := make([]*Packet, 0)
+	ok := true
+	decode(data, func(pkt Packet, index, total int) {
+		if isErrPkt(&pkt) {
+			ok = false
+			return
+		}
+		pkts = append(pkts, &pkt)
+	})
+	return pkts, ok
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	for _, seed := range payloadSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkts, ok := decodeAll(data, DecodePayload)
+		if !ok {
+			return
+		}
+		checkRoundTrip(t, pkts)
+
+		// The streaming decoder must agree.
+		dec := NewPayloadDecoder(bytes.NewReader(data))
+		for i := 0; ; i++ {
+			pkt, err := dec.Next()
+			if err == io.EOF {
+				if i != len(pkts) {
+					t.Fatalf("stream decoded %d of %d packets from %q", i, len(pkts), data)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("stream failed on %q: %v", data, err)
+			}
+			if i >= len(pkts) || !packetEqual(&pkt, pkts[i]) || pkt.IsBin != pkts[i].IsBin {
+				t.Fatalf("stream decoded %v at %d from %q", pkt, i, data)
+			}
+		}
+	})
+}
+
+func FuzzDecodePayloadAsBinary(f *testing.F) {
+	for _, seed := range payloadSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkts, ok := decodeAll(data, DecodePayloadAsBinary)
+		if !ok {
+			return
+		}
+		checkRoundTrip(t, pkts)
+	})
+}
+
+func FuzzPayloadDecoder(f *testing.F) {
+	for _, seed := range payloadSeeds {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, lenient bool) {
+		dec := NewPayloadDecoder(bytes.NewReader(data))
+		dec.Lenient = lenient
+		dec.MaxPayloadSize = 1 << 16
+		pkts := make([]*Packet, 0)
+		for {
+			pkt, err := dec.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+			pkts = append(pkts, &pkt)
+		}
+		checkRoundTrip(t, pkts)
+	})
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add(byte(4), []byte("hello"), false)
+	f.Add(byte(4), []byte{0, 1, 255}, true)
+	f.Add(byte(2), []byte("probe"), false)
+	f.Add(byte(4), []byte("a😀b"), false)
+	f.Fuzz(func(t *testing.T, typ byte, data []byte, isBin bool) {
+		if int(typ) >= len(PacketsList) {
+			return
+		}
+		pkt := &Packet{Type: PacketsList[typ], Data: data, IsBin: isBin}
+		checkRoundTrip(t, []*Packet{pkt, pkt})
+	})
+}
@@ -34,4 +34,7 @@ type Packet struct {
 	Type  string
 	Data  []byte
 	IsBin bool
+
+	// cache is set on packets made by Shared.
+	cache *encodeCache
 }
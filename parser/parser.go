@@ -20,29 +20,60 @@ func EncodePacket(pkt *Packet, supportsBinary bool, callback EncodeCallback) {
 		}
 	}()
 
+	callback(AppendPacket(nil, pkt, supportsBinary))
+}
+
+// AppendPacket appends the encoding of pkt to dst and returns the extended
+// buffer.
+func AppendPacket(dst []byte, pkt *Packet, supportsBinary bool) []byte {
+	if pkt.cache != nil {
+		return append(dst, pkt.cache.encoded(pkt, supportsBinary)...)
+	}
+	return appendPacket(dst, pkt, supportsBinary)
+}
+
+func appendPacket(dst []byte, pkt *Packet, supportsBinary bool) []byte {
 	if !supportsBinary && pkt.IsBin {
-		EncodeBase64Packet(pkt, callback)
-		return
+		return AppendBase64Packet(dst, pkt)
 	}
 
-	buf := new(bytes.Buffer)
-	buf.Grow(1 + len(pkt.Data))
+	dst = grow(dst, 1+len(pkt.Data))
 	if pkt.IsBin {
-		buf.WriteByte(Packets[pkt.Type])
+		dst = append(dst, Packets[pkt.Type])
 	} else {
-		buf.WriteByte(Packets[pkt.Type] + '0')
+		dst = append(dst, Packets[pkt.Type]+'0')
+	}
+	return append(dst, pkt.Data...)
+}
+
+// encodedLen returns the length of AppendPacket's output for pkt.
+func encodedLen(pkt *Packet, supportsBinary bool) int {
+	if !supportsBinary && pkt.IsBin {
+		return 2 + base64.StdEncoding.EncodedLen(len(pkt.Data))
 	}
-	buf.Write(pkt.Data)
-	callback(buf.Next(buf.Len()))
+	return 1 + len(pkt.Data)
+}
+
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) < n {
+		buf := make([]byte, len(dst), 2*cap(dst)+n)
+		copy(buf, dst)
+		dst = buf
+	}
+	return dst
 }
 
 func DecodePacket(data []byte) Packet {
+	if len(data) == 0 {
+		return errPkt
+	}
 	if data[0] == 'b' {
 		return DecodeBase64Packet(data[1:])
 	}
 
 	t := data[0]
-	if t >= '0' {
+	isBin := t < '0'
+	if !isBin {
 		t = t - '0'
 	}
 	if int(t) >= len(PacketsList) {
@@ -52,22 +83,40 @@ func DecodePacket(data []byte) Packet {
 	if len(data) > 1 {
 		newData := make([]byte, len(data)-1)
 		copy(newData, data[1:])
-		return Packet{Type: PacketsList[t], Data: newData}
+		return Packet{Type: PacketsList[t], Data: newData, IsBin: isBin}
 	} else {
-		return Packet{Type: PacketsList[t]}
+		return Packet{Type: PacketsList[t], IsBin: isBin}
 	}
 }
 
+// decodeFramedPacket decodes a packet of a binary payload, which must match
+// its string (0) or binary (1) marker.
+func decodeFramedPacket(marker byte, data []byte) Packet {
+	if marker > 1 || (marker == 1) != (data[0] < '0') {
+		return errPkt
+	}
+	return DecodePacket(data)
+}
+
 func EncodeBase64Packet(pkt *Packet, callback EncodeCallback) {
-	buf := new(bytes.Buffer)
-	buf.Grow(2 + len(pkt.Data)*2)
-	buf.WriteByte('b')
-	buf.Write([]byte(strconv.FormatInt(int64(Packets[pkt.Type]), 10)))
-	buf.Write([]byte(base64.StdEncoding.EncodeToString(pkt.Data)))
-	callback(buf.Next(buf.Len()))
+	callback(AppendBase64Packet(nil, pkt))
+}
+
+// AppendBase64Packet appends the base64 encoding of pkt to dst and returns the
+// extended buffer.
+func AppendBase64Packet(dst []byte, pkt *Packet) []byte {
+	n := base64.StdEncoding.EncodedLen(len(pkt.Data))
+	dst = grow(dst, 2+n)
+	dst = append(dst, 'b')
+	dst = strconv.AppendInt(dst, int64(Packets[pkt.Type]), 10)
+	base64.StdEncoding.Encode(dst[len(dst):len(dst)+n], pkt.Data)
+	return dst[:len(dst)+n]
 }
 
 func DecodeBase64Packet(data []byte) Packet {
+	if len(data) == 0 {
+		return errPkt
+	}
 	t, err := strconv.ParseUint(string(data[0:1]), 10, 8)
 	if err != nil {
 		return errPkt
@@ -79,36 +128,36 @@ func DecodeBase64Packet(data []byte) Packet {
 	if err != nil {
 		return errPkt
 	}
-	return Packet{Type: PacketsList[t], Data: dec}
+	return Packet{Type: PacketsList[t], Data: dec, IsBin: true}
 }
 
 func EncodePayload(pkts []*Packet, supportsBinary bool, callback EncodeCallback) {
-	if supportsBinary {
-		EncodePayloadAsBinary(pkts, callback)
-		return
+	callback(AppendPayload(nil, pkts, supportsBinary))
+}
+
+// AppendPayload appends the payload encoding of pkts to dst and returns the
+// extended buffer.
+func AppendPayload(dst []byte, pkts []*Packet, supportsBinary bool) []byte {
+	if supportsBinary && hasBinary(pkts) {
+		return AppendPayloadAsBinary(dst, pkts)
 	}
 
 	if len(pkts) == 0 {
-		callback([]byte("0:"))
-		return
+		return append(dst, "0:"...)
 	}
 
-	buf := new(bytes.Buffer)
 	estLen := 0
 	for _, pkt := range pkts {
 		// sample encoded: 102:bxmessage
-		// message is in base 64
-		estLen += 6 + len(pkt.Data)*2
+		estLen += 11 + encodedLen(pkt, false)
 	}
-	buf.Grow(estLen)
+	dst = grow(dst, estLen)
 	for _, pkt := range pkts {
-		EncodePacket(pkt, supportsBinary, func(data []byte) {
-			buf.Write([]byte(strconv.FormatInt(int64(len(data)), 10)))
-			buf.WriteByte(':')
-			buf.Write(data)
-		})
+		dst = strconv.AppendInt(dst, int64(textLen(pkt)), 10)
+		dst = append(dst, ':')
+		dst = AppendPacket(dst, pkt, false)
 	}
-	callback(buf.Next(buf.Len()))
+	return dst
 }
 
 func DecodePayload(data []byte, callback DecodePayloadCallback) {
@@ -128,9 +177,14 @@ func DecodePayload(data []byte, callback DecodePayloadCallback) {
 			callback(errPkt, 0, 1)
 			return
 		}
-		length64, err := strconv.ParseInt(string(work[:colon]), 10, 32)
-		length := int(length64)
-		if err != nil || colon+length >= len(work) {
+		units := getTextInt(work[:colon])
+		if units < 0 {
+			callback(errPkt, 0, 1)
+			return
+		}
+		// units counts UTF-16 code units, not bytes.
+		length := utf16Offset(work[colon+1:], units)
+		if length < 0 {
 			callback(errPkt, 0, 1)
 			return
 		}
@@ -146,55 +200,81 @@ func DecodePayload(data []byte, callback DecodePayloadCallback) {
 	}
 }
 
-func EncodePayloadAsBinary(pkts []*Packet, callback EncodeCallback) {
-	if len(pkts) == 0 {
-		callback([]byte{})
+func hasBinary(pkts []*Packet) bool {
+	for _, pkt := range pkts {
+		if pkt.IsBin {
+			return true
+		}
 	}
+	return false
+}
 
-	buf := new(bytes.Buffer)
+func EncodePayloadAsBinary(pkts []*Packet, callback EncodeCallback) {
+	callback(AppendPayloadAsBinary(nil, pkts))
+}
+
+// AppendPayloadAsBinary appends the binary payload encoding of pkts to dst and
+// returns the extended buffer.
+func AppendPayloadAsBinary(dst []byte, pkts []*Packet) []byte {
 	estLen := 0
 	for _, pkt := range pkts {
 		// Estimated length of buffer
-		// 1(binary indicator) + 4(length bytes) + 1(255) + len(pkt.Data)
-		estLen += 6 + len(pkt.Data)
+		// 1(binary indicator) + 10(length bytes) + 1(255) + encoded length
+		estLen += 12 + encodedLen(pkt, true)
 	}
-	buf.Grow(estLen)
+	dst = grow(dst, estLen)
 	for _, pkt := range pkts {
-		EncodePacket(pkt, true, func(data []byte) {
-			buf.WriteByte(1)
-			length := len(data)
-			bitsBuf := make([]byte, 10)
-			bits := 0
-			for length > 0 {
-				bitsBuf[bits] = byte(length % 10)
-				bits++
-				length = length / 10
-			}
-			for i := bits - 1; i >= 0; i-- {
-				buf.WriteByte(bitsBuf[i])
-			}
-			buf.WriteByte(255)
-			buf.Write(data)
-		})
+		if pkt.IsBin {
+			dst = append(dst, 1)
+		} else {
+			dst = append(dst, 0)
+		}
+		start := len(dst)
+		dst = strconv.AppendInt(dst, int64(encodedLen(pkt, true)), 10)
+		for i := start; i < len(dst); i++ {
+			dst[i] -= '0'
+		}
+		dst = append(dst, 255)
+		dst = AppendPacket(dst, pkt, true)
 	}
-	callback(buf.Next(buf.Len()))
+	return dst
 }
 
 func getInt(data []byte) (res int) {
-	if len(data) > 10 {
+	if len(data) > maxLengthDigits {
 		return -1
 	}
 	res = 0
 	for i := 0; i < len(data); i++ {
+		if data[i] > 9 {
+			return -1
+		}
 		res = res * 10
 		res += int(data[i])
 	}
 	return
 }
 
+// getTextInt parses the decimal length prefix of a text payload, or returns -1.
+func getTextInt(data []byte) (res int) {
+	if len(data) == 0 || len(data) > maxLengthDigits {
+		return -1
+	}
+	res = 0
+	for i := 0; i < len(data); i++ {
+		if data[i] < '0' || data[i] > '9' {
+			return -1
+		}
+		res = res * 10
+		res += int(data[i] - '0')
+	}
+	return
+}
+
 func DecodePayloadAsBinary(data []byte, callback DecodePayloadCallback) {
 	estTotal := bytes.Count(data, []byte{255})
 	buf := make([][]byte, estTotal)
+	markers := make([]byte, estTotal)
 	total := 0
 	base := 0
 	i := 0
@@ -215,6 +295,7 @@ func DecodePayloadAsBinary(data []byte, callback DecodePayloadCallback) {
 			return
 		}
 		buf[i] = work[i255+1 : i255+1+length]
+		markers[i] = data[base]
 		i++
 		total++
 		// 1 + number length + 1(255) + data length
@@ -222,6 +303,6 @@ func DecodePayloadAsBinary(data []byte, callback DecodePayloadCallback) {
 	}
 	for index := 0; index < total; index++ {
 		b := buf[index]
-		callback(DecodePacket(b), index, total)
+		callback(decodeFramedPacket(markers[index], b), index, total)
 	}
 }
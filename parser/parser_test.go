@@ -3,8 +3,10 @@ package parser
 import (
 	"bytes"
 	"crypto/rand"
+	"io"
 	"runtime/debug"
 	"testing"
+	"testing/iotest"
 )
 
 func encode(pkt *Packet, callback EncodeCallback) {
@@ -203,3 +205,298 @@ func TestEncodeDecodePayloadAsBinary(t *testing.T) {
 		})
 	})
 }
+
+func decodeStream(t *testing.T, data []byte, maxPacket, maxPayload int) ([]Packet, error) {
+	dec := NewPayloadDecoder(bytes.NewReader(data))
+	dec.MaxPacketSize = maxPacket
+	dec.MaxPayloadSize = maxPayload
+	pkts := make([]Packet, 0)
+	for {
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			return pkts, nil
+		}
+		if err != nil {
+			expect(t, packetEqual(&pkt, &errPkt), "Should get error packet")
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestPayloadDecoder(t *testing.T) {
+	msg := Packet{Type: "message", Data: []byte("a")}
+	ping := Packet{Type: "ping"}
+	encPayload([]*Packet{&msg, &ping}, func(data []byte) {
+		pkts, err := decodeStream(t, data, 0, 0)
+		expect(t, err == nil, "Decode err:", err)
+		expect(t, len(pkts) == 2, "Should decode 2 packets")
+		expect(t, packetEqual(&pkts[0], &msg), "Decode err:", pkts[0], msg)
+		expect(t, packetEqual(&pkts[1], &ping), "Decode err:", pkts[1], ping)
+	})
+	encPayload([]*Packet{}, func(data []byte) {
+		pkts, err := decodeStream(t, data, 0, 0)
+		expect(t, err == nil && len(pkts) == 0, "Should not decode any packet")
+	})
+}
+
+func TestPayloadDecoderBinary(t *testing.T) {
+	buf := make([]byte, 123)
+	rand.Read(buf)
+	pkt0 := Packet{Type: "message", Data: buf}
+	pkt1 := Packet{Type: "message", Data: []byte("hello")}
+	pkt2 := Packet{Type: "close"}
+	encPayloadB([]*Packet{&pkt0, &pkt1, &pkt2}, func(data []byte) {
+		// One byte at a time to exercise the incremental path.
+		dec := NewPayloadDecoder(iotest.OneByteReader(bytes.NewReader(data)))
+		for _, want := range []*Packet{&pkt0, &pkt1, &pkt2} {
+			pkt, err := dec.Next()
+			expect(t, err == nil, "Decode err:", err)
+			expect(t, packetEqual(&pkt, want), "Decode err:", pkt, *want)
+		}
+		_, err := dec.Next()
+		expect(t, err == io.EOF, "Should end with EOF")
+	})
+}
+
+func TestPayloadDecoderErrors(t *testing.T) {
+	for _, data := range []string{"", "1!", "))", "1:", "3:99:", "1:aa", "1:a2:b"} {
+		_, err := decodeStream(t, []byte(data), 0, 0)
+		expect(t, err == ErrBadPayload, "Should fail on", data)
+	}
+	_, err := decodeStream(t, []byte{1, 0, 255}, 0, 0)
+	expect(t, err == ErrBadPayload, "Should fail on zero length binary packet")
+}
+
+func TestPayloadDecoderLimits(t *testing.T) {
+	data := []byte("6:4hello2:4a")
+	pkts, err := decodeStream(t, data, 5, 0)
+	expect(t, err == ErrPacketTooLarge && len(pkts) == 0, "Should reject large packet")
+	pkts, err = decodeStream(t, data, 6, 0)
+	expect(t, err == nil && len(pkts) == 2, "Should accept packet at limit")
+	pkts, err = decodeStream(t, data, 0, 10)
+	expect(t, err == ErrPayloadTooLarge && len(pkts) == 1, "Should reject large payload")
+	pkts, err = decodeStream(t, data, 0, len(data))
+	expect(t, err == nil && len(pkts) == 2, "Should accept payload at limit")
+}
+
+func TestAppendPacket(t *testing.T) {
+	prefix := []byte("xx")
+	pkts := []*Packet{
+		&Packet{Type: "message", Data: []byte("test")},
+		&Packet{Type: "message", Data: []byte{1, 2, 3}, IsBin: true},
+		&Packet{Type: "close"},
+	}
+	for _, pkt := range pkts {
+		for _, b := range []bool{false, true} {
+			EncodePacket(pkt, b, func(data []byte) {
+				res := AppendPacket(prefix, pkt, b)
+				expect(t, bytes.Equal(res[2:], data), "AppendPacket err:", res, data)
+				expect(t, len(data) == encodedLen(pkt, b), "encodedLen err:", *pkt)
+			})
+		}
+	}
+	EncodePayload(pkts, false, func(data []byte) {
+		res := AppendPayload(prefix, pkts, false)
+		expect(t, bytes.Equal(res[2:], data), "AppendPayload err:", res, data)
+	})
+	EncodePayload(pkts, true, func(data []byte) {
+		res := AppendPayload(prefix, pkts, true)
+		expect(t, bytes.Equal(res[2:], data), "AppendPayload err:", res, data)
+	})
+}
+
+func TestEncodeEmptyPayloadAsBinary(t *testing.T) {
+	calls := 0
+	encPayloadB([]*Packet{}, func(data []byte) {
+		calls++
+		expect(t, len(data) == 0, "Should be empty")
+	})
+	expect(t, calls == 1, "Should call back once")
+}
+
+var benchPkts = []*Packet{
+	&Packet{Type: "message", Data: []byte("hello world, this is a chat message")},
+	&Packet{Type: "message", Data: bytes.Repeat([]byte{7}, 256), IsBin: true},
+	&Packet{Type: "ping"},
+}
+
+func BenchmarkEncodePacket(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodePacket(benchPkts[0], true, func([]byte) {})
+	}
+}
+
+func BenchmarkAppendPacket(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 512)
+	for i := 0; i < b.N; i++ {
+		buf = AppendPacket(buf[:0], benchPkts[0], true)
+	}
+}
+
+func BenchmarkEncodePayload(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodePayload(benchPkts, false, func([]byte) {})
+	}
+}
+
+func BenchmarkAppendPayload(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 1024)
+	for i := 0; i < b.N; i++ {
+		buf = AppendPayload(buf[:0], benchPkts, false)
+	}
+}
+
+func BenchmarkAppendPayloadAsBinary(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 1024)
+	for i := 0; i < b.N; i++ {
+		buf = AppendPayloadAsBinary(buf[:0], benchPkts)
+	}
+}
+
+func BenchmarkDecodePayload(b *testing.B) {
+	b.ReportAllocs()
+	data := AppendPayload(nil, benchPkts, false)
+	for i := 0; i < b.N; i++ {
+		DecodePayload(data, func(Packet, int, int) {})
+	}
+}
+
+var utf16Vectors = []struct {
+	text    string
+	encoded string
+}{
+	{"a", "2:4a"},
+	{"é", "2:4é"},
+	{"日本語", "4:4日本語"},
+	{"😀", "3:4😀"},
+	{"a😀b", "5:4a😀b"},
+}
+
+func TestEncodePayloadUTF16(t *testing.T) {
+	for _, v := range utf16Vectors {
+		encPayload([]*Packet{&Packet{Type: "message", Data: []byte(v.text)}}, func(data []byte) {
+			expect(t, string(data) == v.encoded, "Encode err:", string(data), v.encoded)
+		})
+	}
+}
+
+func TestDecodePayloadUTF16(t *testing.T) {
+	pkts := make([]*Packet, len(utf16Vectors))
+	for i, v := range utf16Vectors {
+		pkts[i] = &Packet{Type: "message", Data: []byte(v.text)}
+	}
+	encPayload(pkts, func(data []byte) {
+		i := 0
+		decPayload(data, func(pkt Packet, index, total int) {
+			expect(t, packetEqual(&pkt, pkts[i]), "Decode err:", pkt, *pkts[i])
+			i++
+		})
+		expect(t, i == len(pkts), "Should decode all packets")
+
+		res, err := decodeStream(t, data, 0, 0)
+		expect(t, err == nil && len(res) == len(pkts), "Stream decode err:", err)
+		for i := range res {
+			expect(t, packetEqual(&res[i], pkts[i]), "Stream decode err:", res[i], *pkts[i])
+		}
+	})
+	// A length that ends inside a surrogate pair.
+	decPayload([]byte("2:4😀"), func(pkt Packet, index, total int) {
+		expect(t, packetEqual(&pkt, &errPkt), "Should get error packet")
+	})
+}
+
+func TestPayloadDecoderLenient(t *testing.T) {
+	// Byte lengths as sent by legacy Go clients.
+	data := []byte("3:4é7:4日本7:4日本")
+	_, err := decodeStream(t, data, 0, 0)
+	expect(t, err == ErrBadPayload, "Strict mode should reject byte lengths")
+
+	dec := NewPayloadDecoder(bytes.NewReader(data))
+	dec.Lenient = true
+	for _, want := range []string{"é", "日本", "日本"} {
+		pkt, err := dec.Next()
+		expect(t, err == nil && string(pkt.Data) == want, "Lenient decode err:", err, string(pkt.Data), want)
+	}
+	_, err = dec.Next()
+	expect(t, err == io.EOF, "Should end with EOF")
+
+	// Spec lengths still decode in lenient mode, even where a byte length
+	// would also end at a packet.
+	pkts := []*Packet{
+		&Packet{Type: "message", Data: []byte("a😀b")},
+		&Packet{Type: "message", Data: []byte("é5")},
+		&Packet{Type: "message", Data: []byte("ab")},
+	}
+	for i := 0; i < 200; i++ {
+		pkts = append(pkts, &Packet{Type: "message", Data: []byte("日本")})
+	}
+	dec = NewPayloadDecoder(bytes.NewReader(AppendPayload(nil, pkts, false)))
+	dec.Lenient = true
+	for _, want := range pkts {
+		pkt, err := dec.Next()
+		expect(t, err == nil && string(pkt.Data) == string(want.Data), "Lenient decode err:", err, string(pkt.Data), string(want.Data))
+	}
+	_, err = dec.Next()
+	expect(t, err == io.EOF, "Should end with EOF")
+}
+
+func TestEncodeDecodeMixedPayloadAsBinary(t *testing.T) {
+	pkts := []*Packet{
+		&Packet{Type: "message", Data: []byte("hello")},
+		&Packet{Type: "message", Data: []byte{0, 1, 255}, IsBin: true},
+		&Packet{Type: "ping", Data: []byte("probe")},
+	}
+	encPayloadB(pkts, func(data []byte) {
+		expect(t, bytes.HasPrefix(data, []byte{0, 6, 255, '4'}), "String packet should use the 0 marker")
+		decPayloadB(data, func(pkt Packet, index, total int) {
+			expect(t, packetEqual(&pkt, pkts[index]), "Decode err:", pkt, *pkts[index])
+			expect(t, pkt.IsBin == pkts[index].IsBin, "IsBin lost:", pkt)
+		})
+		res, err := decodeStream(t, data, 0, 0)
+		expect(t, err == nil && len(res) == len(pkts), "Stream decode err:", err)
+		for i := range res {
+			expect(t, res[i].IsBin == pkts[i].IsBin, "IsBin lost:", res[i])
+		}
+	})
+	// A binary marker in front of a string packet.
+	decPayloadB([]byte{1, 2, 255, '4', 'a'}, func(pkt Packet, index, total int) {
+		expect(t, packetEqual(&pkt, &errPkt), "Should get error packet")
+	})
+}
+
+func TestEncodePayloadWithoutBinary(t *testing.T) {
+	EncodePayload([]*Packet{&Packet{Type: "message", Data: []byte("a")}}, true, func(data []byte) {
+		expect(t, string(data) == "2:4a", "Text only payload should use text framing:", data)
+	})
+}
+
+func TestDecodeBase64PacketIsBin(t *testing.T) {
+	pkt := Packet{Type: "message", Data: []byte{1, 2, 3}, IsBin: true}
+	encode(&pkt, func(data []byte) {
+		decPkt := decode(data)
+		expect(t, packetEqual(&pkt, &decPkt) && decPkt.IsBin, "Decode error:", pkt, decPkt)
+	})
+}
+
+func TestSharedPacket(t *testing.T) {
+	data := []byte("héllo \U0001F600")
+	plain := &Packet{Type: "message", Data: data}
+	bin := &Packet{Type: "message", Data: []byte{1, 2, 3}, IsBin: true}
+	shared, sharedBin := Shared(*plain), Shared(*bin)
+	for _, b := range []bool{false, true} {
+		expect(t, bytes.Equal(AppendPacket(nil, shared, b), AppendPacket(nil, plain, b)), "shared text packet should encode the same, binary:", b)
+		expect(t, bytes.Equal(AppendPacket(nil, sharedBin, b), AppendPacket(nil, bin, b)), "shared binary packet should encode the same, binary:", b)
+		expect(t, bytes.Equal(AppendPayload(nil, []*Packet{shared, sharedBin}, b), AppendPayload(nil, []*Packet{plain, bin}, b)),
+			"shared payload should encode the same, binary:", b)
+	}
+	// The encodings are kept, so later changes to Data don't show.
+	before := AppendPacket(nil, shared, false)
+	shared.Data[0] = 'j'
+	expect(t, bytes.Equal(AppendPacket(nil, shared, false), before), "shared packet should be encoded once")
+}
@@ -0,0 +1,38 @@
+package parser
+
+import "sync"
+
+// encodeCache holds the encodings of a shared packet, made on first use.
+type encodeCache struct {
+	once    [2]sync.Once
+	enc     [2][]byte
+	lenOnce sync.Once
+	textLen int
+}
+
+// Shared returns a copy of pkt that is encoded at most once per binary mode,
+// however many transports send it. It is meant for packets fanned out to many
+// sockets, and may be used from several goroutines. Its Data must not be
+// modified afterwards.
+func Shared(pkt Packet) *Packet {
+	pkt.cache = new(encodeCache)
+	return &pkt
+}
+
+func (cache *encodeCache) encoded(pkt *Packet, supportsBinary bool) []byte {
+	i := 0
+	if supportsBinary {
+		i = 1
+	}
+	cache.once[i].Do(func() {
+		cache.enc[i] = appendPacket(nil, pkt, supportsBinary)
+	})
+	return cache.enc[i]
+}
+
+func (cache *encodeCache) length(pkt *Packet) int {
+	cache.lenOnce.Do(func() {
+		cache.textLen = computeTextLen(pkt)
+	})
+	return cache.textLen
+}
@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"unicode/utf8"
+)
+
+// The "len:" prefix of text payloads counts UTF-16 code units, which is what
+// String.prototype.length returns in the JS reference implementation.
+
+// utf16Len returns the number of UTF-16 code units of the UTF-8 text in data.
+// Invalid bytes count as one unit each, like their U+FFFD replacement.
+func utf16Len(data []byte) int {
+	n := 0
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			n++
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		n += runeUTF16Len(r)
+		i += size
+	}
+	return n
+}
+
+// utf16Offset returns the number of bytes of data that hold the first n UTF-16
+// code units, or -1 if data is too short or unit n splits a surrogate pair.
+func utf16Offset(data []byte, n int) int {
+	if n < 0 {
+		return -1
+	}
+	i := 0
+	for n > 0 {
+		if i >= len(data) {
+			return -1
+		}
+		if data[i] < utf8.RuneSelf {
+			n--
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		n -= runeUTF16Len(r)
+		i += size
+	}
+	if n < 0 {
+		return -1
+	}
+	return i
+}
+
+func runeUTF16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// textLen returns the length prefix of pkt in a text payload.
+func textLen(pkt *Packet) int {
+	if pkt.cache != nil {
+		return pkt.cache.length(pkt)
+	}
+	return computeTextLen(pkt)
+}
+
+func computeTextLen(pkt *Packet) int {
+	if pkt.IsBin {
+		// base64 is plain ASCII
+		return encodedLen(pkt, false)
+	}
+	return 1 + utf16Len(pkt.Data)
+}
@@ -0,0 +1,106 @@
+package engineio
+
+import (
+	"sync"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// Pipe is a Transport that carries packets over channels instead of HTTP.
+// Packets flushed by the socket come out of Out, and packets from the peer
+// go in through Receive. Open a socket over it with Server.Handshake.
+type Pipe struct {
+	TransportBase
+
+	// Filter, if set, sees every flush before it is queued on Out, and drops
+	// it by returning false. Set it before the pipe is used.
+	Filter func(pkts []*parser.Packet) bool
+
+	out       chan []*parser.Packet
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func NewPipe() *Pipe {
+	pipe := new(Pipe)
+	pipe.initTransportBase(nil)
+	pipe.name = "memory"
+	pipe.supportsBinary = true
+	pipe.out = make(chan []*parser.Packet, 64)
+	pipe.done = make(chan bool)
+
+	pipe.doClose = func(fn func()) {
+		debug("pipe closing")
+		fn()
+		pipe.finish()
+		pipe.onClose()
+	}
+	return pipe
+}
+
+// Out returns the packets sent by the socket, one slice per flush. It must be
+// drained, or sends block once its buffer is full.
+func (pipe *Pipe) Out() <-chan []*parser.Packet {
+	return pipe.out
+}
+
+// Done is closed once the pipe is closed from either end.
+func (pipe *Pipe) Done() <-chan bool {
+	return pipe.done
+}
+
+// Receive hands a packet from the peer to the socket.
+func (pipe *Pipe) Receive(pkt *parser.Packet) {
+	if pipe.readyState() == StateClosed {
+		return
+	}
+	if pkt.Type == "close" {
+		debug("got pipe close packet")
+		pipe.onPacket(pkt)
+		pipe.Hangup()
+		return
+	}
+	pipe.onPacket(pkt)
+}
+
+// Hangup closes the pipe from the peer's end without a close packet, like a
+// dropped connection.
+func (pipe *Pipe) Hangup() {
+	if pipe.readyState() == StateClosed {
+		return
+	}
+	pipe.finish()
+	pipe.onClose()
+}
+
+func (pipe *Pipe) finish() {
+	pipe.closeOnce.Do(func() {
+		close(pipe.done)
+	})
+}
+
+func (pipe *Pipe) send(pkts []*parser.Packet) {
+	// The socket reuses pkts once send returns.
+	pkts = append([]*parser.Packet(nil), pkts...)
+	if pipe.Filter != nil && !pipe.Filter(pkts) {
+		pipe.Emit("drain")
+		return
+	}
+	select {
+	case pipe.out <- pkts:
+	case <-pipe.done:
+		return
+	}
+	pipe.Emit("drain")
+}
+
+func (pipe *Pipe) tryWritable(fn, def func()) {
+	select {
+	case <-pipe.done:
+		if def != nil {
+			def()
+		}
+	default:
+		fn()
+	}
+}
@@ -1,10 +1,12 @@
 package engineio
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/kaicheng/engineio/parser"
+	"io"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Polling struct {
@@ -12,15 +14,22 @@ type Polling struct {
 
 	cleanup           func()
 	maxHTTPBufferSize int
+	lenientPayload    bool
+	pollTimeout       time.Duration
+	clock             Clock
 	shouldClose       func()
+	closeLock         sync.Mutex
 	headers           func(req *Request)
 	doWrite           func(req *Request, data []byte)
+	payload           func(req *Request) (io.Reader, error)
 
 	reqGuard  int32
 	dataGuard int32
 
-	writeCh chan []byte
-	readyCh chan bool
+	writeCh  chan *[]byte
+	readyCh  chan bool
+	done     chan bool
+	doneOnce sync.Once
 }
 
 func NewPollingTransport(req *Request) Transport {
@@ -43,15 +52,23 @@ func (poll *Polling) InitPolling(req *Request) {
 		poll.tryWritable(
 			func() {
 				poll.send([]*parser.Packet{&parser.Packet{Type: "close"}})
+				poll.finish()
 				fn()
 			},
 			func() {
+				poll.closeLock.Lock()
 				poll.shouldClose = fn
+				poll.closeLock.Unlock()
 			})
 	}
 
+	poll.payload = func(req *Request) (io.Reader, error) {
+		return req.httpReq.Body, nil
+	}
+
 	poll.readyCh = make(chan bool, 1)
-	poll.writeCh = make(chan []byte, 1)
+	poll.writeCh = make(chan *[]byte, 1)
+	poll.done = make(chan bool)
 
 }
 
@@ -93,6 +110,12 @@ func (poll *Polling) onPollRequest(req *Request) {
 	debug("setting request")
 
 	timeout := make(chan bool, 1)
+	if poll.pollTimeout > 0 {
+		timer := poll.clock.AfterFunc(poll.pollTimeout, func() {
+			timeout <- true
+		})
+		defer timer.Stop()
+	}
 
 	select {
 	case poll.readyCh <- true:
@@ -101,20 +124,61 @@ func (poll *Polling) onPollRequest(req *Request) {
 
 	poll.Emit("drain")
 
-	if poll.shouldClose != nil {
+	poll.closeLock.Lock()
+	closing := poll.shouldClose != nil
+	poll.closeLock.Unlock()
+	if closing {
 		poll.tryWritable(func() {
 			debug("triggering empty send to append close packet")
 			poll.send([]*parser.Packet{&noopPkt})
 		}, nil)
 	}
 
-	var data []byte = nil
 	select {
-	case data = <-poll.writeCh:
+	case buf := <-poll.writeCh:
+		poll.doWrite(req, *buf)
+		putBuffer(buf)
 	case <-timeout:
+		debug("poll timeout, answering with noop")
+		poll.tryWritable(func() {
+			poll.send([]*parser.Packet{&noopPkt})
+		}, nil)
+		// Whoever holds the request now is writing to it, unless the
+		// transport closed meanwhile.
+		select {
+		case buf := <-poll.writeCh:
+			poll.doWrite(req, *buf)
+			putBuffer(buf)
+		case <-poll.done:
+			select {
+			case buf := <-poll.writeCh:
+				poll.doWrite(req, *buf)
+				putBuffer(buf)
+			default:
+				poll.doWrite(req, parser.AppendPayload(nil, []*parser.Packet{&noopPkt}, poll.supportsBinary))
+			}
+		}
+	case <-poll.done:
+		select {
+		case buf := <-poll.writeCh:
+			poll.doWrite(req, *buf)
+			putBuffer(buf)
+		default:
+			debug("transport closed, answering with noop")
+			poll.doWrite(req, parser.AppendPayload(nil, []*parser.Packet{&noopPkt}, poll.supportsBinary))
+		}
+	case <-req.httpReq.Context().Done():
+		debug("poll connection closed prematurely")
+		poll.tryWritable(func() {}, func() {
+			select {
+			case buf := <-poll.writeCh:
+				putBuffer(buf)
+			case <-poll.done:
+			}
+		})
+		poll.onError("poll connection closed prematurely", "")
+		return
 	}
-	poll.doWrite(req, data)
-	close(timeout)
 
 	select {
 	case <-poll.readyCh:
@@ -133,24 +197,49 @@ func (poll *Polling) onDataRequest(req *Request) {
 	}
 	defer atomic.StoreInt32(&poll.dataGuard, 0)
 
-	chunks := new(bytes.Buffer)
-	buffer := make([]byte, 4096)
+	// The packets are held back until the payload is read in full, so that
+	// a payload exceeding a size limit is rejected as a whole.
+	body, err := poll.payload(req)
+	if err != nil {
+		debug("bad data request", err)
+		res.WriteHeader(400)
+		return
+	}
+	dec := parser.NewPayloadDecoder(body)
+	dec.MaxPacketSize = poll.maxHTTPBufferSize
+	dec.MaxPayloadSize = poll.maxHTTPBufferSize
+	dec.Lenient = poll.lenientPayload
+	var pkts []parser.Packet
 	for {
-		length, err := req.httpReq.Body.Read(buffer)
-		if length+chunks.Len() > poll.maxHTTPBufferSize {
-			chunks.Reset()
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == parser.ErrPacketTooLarge || err == parser.ErrPayloadTooLarge {
+			debug("data request exceeds maxHttpBufferSize")
 			req.httpReq.Body.Close()
 			req.httpReq.Close = true
-		} else {
-			chunks.Write(buffer[:length])
+			poll.onPacket(&pkt)
+			poll.headers(req)
+			res.WriteHeader(413)
+			return
 		}
+		pkts = append(pkts, pkt)
 		if err != nil {
 			break
 		}
 	}
-
-	debug("data request onEnd ok. data.len = ", chunks.Len())
-	go poll.onData(chunks.Next(chunks.Len()))
+	for i := range pkts {
+		pkt := &pkts[i]
+		if pkt.Type == "close" {
+			debug("got xhr close packet")
+			poll.onPacket(pkt)
+			poll.onClose()
+			break
+		}
+		poll.onPacket(pkt)
+	}
+	debug("data request onEnd ok")
 
 	res.Header().Set("Content-Length", "2")
 	res.Header().Set("Content-Type", "text/html")
@@ -160,10 +249,13 @@ func (poll *Polling) onDataRequest(req *Request) {
 }
 
 func (poll *Polling) onData(data []byte) {
-	debug(fmt.Sprintf("received \"%s\"", string(data)))
+	if eioDebug {
+		debug(fmt.Sprintf("received \"%s\"", string(data)))
+	}
 	parser.DecodePayload(data, func(pkt parser.Packet, index, total int) {
 		if pkt.Type == "close" {
 			debug("got xhr close packet")
+			poll.onPacket(&pkt)
 			poll.onClose()
 			return
 		}
@@ -172,27 +264,62 @@ func (poll *Polling) onData(data []byte) {
 }
 
 func (poll *Polling) send(pkts []*parser.Packet) {
-	if poll.shouldClose != nil {
+	poll.closeLock.Lock()
+	shouldClose := poll.shouldClose
+	poll.shouldClose = nil
+	poll.closeLock.Unlock()
+	if shouldClose != nil {
 		debug("appending close packet to payload")
 		pkts = append(pkts, &parser.Packet{Type: "close"})
-		poll.shouldClose()
-		poll.shouldClose = nil
+		defer poll.finish()
+		shouldClose()
 	}
 	debug("poll.send")
 	for _, pkt := range pkts {
 		debug(*pkt)
 	}
 
-	parser.EncodePayload(pkts, poll.supportsBinary, func(data []byte) {
-		poll.write(data)
-	})
+	buf := getBuffer()
+	*buf = parser.AppendPayload(*buf, pkts, poll.supportsBinary)
+	poll.write(buf)
 }
 
-func (poll *Polling) write(data []byte) {
-	debug(fmt.Sprintf("writing \"%s\"", string(data)))
-	poll.writeCh <- data
+func (poll *Polling) write(buf *[]byte) {
+	debug(fmt.Sprintf("writing \"%s\"", string(*buf)))
+	select {
+	case poll.writeCh <- buf:
+		return
+	default:
+	}
+	select {
+	case poll.writeCh <- buf:
+	case <-poll.done:
+		putBuffer(buf)
+	}
+}
+
+func (poll *Polling) onClose() {
+	poll.finish()
+	poll.TransportBase.onClose()
+}
+
+// finish releases any request still waiting on the transport, once the close
+// packet has been written or the client is gone.
+func (poll *Polling) finish() {
+	poll.doneOnce.Do(func() {
+		close(poll.done)
+	})
 }
 
 func (poll *Polling) setMaxHTTPBufferSize(size int) {
 	poll.maxHTTPBufferSize = size
 }
+
+func (poll *Polling) setLenientPayload(b bool) {
+	poll.lenientPayload = b
+}
+
+func (poll *Polling) setPollTimeout(d time.Duration, clock Clock) {
+	poll.pollTimeout = d
+	poll.clock = clock
+}
@@ -0,0 +1,446 @@
+package engineio
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// LimitPolicy says what happens to traffic over a rate limit.
+type LimitPolicy int
+
+const (
+	// LimitDrop rejects handshakes and polling requests with a 429, and
+	// discards messages.
+	LimitDrop LimitPolicy = iota
+	// LimitDelay holds traffic until the limit allows it, for up to the
+	// limit's MaxDelay; what would wait longer is dropped.
+	LimitDelay
+	// LimitClose closes the socket with reason "rate limit" and the
+	// LimitKind as description. Handshakes are rejected.
+	LimitClose
+)
+
+var limitPolicyNames = [...]string{
+	LimitDrop:  "drop",
+	LimitDelay: "delay",
+	LimitClose: "close",
+}
+
+func (policy LimitPolicy) String() string {
+	if policy < 0 || int(policy) >= len(limitPolicyNames) {
+		return "unknown"
+	}
+	return limitPolicyNames[policy]
+}
+
+// LimitKind names a rate limit.
+type LimitKind string
+
+const (
+	// LimitHandshake limits handshakes per client: the "handshakeLimit"
+	// option. Clients are told apart by their remote IP, or by the
+	// "handshakeLimitKey" option, a func(*http.Request) string such as
+	// ForwardedFor.
+	LimitHandshake LimitKind = "handshake"
+	// LimitMessages limits the messages a socket receives: "messageLimit".
+	LimitMessages LimitKind = "messages"
+	// LimitBytes limits the message data a socket receives: "byteLimit".
+	LimitBytes LimitKind = "bytes"
+	// LimitPolls limits the polling requests of a session: "pollLimit".
+	LimitPolls LimitKind = "polls"
+)
+
+// RateLimit is a token bucket holding up to Burst tokens, refilled at Rate
+// tokens per second. A message takes one message token and a byte token per
+// byte of data; a handshake or polling request takes one token.
+type RateLimit struct {
+	Rate   float64
+	Burst  int
+	Policy LimitPolicy
+	// MaxDelay bounds the wait of LimitDelay. It defaults to the time to
+	// refill the whole bucket.
+	MaxDelay time.Duration
+}
+
+func (limit *RateLimit) maxDelay() time.Duration {
+	if limit.MaxDelay > 0 {
+		return limit.MaxDelay
+	}
+	return time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+}
+
+// RateLimitEvent is emitted with the server's "rateLimit" event whenever
+// traffic is over a limit. Sid is empty for handshakes, and Key is the key
+// their limit was counted under.
+type RateLimitEvent struct {
+	Kind       LimitKind
+	Policy     LimitPolicy
+	Sid        string
+	RemoteAddr string
+	Key        string
+}
+
+func rateLimitOption(opts Options, key string) *RateLimit {
+	limit, ok := opts[key].(RateLimit)
+	if !ok {
+		return nil
+	}
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		panic(fmt.Sprintf("engineio: %s needs a positive Rate and Burst", key))
+	}
+	return &limit
+}
+
+type bucket struct {
+	lock   sync.Mutex
+	limit  *RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit *RateLimit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// refill must be called with lock held.
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+		b.last = now
+	}
+}
+
+// take takes n tokens if there are. More than Burst may be taken from a full
+// bucket, which then owes them.
+func (b *bucket) take(now time.Time, n float64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	if b.tokens < n && b.tokens < float64(b.limit.Burst) {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, owing them if needed, and returns how long it takes
+// to pay them back.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// cancel gives back n reserved tokens.
+func (b *bucket) cancel(n float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += n
+}
+
+// full reports whether the bucket has refilled, so that it can be forgotten.
+func (b *bucket) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// keyBuckets holds the handshake buckets of clients by key.
+type keyBuckets struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	sweepAt int
+}
+
+// get returns the bucket of key. Buckets that refilled are forgotten each
+// time the map doubles.
+func (kb *keyBuckets) get(limit *RateLimit, key string, now time.Time) *bucket {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+	if kb.buckets == nil {
+		kb.buckets = make(map[string]*bucket)
+		kb.sweepAt = 64
+	}
+	b := kb.buckets[key]
+	if b == nil {
+		if len(kb.buckets) >= kb.sweepAt {
+			for key, old := range kb.buckets {
+				if old.full(now) {
+					delete(kb.buckets, key)
+				}
+			}
+			kb.sweepAt = 2 * len(kb.buckets)
+			if kb.sweepAt < 64 {
+				kb.sweepAt = 64
+			}
+		}
+		b = newBucket(limit, now)
+		kb.buckets[key] = b
+	}
+	return b
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedFor returns a "handshakeLimitKey" for servers behind proxies or
+// load balancers, which would otherwise share one handshake limit among all
+// their clients. Requests from the trusted addresses, IPs or CIDR ranges, are
+// counted under the last address of their X-Forwarded-For header that is not
+// trusted itself; other requests under their remote IP, as the header can be
+// forged. It panics on an invalid address.
+func ForwardedFor(trusted ...string) func(*http.Request) string {
+	var nets []*net.IPNet
+	for _, addr := range trusted {
+		if !strings.Contains(addr, "/") {
+			if strings.Contains(addr, ":") {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			panic(fmt.Sprintf("engineio: bad trusted address %q", addr))
+		}
+		nets = append(nets, ipnet)
+	}
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(req *http.Request) string {
+		ip := remoteIP(req)
+		if !isTrusted(ip) {
+			return ip
+		}
+		var hops []string
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if len(hop) == 0 {
+				continue
+			}
+			ip = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		return ip
+	}
+}
+
+// sleep waits d on the server's clock.
+func (srv *Server) sleep(d time.Duration) {
+	done := make(chan bool)
+	srv.clock.AfterFunc(d, func() {
+		close(done)
+	})
+	<-done
+}
+
+// limitRequest applies b to an HTTP request, and reports whether to go on
+// with it. Rejected requests are answered; closeSocket is called for
+// LimitClose.
+func (srv *Server) limitRequest(b *bucket, event *RateLimitEvent, res http.ResponseWriter, closeSocket func()) bool {
+	now := srv.clock.Now()
+	if b.limit.Policy == LimitDelay {
+		wait := b.reserve(now, 1)
+		if wait == 0 {
+			return true
+		}
+		if wait <= b.limit.maxDelay() {
+			event.Policy = LimitDelay
+			srv.Emit("rateLimit", event)
+			srv.sleep(wait)
+			return true
+		}
+		b.cancel(1)
+		event.Policy = LimitDrop
+	} else if b.take(now, 1) {
+		return true
+	} else {
+		event.Policy = b.limit.Policy
+	}
+	debug(fmt.Sprintf("%s rate limit hit by %s", event.Kind, event.RemoteAddr))
+	srv.Emit("rateLimit", event)
+	if event.Policy == LimitClose && closeSocket != nil {
+		closeSocket()
+	}
+	sendErrorMessage(res, RATE_LIMITED)
+	return false
+}
+
+// limitHandshake applies the "handshakeLimit" option to req, counted under
+// the "handshakeLimitKey" of the request.
+func (srv *Server) limitHandshake(req *Request) bool {
+	if srv.handshakeLimit == nil || req.httpReq == nil {
+		return true
+	}
+	key := srv.handshakeLimitKey(req.httpReq)
+	b := srv.handshakeBuckets.get(srv.handshakeLimit, key, srv.clock.Now())
+	event := &RateLimitEvent{Kind: LimitHandshake, RemoteAddr: remoteIP(req.httpReq), Key: key}
+	return srv.limitRequest(b, event, req.res, nil)
+}
+
+// limitPoll applies the "pollLimit" option to a polling request of socket.
+func (srv *Server) limitPoll(socket *Socket, req *Request) bool {
+	if socket.pollBucket == nil {
+		return true
+	}
+	event := &RateLimitEvent{Kind: LimitPolls, Sid: socket.id, RemoteAddr: remoteIP(req.httpReq)}
+	return srv.limitRequest(socket.pollBucket, event, req.res, func() {
+		socket.post(func() {
+			socket.onClose("rate limit", string(LimitPolls))
+		})
+	})
+}
+
+// delayedPacket is a packet held by LimitDelay until at.
+type delayedPacket struct {
+	packet *parser.Packet
+	at     time.Time
+}
+
+// admitPacket applies the message and byte limits to a packet from the
+// client, and reports whether to handle it now. Delayed packets are handled
+// later, in order. Only messages count: pings and other control packets
+// always pass, so that a client sending at its limit is not timed out.
+func (socket *Socket) admitPacket(packet *parser.Packet) bool {
+	if socket.messageBucket == nil && socket.byteBucket == nil {
+		return true
+	}
+	if packet.Type != "message" {
+		return true
+	}
+	now := socket.server.clock.Now()
+	at := now
+	if len(socket.delayed) > 0 {
+		at = socket.delayed[len(socket.delayed)-1].at
+	}
+	type reservation struct {
+		b *bucket
+		n float64
+	}
+	var reserved []reservation
+	limits := []struct {
+		kind LimitKind
+		b    *bucket
+		n    float64
+	}{
+		{LimitMessages, socket.messageBucket, 1},
+		{LimitBytes, socket.byteBucket, float64(len(packet.Data))},
+	}
+	for _, l := range limits {
+		if l.b == nil {
+			continue
+		}
+		if l.b.limit.Policy != LimitDelay {
+			if !l.b.take(now, l.n) {
+				for _, r := range reserved {
+					r.b.cancel(r.n)
+				}
+				socket.limitHit(l.kind, l.b.limit.Policy)
+				return false
+			}
+			continue
+		}
+		wait := l.b.reserve(now, l.n)
+		reserved = append(reserved, reservation{l.b, l.n})
+		if wait > l.b.limit.maxDelay() {
+			for _, r := range reserved {
+				r.b.cancel(r.n)
+			}
+			socket.limitHit(l.kind, LimitDrop)
+			return false
+		}
+		if now.Add(wait).After(at) {
+			at = now.Add(wait)
+			socket.limitHit(l.kind, LimitDelay)
+		}
+	}
+	if !at.After(now) {
+		return true
+	}
+	socket.delayed = append(socket.delayed, delayedPacket{packet, at})
+	if len(socket.delayed) == 1 {
+		socket.armDelayed()
+	}
+	return false
+}
+
+func (socket *Socket) limitHit(kind LimitKind, policy LimitPolicy) {
+	debug(fmt.Sprintf("socket \"%s\" hit the %s rate limit", socket.id, kind))
+	socket.server.Emit("rateLimit", &RateLimitEvent{
+		Kind:       kind,
+		Policy:     policy,
+		Sid:        socket.id,
+		RemoteAddr: socket.handshake.RemoteAddr,
+	})
+	if policy == LimitClose {
+		socket.onClose("rate limit", string(kind))
+	}
+}
+
+// armDelayed arms the timer handling the first delayed packet.
+func (socket *Socket) armDelayed() {
+	var timer Timer
+	timer = socket.server.clock.AfterFunc(socket.delayed[0].at.Sub(socket.server.clock.Now()), func() {
+		socket.post(func() {
+			if socket.delayTimer != timer {
+				return
+			}
+			socket.delayTimer = nil
+			now := socket.server.clock.Now()
+			for len(socket.delayed) > 0 && !socket.delayed[0].at.After(now) {
+				packet := socket.delayed[0].packet
+				socket.delayed[0] = delayedPacket{}
+				socket.delayed = socket.delayed[1:]
+				socket.handlePacket(packet)
+			}
+			if len(socket.delayed) > 0 {
+				socket.armDelayed()
+			}
+		})
+	})
+	socket.delayTimer = timer
+}
+
+// stopDelayed drops the delayed packets.
+func (socket *Socket) stopDelayed() {
+	if socket.delayTimer != nil {
+		socket.delayTimer.Stop()
+	}
+	socket.delayTimer = nil
+	socket.delayed = nil
+}
@@ -0,0 +1,182 @@
+package engineio
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// onRateLimit reports the "rateLimit" events of srv as "kind:policy".
+func onRateLimit(srv *Server) chan string {
+	ch := make(chan string, 10)
+	srv.On("rateLimit", func(event *RateLimitEvent) {
+		ch <- string(event.Kind) + ":" + event.Policy.String()
+	})
+	return ch
+}
+
+func onMessages(socket *Socket) chan string {
+	ch := make(chan string, 10)
+	socket.On("message", func(data []byte) {
+		ch <- string(data)
+	})
+	return ch
+}
+
+func expectNoMessage(t *testing.T, ch chan string) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Error("should get no message, got", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	clock := NewFakeClock()
+	srv := NewServer(Options{"messageLimit": RateLimit{Rate: 1, Burst: 2}, "clock": clock})
+	limits := onRateLimit(srv)
+	sockets, pipes := roomPipes(t, srv, 1)
+	messages := onMessages(sockets[0])
+
+	for _, data := range []string{"a", "b", "c"} {
+		pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte(data)})
+	}
+	expect(t, wait(t, messages) == "a" && wait(t, messages) == "b", "messages within the burst should pass")
+	expect(t, wait(t, limits) == "messages:drop", "the drop should be reported")
+	expectNoMessage(t, messages)
+
+	clock.Advance(time.Second)
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("d")})
+	expect(t, wait(t, messages) == "d", "the bucket should refill")
+}
+
+func TestRateLimitPing(t *testing.T) {
+	srv := NewServer(Options{"messageLimit": RateLimit{Rate: 1, Burst: 1}, "clock": NewFakeClock()})
+	limits := onRateLimit(srv)
+	sockets, pipes := roomPipes(t, srv, 1)
+	messages := onMessages(sockets[0])
+
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("a")})
+	expect(t, wait(t, messages) == "a", "the first message should pass")
+	pipes[0].Receive(&parser.Packet{Type: "ping"})
+	expect(t, nextPacket(t, pipes[0]).Type == "pong", "a ping over the limit should be answered")
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("b")})
+	expect(t, wait(t, limits) == "messages:drop", "only the message should hit the limit")
+	expectNoMessage(t, messages)
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	clock := NewFakeClock()
+	srv := NewServer(Options{"messageLimit": RateLimit{Rate: 1, Burst: 1, Policy: LimitDelay}, "clock": clock})
+	limits := onRateLimit(srv)
+	sockets, pipes := roomPipes(t, srv, 1)
+	messages := onMessages(sockets[0])
+	pending := clock.Pending()
+
+	for _, data := range []string{"a", "b", "c"} {
+		pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte(data)})
+	}
+	expect(t, wait(t, messages) == "a", "the first message should pass")
+	expect(t, wait(t, limits) == "messages:delay", "the delay should be reported")
+	expect(t, wait(t, limits) == "messages:drop", "a message over MaxDelay should be dropped")
+	waitPending(t, clock, pending+1)
+	expectNoMessage(t, messages)
+
+	clock.Advance(time.Second)
+	expect(t, wait(t, messages) == "b", "the delayed message should pass in time")
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("d")})
+	expect(t, wait(t, limits) == "messages:delay", "the next message should wait for a token")
+	waitPending(t, clock, pending+1)
+	clock.Advance(time.Second)
+	expect(t, wait(t, messages) == "d", "the dropped message should not come back")
+}
+
+func TestRateLimitClose(t *testing.T) {
+	srv := NewServer(Options{"byteLimit": RateLimit{Rate: 10, Burst: 10, Policy: LimitClose}, "clock": NewFakeClock()})
+	limits := onRateLimit(srv)
+	sockets, pipes := roomPipes(t, srv, 1)
+	closed := make(chan string, 1)
+	sockets[0].On("close", func(reason string, desc string) {
+		closed <- reason + ":" + desc
+	})
+
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("0123456789a")})
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("b")})
+	expect(t, wait(t, limits) == "bytes:close", "the hit should be reported")
+	expect(t, wait(t, closed) == "rate limit:bytes", "the socket should close with the limit as reason")
+}
+
+func TestRateLimitHandshake(t *testing.T) {
+	srv, addr := listen(t, Options{"handshakeLimit": RateLimit{Rate: 0.001, Burst: 1}})
+	limits := onRateLimit(srv)
+	query := url.Values{"transport": {"polling"}}
+	res := get(t, addr+"/engine.io/default/", query, nil)
+	expect(t, res.code == 200, "the first handshake should pass:", res.code)
+	res = get(t, addr+"/engine.io/default/", query, nil)
+	expect(t, res.code == http.StatusTooManyRequests, "the second handshake should be rejected:", res.code)
+	expect(t, strings.Contains(res.body, ErrorMessages[RATE_LIMITED]), "the rejection should say why:", res.body)
+	expect(t, wait(t, limits) == "handshake:drop", "the rejection should be reported")
+}
+
+func TestRateLimitHandshakeKey(t *testing.T) {
+	// The test server is the trusted proxy.
+	_, addr := listen(t, Options{
+		"handshakeLimit":    RateLimit{Rate: 0.001, Burst: 1},
+		"handshakeLimitKey": ForwardedFor("127.0.0.1", "::1"),
+	})
+	query := url.Values{"transport": {"polling"}}
+	for _, client := range []string{"10.0.0.1", "10.0.0.2"} {
+		res := get(t, addr+"/engine.io/default/", query, http.Header{"X-Forwarded-For": {client}})
+		expect(t, res.code == 200, "clients behind the proxy should have their own limit:", client, res.code)
+	}
+	res := get(t, addr+"/engine.io/default/", query, http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+	expect(t, res.code == http.StatusTooManyRequests, "a client should still hit its own limit:", res.code)
+}
+
+func TestForwardedFor(t *testing.T) {
+	key := ForwardedFor("10.0.0.0/8")
+	for _, c := range []struct {
+		remote, header, want string
+	}{
+		{"10.1.1.1:80", "1.2.3.4", "1.2.3.4"},
+		{"10.1.1.1:80", "5.6.7.8, 1.2.3.4, 10.2.2.2", "1.2.3.4"},
+		{"10.1.1.1:80", "", "10.1.1.1"},
+		{"10.1.1.1:80", "10.3.3.3", "10.3.3.3"},
+		// Only trusted proxies may set the header.
+		{"9.9.9.9:80", "1.2.3.4", "9.9.9.9"},
+	} {
+		req := &http.Request{RemoteAddr: c.remote, Header: http.Header{}}
+		if len(c.header) > 0 {
+			req.Header.Set("X-Forwarded-For", c.header)
+		}
+		got := key(req)
+		expect(t, got == c.want, "key of", c.remote, c.header, "should be", c.want, "got", got)
+	}
+}
+
+func TestRateLimitPolls(t *testing.T) {
+	srv, addr := listen(t, Options{"pollLimit": RateLimit{Rate: 0.001, Burst: 1, Policy: LimitClose}})
+	limits := onRateLimit(srv)
+	sockets := onConnection(srv)
+	sid := handshakeSid(t, get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}}, nil))
+	closed := onClose(waitSocket(t, sockets))
+
+	rawurl := addr + "/engine.io/default/?" + url.Values{"transport": {"polling"}, "sid": {sid}}.Encode()
+	post := func() int {
+		res, err := http.Post(rawurl, "text/plain;charset=UTF-8", strings.NewReader("1:6"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	expect(t, post() == 200, "the first request should pass")
+	expect(t, post() == http.StatusTooManyRequests, "the second request should be rejected")
+	expect(t, wait(t, limits) == "polls:close", "the hit should be reported")
+	expect(t, wait(t, closed) == "rate limit", "the socket should close")
+}
@@ -0,0 +1,190 @@
+package engineio
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// Connection state recovery. With the "recoveryTimeout" option set, a socket
+// whose transport is lost is suspended rather than closed: it stays in
+// Clients and in its rooms, and what is sent to it is buffered. The open
+// packet carries a "pid", a random token only the client learns. A client
+// handshaking again within the timeout, with the query
+//
+//	recover=<old sid>&pid=<pid>&offset=<messages received>
+//
+// gets the same Socket back, with the messages it missed, and the socket
+// emits "recovered". The offset counts the message packets the client got in
+// the session; the last "recoveryBufferSize" ones sent are kept to be sent
+// again. Otherwise the socket closes with the original reason once the
+// timeout expires.
+
+// newRecoveryToken returns the pid of a new socket. Sids are guessable and
+// shown to other clients by applications, so they can't prove who is
+// recovering. It returns "" if no random token could be made, which leaves
+// the socket unrecoverable.
+func newRecoveryToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(token)
+}
+
+// recoverable reports whether a socket closing for reason may be recovered.
+// Closes asked for by either side are not.
+func recoverable(reason string) bool {
+	switch reason {
+	case "transport close", "transport error", "ping timeout":
+		return true
+	}
+	return false
+}
+
+// suspend keeps the socket for recovery after its transport is lost, and
+// reports whether it did.
+func (socket *Socket) suspend(reason, desc string) bool {
+	if socket.server.recoveryTimeout <= 0 || StateOpen != socket.readyState || !recoverable(reason) {
+		return false
+	}
+	debug(fmt.Sprintf("suspending socket \"%s\": %s", socket.id, reason))
+	if socket.upgrading != nil {
+		candidate := socket.upgrading
+		socket.stopUpgrade()
+		candidate.close(nil)
+	}
+	socket.clearTransport()
+	socket.setSuspended(true)
+
+	var timer Timer
+	timer = socket.server.clock.AfterFunc(socket.server.recoveryTimeout, func() {
+		socket.post(func() {
+			if socket.recoveryTimer == timer {
+				debug(fmt.Sprintf("socket \"%s\" was not recovered", socket.id))
+				socket.recoveryTimer = nil
+				socket.setSuspended(false)
+				socket.doClose(reason, desc)
+			}
+		})
+	})
+	socket.recoveryTimer = timer
+	return true
+}
+
+func (socket *Socket) setSuspended(suspended bool) {
+	socket.stateLock.Lock()
+	socket.suspended = suspended
+	socket.stateLock.Unlock()
+}
+
+// isSuspended reports whether the socket is waiting to be recovered.
+func (socket *Socket) isSuspended() bool {
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
+	return socket.suspended
+}
+
+// stopRecovery cancels the recovery timeout of a suspended socket.
+func (socket *Socket) stopRecovery() {
+	if socket.recoveryTimer != nil {
+		socket.recoveryTimer.Stop()
+	}
+	socket.recoveryTimer = nil
+	socket.setSuspended(false)
+}
+
+// remember keeps the messages of a flushed buffer for recovery.
+func (socket *Socket) remember(buf []*parser.Packet) {
+	max := socket.server.recoveryBufferSize
+	if socket.server.recoveryTimeout <= 0 || max <= 0 {
+		return
+	}
+	for _, packet := range buf {
+		if "message" == packet.Type {
+			socket.history = append(socket.history, packet)
+			socket.sent++
+		}
+	}
+	// Trimmed in batches, so that each message is copied once on average.
+	if len(socket.history) >= 2*max {
+		socket.history = append([]*parser.Packet(nil), socket.history[len(socket.history)-max:]...)
+	}
+}
+
+// resume attaches transport to the suspended socket, queueing the open
+// packet, the messages sent after offset and the ones still buffered. It
+// reports false if pid is wrong, the socket isn't suspended or it can't be
+// recovered from offset.
+func (socket *Socket) resume(transport Transport, pid string, offset int) bool {
+	if len(socket.recoveryToken) == 0 ||
+		subtle.ConstantTimeCompare([]byte(pid), []byte(socket.recoveryToken)) != 1 {
+		debug(fmt.Sprintf("wrong pid to recover socket \"%s\"", socket.id))
+		return false
+	}
+	if StateOpen != socket.readyState || !socket.suspended {
+		return false
+	}
+	first := socket.sent - len(socket.history)
+	if offset < first || offset > socket.sent {
+		debug(fmt.Sprintf("cannot recover socket \"%s\" from offset %d", socket.id, offset))
+		return false
+	}
+	socket.stopRecovery()
+
+	missed := append([]*parser.Packet(nil), socket.history[offset-first:]...)
+	socket.history = socket.history[:offset-first]
+	socket.sent = offset
+	for _, packet := range socket.writeBuffer {
+		if "message" == packet.Type {
+			missed = append(missed, packet)
+		}
+	}
+	debug(fmt.Sprintf("recovering socket \"%s\" with %d packets", socket.id, len(missed)))
+
+	socket.setTransport(transport)
+	socket.listen(transport)
+	transport.setSid(socket.id)
+	socket.setWriteBuffer(append(socket.writeBuffer[0:0], socket.openPacket()))
+	socket.setWriteBuffer(append(socket.writeBuffer, missed...))
+	socket.setPingTimeout()
+	socket.Emit("recovered")
+	socket.flush()
+	return true
+}
+
+// recover hands the transport of a handshake asking for recovery to the old
+// socket, and returns that socket, or nil if it can't be recovered.
+func (srv *Server) recover(transport Transport, req *Request) *Socket {
+	sid := req.Query.Get("recover")
+	if srv.recoveryTimeout <= 0 || len(sid) == 0 {
+		return nil
+	}
+	offset, err := strconv.Atoi(req.Query.Get("offset"))
+	if err != nil {
+		return nil
+	}
+	socket := srv.getClient(sid)
+	if socket == nil {
+		return nil
+	}
+	result := make(chan bool, 1)
+	socket.post(func() {
+		result <- socket.resume(transport, req.Query.Get("pid"), offset)
+	})
+	select {
+	case ok := <-result:
+		if !ok {
+			return nil
+		}
+	case <-socket.done:
+		return nil
+	}
+	srv.setCookie(transport, sid)
+	transport.onRequest(req)
+	return socket
+}
@@ -0,0 +1,114 @@
+package engineio
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+func recoverRequest(socket *Socket, offset string) *Request {
+	return &Request{Query: url.Values{"recover": {socket.ID()}, "pid": {socket.recoveryToken}, "offset": {offset}}}
+}
+
+func TestRecovery(t *testing.T) {
+	srv := NewServer(Options{"recoveryTimeout": 60000})
+	sockets, pipes := roomPipes(t, srv, 1)
+	socket := sockets[0]
+	socket.Join("r")
+	closed := onClose(socket)
+	recovered := make(chan string, 1)
+	socket.On("recovered", func() {
+		recovered <- "recovered"
+	})
+
+	expect(t, len(socket.recoveryToken) > 0, "the socket should have a pid")
+	socket.Send([]byte("a"))
+	socket.Send([]byte("b"))
+	nextPacket(t, pipes[0])
+	nextPacket(t, pipes[0])
+	pipes[0].Hangup()
+	socket.Send([]byte("c"))
+	srv.To("r").Send([]byte("d"))
+
+	pipe := NewPipe()
+	expect(t, srv.Handshake(pipe, recoverRequest(socket, "1")) == socket, "the old socket should be recovered")
+	expect(t, wait(t, recovered) == "recovered", "the socket should emit recovered")
+	var got []string
+	for len(got) < 4 {
+		got = append(got, nextFlush(t, pipe)...)
+	}
+	expect(t, strings.Contains(got[0], `"pid":"`+socket.recoveryToken+`"`), "the open packet should carry the pid:", got[0])
+	expect(t, got[0][:5] == "open:" && got[1] == "message:b" && got[2] == "message:c" && got[3] == "message:d",
+		"missed messages should follow the open packet:", got)
+	expect(t, socket.ReadyState() == StateOpen && len(socket.Rooms()) == 1, "the socket should keep its state")
+	select {
+	case reason := <-closed:
+		t.Error("recovered socket should not close:", reason)
+	default:
+	}
+
+	received := make(chan string, 1)
+	socket.On("message", func(data []byte) {
+		received <- string(data)
+	})
+	pipe.Receive(&parser.Packet{Type: "message", Data: []byte("e")})
+	expect(t, wait(t, received) == "e", "the new transport should deliver")
+}
+
+func TestRecoveryTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	srv := NewServer(Options{"recoveryTimeout": 1000, "clock": clock})
+	sockets, pipes := roomPipes(t, srv, 2)
+	closed := onClose(sockets[0])
+	pipes[0].Hangup()
+	deadline := time.Now().Add(timeout)
+	for !sockets[0].isSuspended() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	expect(t, sockets[0].isSuspended(), "lost socket should be suspended")
+	clock.Advance(time.Second)
+	expect(t, wait(t, closed) == "transport close", "unrecovered socket should close with the original reason")
+
+	pipe := NewPipe()
+	socket := srv.Handshake(pipe, recoverRequest(sockets[0], "0"))
+	expect(t, socket != sockets[0], "an expired session should get a new socket")
+
+	// A client closing cleanly is not kept for recovery.
+	closed = onClose(sockets[1])
+	pipes[1].Receive(&parser.Packet{Type: "close"})
+	expect(t, wait(t, closed) == "transport close", "closing client should close at once")
+}
+
+func TestRecoveryWrongPid(t *testing.T) {
+	srv := NewServer(Options{"recoveryTimeout": 60000})
+	sockets, pipes := roomPipes(t, srv, 1)
+	pipes[0].Hangup()
+	deadline := time.Now().Add(timeout)
+	for !sockets[0].isSuspended() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, pid := range []string{"", "0", sockets[0].recoveryToken[1:]} {
+		req := &Request{Query: url.Values{"recover": {sockets[0].ID()}, "pid": {pid}, "offset": {"0"}}}
+		socket := srv.Handshake(NewPipe(), req)
+		expect(t, socket != sockets[0], "a wrong pid should get a new socket:", pid)
+	}
+	expect(t, sockets[0].isSuspended(), "the lost socket should still wait for its client")
+	expect(t, srv.Handshake(NewPipe(), recoverRequest(sockets[0], "0")) == sockets[0], "the right pid should recover")
+}
+
+func TestRecoveryLiveSocket(t *testing.T) {
+	srv := NewServer(Options{"recoveryTimeout": 60000})
+	sockets, pipes := roomPipes(t, srv, 1)
+	closed := onClose(sockets[0])
+
+	socket := srv.Handshake(NewPipe(), recoverRequest(sockets[0], "0"))
+	expect(t, socket != sockets[0], "a live socket should not be taken over")
+	received := onMessages(sockets[0])
+	pipes[0].Receive(&parser.Packet{Type: "message", Data: []byte("a")})
+	expect(t, wait(t, received) == "a", "the live socket should keep its transport")
+	expectNoMessage(t, closed)
+}
@@ -0,0 +1,226 @@
+// Package replay plays a session recorded by an engineio.Capture against a
+// server and reports where the server's answers differ from the recording.
+//
+// The packets the client sent are sent again, in order, over the transport
+// the session opened with. Transport level packets (pings, upgrades, noops)
+// are left to the client, and only the messages the server sends are
+// compared, as the rest depends on timing.
+package replay
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/client"
+	"github.com/kaicheng/engineio/parser"
+)
+
+type Options struct {
+	// Speed scales the delays between the recorded packets: 2 replays twice
+	// as fast. With 0, packets are sent back to back.
+	Speed float64
+	// Settle is how long to wait for the server's messages after the last
+	// packet is sent, and before a recorded close, one second by default.
+	Settle time.Duration
+	// Path is the engine.io endpoint, "/engine.io/" by default.
+	Path string
+}
+
+// Divergence is a message of the replay that differs from the recording.
+// Expected or Got is empty when one side has fewer messages.
+type Divergence struct {
+	Index    int
+	Expected string
+	Got      string
+}
+
+func (d Divergence) String() string {
+	expected, got := d.Expected, d.Got
+	if len(expected) == 0 {
+		expected = "nothing"
+	}
+	if len(got) == 0 {
+		got = "nothing"
+	}
+	return fmt.Sprintf("message %d: expected %s, got %s", d.Index, expected, got)
+}
+
+type Report struct {
+	Sid         string
+	Transport   string
+	Sent        int
+	Expected    []string
+	Got         []string
+	Divergences []Divergence
+}
+
+func (report *Report) Diverged() bool {
+	return len(report.Divergences) > 0
+}
+
+func (report *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "session %s over %s: sent %d packets, expected %d messages, got %d\n",
+		report.Sid, report.Transport, report.Sent, len(report.Expected), len(report.Got))
+	if !report.Diverged() {
+		b.WriteString("no divergence\n")
+	}
+	for _, d := range report.Divergences {
+		b.WriteString(d.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Sessions returns the session ids of recs, in the order they first appear.
+func Sessions(recs []engineio.CaptureRecord) []string {
+	seen := make(map[string]bool)
+	var sids []string
+	for _, rec := range recs {
+		if !seen[rec.Sid] {
+			seen[rec.Sid] = true
+			sids = append(sids, rec.Sid)
+		}
+	}
+	return sids
+}
+
+// Run replays the session sid of recs against the server at addr.
+func Run(addr string, recs []engineio.CaptureRecord, sid string, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	settle := opts.Settle
+	if settle == 0 {
+		settle = time.Second
+	}
+
+	report := &Report{Sid: sid}
+	var in []engineio.CaptureRecord
+	// The number of messages recorded before each packet of in.
+	var before []int
+	for _, rec := range recs {
+		if rec.Sid != sid {
+			continue
+		}
+		if len(report.Transport) == 0 {
+			report.Transport = rec.Transport
+		}
+		pkt := rec.Packet()
+		if rec.Dir == "in" {
+			in = append(in, rec)
+			before = append(before, len(report.Expected))
+		} else if pkt.Type == "message" {
+			report.Expected = append(report.Expected, describe(&pkt))
+		}
+	}
+	if len(report.Transport) == 0 {
+		return nil, fmt.Errorf("replay: no packets for session %q", sid)
+	}
+
+	c, err := client.New(addr, &client.Options{
+		Path:       opts.Path,
+		Transports: []string{report.Transport},
+		NoUpgrade:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var lock sync.Mutex
+	var messages []string
+	received := make(chan bool, 1)
+	c.On("packet", func(pkt *parser.Packet) {
+		if pkt.Type != "message" {
+			return
+		}
+		lock.Lock()
+		messages = append(messages, describe(pkt))
+		lock.Unlock()
+		select {
+		case received <- true:
+		default:
+		}
+	})
+	if err := c.Open(); err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// wait waits up to settle for n messages, unless the client closes.
+	wait := func(n int) {
+		deadline := time.After(settle)
+		for {
+			lock.Lock()
+			waiting := len(messages) < n
+			lock.Unlock()
+			if !waiting {
+				return
+			}
+			select {
+			case <-received:
+			case <-c.Done():
+				return
+			case <-deadline:
+				return
+			}
+		}
+	}
+
+	for i, rec := range in {
+		if i > 0 && opts.Speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(in[i-1].Time)) / opts.Speed))
+		}
+		pkt := rec.Packet()
+		switch pkt.Type {
+		case "message":
+			if err := c.SendPacket(&pkt); err != nil {
+				return nil, err
+			}
+			report.Sent++
+		case "close":
+			// Closing discards what the server has yet to deliver.
+			wait(before[i])
+			c.Close()
+			report.Sent++
+		}
+	}
+	wait(len(report.Expected))
+
+	lock.Lock()
+	report.Got = append([]string(nil), messages...)
+	lock.Unlock()
+	for i := 0; i < len(report.Expected) || i < len(report.Got); i++ {
+		var expected, got string
+		if i < len(report.Expected) {
+			expected = report.Expected[i]
+		}
+		if i < len(report.Got) {
+			got = report.Got[i]
+		}
+		if expected != got {
+			report.Divergences = append(report.Divergences, Divergence{Index: i, Expected: expected, Got: got})
+		}
+	}
+	return report, nil
+}
+
+// RunHandler replays the session sid of recs against handler, served from
+// this process.
+func RunHandler(handler http.Handler, recs []engineio.CaptureRecord, sid string, opts *Options) (*Report, error) {
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	return Run(ts.URL, recs, sid, opts)
+}
+
+func describe(pkt *parser.Packet) string {
+	if pkt.IsBin {
+		return "binary " + hex.EncodeToString(pkt.Data)
+	}
+	return fmt.Sprintf("text %q", pkt.Data)
+}
@@ -0,0 +1,90 @@
+package replay
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/client"
+)
+
+// echoServer answers every message with transform(message).
+func echoServer(opts engineio.Options, transform func(string) string) *engineio.Server {
+	srv := engineio.NewServer(opts)
+	srv.On("connection", func(socket *engineio.Socket) {
+		socket.On("message", func(data []byte) {
+			socket.Send([]byte(transform(string(data))))
+		})
+	})
+	return srv
+}
+
+func record(t *testing.T) []engineio.CaptureRecord {
+	buf := new(bytes.Buffer)
+	capture := engineio.NewCapture(buf)
+	srv := echoServer(engineio.Options{"capture": capture}, func(s string) string { return s })
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close()
+
+	c, err := client.Dial(ts.URL, &client.Options{Transports: []string{"polling"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoes := make(chan bool, 2)
+	c.On("message", func(data []byte) {
+		echoes <- true
+	})
+	c.Send([]byte("a"))
+	c.Send([]byte("b"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-echoes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	c.Close()
+	srv.Close()
+
+	recs, err := engineio.ReadCapture(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.Err() != nil {
+		t.Fatal(capture.Err())
+	}
+	return recs
+}
+
+func TestReplay(t *testing.T) {
+	recs := record(t)
+	sessions := Sessions(recs)
+	if len(sessions) != 1 {
+		t.Fatal("expected one session, got", sessions)
+	}
+	opts := &Options{Settle: time.Second}
+
+	srv := echoServer(nil, func(s string) string { return s })
+	defer srv.Close()
+	report, err := RunHandler(srv, recs, sessions[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Diverged() || report.Sent != 3 || len(report.Got) != 2 {
+		t.Error("replay against the same server should match:", report)
+	}
+
+	upper := echoServer(nil, strings.ToUpper)
+	defer upper.Close()
+	report, err = RunHandler(upper, recs, sessions[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 2 || report.Divergences[0].Got != `text "A"` {
+		t.Error("replay against another server should diverge:", report)
+	}
+}
@@ -0,0 +1,79 @@
+package engineio
+
+import (
+	"github.com/kaicheng/engineio/parser"
+)
+
+// Join adds the socket to room. Sockets leave their rooms when they close.
+func (socket *Socket) Join(room string) {
+	socket.server.adapter.Join(socket, room)
+}
+
+// Leave removes the socket from room.
+func (socket *Socket) Leave(room string) {
+	socket.server.adapter.Leave(socket, room)
+}
+
+// Rooms returns the rooms the socket is in, sorted.
+func (socket *Socket) Rooms() []string {
+	return socket.server.adapter.Rooms(socket)
+}
+
+// BroadcastOperator sends a message to a set of sockets, on every node the
+// server's adapter reaches. Get one from Server.To or Server.Except.
+type BroadcastOperator struct {
+	srv  *Server
+	opts BroadcastOptions
+}
+
+// To returns an operator sending to the sockets in any of rooms.
+func (srv *Server) To(rooms ...string) *BroadcastOperator {
+	return &BroadcastOperator{srv: srv, opts: BroadcastOptions{Rooms: rooms}}
+}
+
+// Except returns an operator sending to every socket but those with ids.
+func (srv *Server) Except(ids ...string) *BroadcastOperator {
+	return &BroadcastOperator{srv: srv, opts: BroadcastOptions{Except: ids}}
+}
+
+// Broadcast sends data to every connected socket.
+func (srv *Server) Broadcast(data []byte) {
+	srv.To().Send(data)
+}
+
+// To adds rooms to the ones the operator sends to.
+func (op *BroadcastOperator) To(rooms ...string) *BroadcastOperator {
+	opts := op.opts
+	opts.Rooms = append(opts.Rooms[:len(opts.Rooms):len(opts.Rooms)], rooms...)
+	return &BroadcastOperator{srv: op.srv, opts: opts}
+}
+
+// Except leaves out the sockets with ids.
+func (op *BroadcastOperator) Except(ids ...string) *BroadcastOperator {
+	opts := op.opts
+	opts.Except = append(opts.Except[:len(opts.Except):len(opts.Except)], ids...)
+	return &BroadcastOperator{srv: op.srv, opts: opts}
+}
+
+// Sockets returns the sockets of this process the operator sends to.
+// Without rooms, that is every connected socket.
+func (op *BroadcastOperator) Sockets() []*Socket {
+	return op.srv.adapter.Sockets(op.opts)
+}
+
+// Send sends data as a text message. The packet is encoded once for every
+// transport and binary mode, not once per socket.
+func (op *BroadcastOperator) Send(data []byte) {
+	op.SendPackets(parser.Shared(parser.Packet{Type: "message", Data: data}))
+}
+
+// SendBin sends data as a binary message.
+func (op *BroadcastOperator) SendBin(data []byte) {
+	op.SendPackets(parser.Shared(parser.Packet{Type: "message", Data: data, IsBin: true}))
+}
+
+// SendPackets sends pkts back to back to each socket, like
+// Socket.SendPackets.
+func (op *BroadcastOperator) SendPackets(pkts ...*parser.Packet) {
+	op.srv.adapter.Broadcast(pkts, op.opts)
+}
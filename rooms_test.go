@@ -0,0 +1,103 @@
+package engineio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// roomPipes opens n sockets over pipes and drains their open packets.
+func roomPipes(t *testing.T, srv *Server, n int) ([]*Socket, []*Pipe) {
+	t.Helper()
+	sockets := make([]*Socket, n)
+	pipes := make([]*Pipe, n)
+	for i := range sockets {
+		pipes[i] = NewPipe()
+		sockets[i] = srv.Handshake(pipes[i], nil)
+		nextFlush(t, pipes[i])
+	}
+	return sockets, pipes
+}
+
+func nextPacket(t *testing.T, pipe *Pipe) *parser.Packet {
+	t.Helper()
+	select {
+	case pkts := <-pipe.Out():
+		return pkts[0]
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	return nil
+}
+
+func expectNothing(t *testing.T, pipe *Pipe) {
+	t.Helper()
+	select {
+	case pkts := <-pipe.Out():
+		t.Error("should get nothing, got", pkts[0].Type, string(pkts[0].Data))
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRoomsTo(t *testing.T) {
+	srv := NewServer(nil)
+	sockets, pipes := roomPipes(t, srv, 3)
+	sockets[0].Join("a")
+	sockets[1].Join("a")
+	sockets[1].Join("b")
+	sockets[2].Join("b")
+	expect(t, len(sockets[1].Rooms()) == 2 && sockets[1].Rooms()[0] == "a", "rooms should be listed:", sockets[1].Rooms())
+
+	srv.To("a").Except(sockets[0].ID()).Send([]byte("x"))
+	expect(t, string(nextPacket(t, pipes[1]).Data) == "x", "a member should get the message")
+	expectNothing(t, pipes[0])
+	expectNothing(t, pipes[2])
+
+	srv.To("a", "b").SendBin([]byte{1})
+	for _, pipe := range pipes {
+		pkt := nextPacket(t, pipe)
+		expect(t, pkt.IsBin && pkt.Data[0] == 1, "every member should get the message once")
+	}
+	expectNothing(t, pipes[1])
+
+	sockets[1].Leave("a")
+	ids := make([]string, 0)
+	for _, socket := range srv.To("a").Sockets() {
+		ids = append(ids, socket.ID())
+	}
+	expect(t, len(ids) == 1 && ids[0] == sockets[0].ID(), "only the remaining member should be in a:", ids)
+}
+
+func TestRoomsBroadcast(t *testing.T) {
+	srv := NewServer(nil)
+	_, pipes := roomPipes(t, srv, 2)
+	srv.Broadcast([]byte("all"))
+	first, second := nextPacket(t, pipes[0]), nextPacket(t, pipes[1])
+	expect(t, string(first.Data) == "all" && string(second.Data) == "all", "every socket should get the broadcast")
+	expect(t, first == second, "sockets should share one packet")
+}
+
+func TestRoomsLeftOnClose(t *testing.T) {
+	srv := NewServer(nil)
+	sockets, _ := roomPipes(t, srv, 2)
+	sockets[0].Join("a")
+	sockets[1].Join("a")
+	closed := make(chan string, 1)
+	sockets[0].On("close", func(reason string) {
+		closed <- reason
+	})
+	sockets[0].Close()
+	waitString(t, closed)
+	<-sockets[0].done
+	members := srv.To("a").Sockets()
+	expect(t, len(members) == 1 && members[0] == sockets[1], "closed socket should leave its rooms")
+	sockets[0].Join("b")
+	expect(t, len(srv.To("b").Sockets()) == 0, "closed socket should not join")
+	sockets[1].Close()
+	<-sockets[1].done
+	adapter := srv.adapter.(*MemoryAdapter)
+	adapter.lock.Lock()
+	expect(t, len(adapter.rooms) == 0 && len(adapter.sids) == 0, "empty rooms should be removed:", len(adapter.rooms))
+	adapter.lock.Unlock()
+}
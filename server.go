@@ -3,8 +3,11 @@ package engineio
 import (
 	"fmt"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaicheng/events"
@@ -16,19 +19,45 @@ type Options map[string]interface{}
 
 type Server struct {
 	events.EventEmitter
+	flushListened int32
 
 	Clients      map[string]*Socket
 	clientsCount int
+	clientsLock  sync.Mutex
+
+	adapter Adapter
+
+	recoveryTimeout    time.Duration
+	recoveryBufferSize int
+	capture            *Capture
+
+	handshakeLimit   *RateLimit
+	messageLimit     *RateLimit
+	byteLimit        *RateLimit
+	pollLimit        *RateLimit
+	handshakeBuckets keyBuckets
+	// handshakeLimitKey tells the clients of handshakeLimit apart.
+	handshakeLimitKey func(*http.Request) string
+
+	sessions        SessionStore
+	unwatchSessions func()
+	node            string
+	proxies         map[string]*httputil.ReverseProxy
+	proxiesLock     sync.Mutex
 
 	pingTimeout    time.Duration
 	pingInterval   time.Duration
 	upgradeTimeout time.Duration
 
 	maxHttpBufferSize int
+	pollTimeout       time.Duration
+	lenientPayload    bool
 	transports        []string
 	allowUpgrades     bool
 	allowRequest      func(*Request, func(int, bool))
 	cookie            string
+	clock             Clock
+	wrapTransport     func(Transport) Transport
 }
 
 type Request struct {
@@ -42,7 +71,10 @@ type Request struct {
 	cleanup func() // used by polling
 }
 
-var gi = 0
+var (
+	gi     = 0
+	giLock sync.Mutex
+)
 
 func inTransports(trans []string, tran string) bool {
 	for _, t := range trans {
@@ -53,8 +85,30 @@ func inTransports(trans []string, tran string) bool {
 	return false
 }
 
+// On adds listener for event. Like Socket.On, it notes "flush" listeners.
+func (srv *Server) On(event string, listener interface{}) {
+	srv.noteListener(event)
+	srv.EventEmitter.On(event, listener)
+}
+
+func (srv *Server) Once(event string, listener interface{}) {
+	srv.noteListener(event)
+	srv.EventEmitter.Once(event, listener)
+}
+
+func (srv *Server) noteListener(event string) {
+	if "flush" == event {
+		atomic.StoreInt32(&srv.flushListened, 1)
+	}
+}
+
+func (srv *Server) hasFlushListener() bool {
+	return atomic.LoadInt32(&srv.flushListened) != 0
+}
+
 func generateId() string {
-	// FIXME: Need lock
+	giLock.Lock()
+	defer giLock.Unlock()
 	gi++
 	return fmt.Sprintf("%d", gi)
 }
@@ -94,8 +148,13 @@ func NewServer(opts Options) (srv *Server) {
 	srv.pingTimeout = (time.Duration(valueOrDefault(opts, "pingTimeout", 60000).(int)) * time.Millisecond)
 	srv.pingInterval = (time.Duration(valueOrDefault(opts, "pingInterval", 25000).(int)) * time.Millisecond)
 	srv.upgradeTimeout = (time.Duration(valueOrDefault(opts, "upgradeTimeout", 10000).(int)) * time.Millisecond)
+	srv.clock = valueOrDefault(opts, "clock", realClock{}).(Clock)
+	srv.recoveryTimeout = (time.Duration(valueOrDefault(opts, "recoveryTimeout", 0).(int)) * time.Millisecond)
+	srv.recoveryBufferSize = valueOrDefault(opts, "recoveryBufferSize", 1000).(int)
 
 	srv.maxHttpBufferSize = valueOrDefault(opts, "maxHttpBufferSize", 100000000).(int)
+	srv.pollTimeout = (time.Duration(valueOrDefault(opts, "pollTimeout", 20000).(int)) * time.Millisecond)
+	srv.lenientPayload = valueOrDefault(opts, "lenientPayloadLength", false).(bool)
 	tmpTransports := valueOrDefault(opts, "transports", transportsArray).([]interface{})
 	srv.transports = make([]string, len(tmpTransports))
 	for i, v := range tmpTransports {
@@ -104,6 +163,42 @@ func NewServer(opts Options) (srv *Server) {
 	srv.allowUpgrades = valueOrDefault(opts, "allowUpgrades", true).(bool)
 	srv.allowRequest = nil
 	srv.cookie = valueOrDefault(opts, "cookie", "io").(string)
+	if wrap, ok := opts["wrapTransport"].(func(Transport) Transport); ok {
+		srv.wrapTransport = wrap
+	}
+	if adapter, ok := opts["adapter"].(Adapter); ok {
+		srv.adapter = adapter
+	} else {
+		srv.adapter = NewMemoryAdapter()
+	}
+	srv.handshakeLimit = rateLimitOption(opts, "handshakeLimit")
+	if key, ok := opts["handshakeLimitKey"].(func(*http.Request) string); ok {
+		srv.handshakeLimitKey = key
+	} else {
+		srv.handshakeLimitKey = remoteIP
+	}
+	srv.messageLimit = rateLimitOption(opts, "messageLimit")
+	srv.byteLimit = rateLimitOption(opts, "byteLimit")
+	srv.pollLimit = rateLimitOption(opts, "pollLimit")
+	if capture, ok := opts["capture"].(*Capture); ok {
+		srv.capture = capture
+	}
+	if store, ok := opts["sessionStore"].(SessionStore); ok {
+		srv.sessions = store
+	} else {
+		srv.sessions = NewMemoryStore()
+	}
+	// node is the base URL other nodes forward this one's requests to.
+	srv.node = valueOrDefault(opts, "node", "").(string)
+	srv.proxies = make(map[string]*httputil.ReverseProxy)
+	if len(srv.node) > 0 {
+		unwatch, err := srv.sessions.Watch(srv.node, srv.drainSession)
+		if err != nil {
+			debug("session store:", err)
+		} else {
+			srv.unwatchSessions = unwatch
+		}
+	}
 
 	return
 }
@@ -113,9 +208,10 @@ const (
 	UNKNOWN_SID
 	BAD_HANDSHAKE_METHOD
 	BAD_REQUEST
+	RATE_LIMITED
 )
 
-var ErrorMessages = []string{"Transport unknown", "Session ID unknown", "Bad handshake method", "Bad request"}
+var ErrorMessages = []string{"Transport unknown", "Session ID unknown", "Bad handshake method", "Bad request", "Rate limit exceeded"}
 
 // TODO(kaicheng): allow upgrades.
 func (srv *Server) upgrades(transport string) []string {
@@ -147,12 +243,12 @@ func (srv *Server) verify(req *Request, upgrade bool, fn func(int, bool)) {
 	}
 
 	if len(sid) > 0 {
-		client, ok := srv.Clients[sid]
-		if !ok {
+		client := srv.getClient(sid)
+		if client == nil || client.isSuspended() {
 			fn(UNKNOWN_SID, false)
 			return
 		}
-		if !upgrade && client.Transport.Name() != transport {
+		if !upgrade && client.getTransport().Name() != transport {
 			debug("bad request: unexpected transport without upgrade")
 			fn(BAD_REQUEST, false)
 			return
@@ -176,7 +272,11 @@ func (srv *Server) verify(req *Request, upgrade bool, fn func(int, bool)) {
 
 func sendErrorMessage(res http.ResponseWriter, code int) {
 	res.Header().Set("Content-type", "application/json")
-	res.WriteHeader(400)
+	if code == RATE_LIMITED {
+		res.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		res.WriteHeader(400)
+	}
 	data := fmt.Sprintf("{\"code\":%d,\"message\":\"%s\"}", code, ErrorMessages[code])
 	res.Write([]byte(data))
 	/*
@@ -188,12 +288,19 @@ func sendErrorMessage(res http.ResponseWriter, code int) {
 func (srv *Server) getTransport(name string, req *Request) Transport {
 	transport := transports[name](req)
 
-	if transport.readyState() == "closed" {
+	if transport.readyState() == StateClosed {
 		return nil
 	}
 
+	if srv.wrapTransport != nil {
+		transport = srv.wrapTransport(transport)
+		transport.setClock(srv.clock)
+	}
+
 	if "polling" == name {
 		transport.setMaxHTTPBufferSize(srv.maxHttpBufferSize)
+		transport.setLenientPayload(srv.lenientPayload)
+		transport.setPollTimeout(srv.pollTimeout, srv.clock)
 	}
 
 	if getBool(req.Query["b64"]) {
@@ -213,6 +320,17 @@ func (srv *Server) ServeHTTP(res http.ResponseWriter, httpreq *http.Request) {
 	req.res = res
 	debug(*httpreq)
 
+	sid := req.Query.Get("sid")
+	if len(sid) == 0 {
+		sid = req.Query.Get("recover")
+	}
+	if len(sid) > 0 {
+		if node := srv.owner(httpreq, sid); len(node) > 0 {
+			srv.forward(res, httpreq, node)
+			return
+		}
+	}
+
 	hasUpgrade := len(httpreq.Header.Get("Upgrade")) > 0
 
 	srv.verify(req, hasUpgrade, func(err int, success bool) {
@@ -227,20 +345,33 @@ func (srv *Server) ServeHTTP(res http.ResponseWriter, httpreq *http.Request) {
 		if len(sid) > 0 {
 			debug("setting new request for existing client")
 			if len(req.httpReq.Header.Get("upgrade")) > 0 {
-				socket := srv.Clients[sid]
+				socket := srv.getClient(sid)
 				if socket == nil {
 					debug("upgrade attempt for closed client")
 					sendErrorMessage(res, err)
-				} else if socket.upgraded {
+				} else if socket.Upgraded() {
 					debug("transport had already been upgraded")
 					sendErrorMessage(res, err)
 				} else {
 					debug("upgrading existing transport")
 					transport := srv.getTransport(req.Query.Get("transport"), req)
+					if transport == nil {
+						debug("upgrade handshake failed")
+						sendErrorMessage(res, BAD_REQUEST)
+						return
+					}
 					socket.maybeUpgrade(transport)
 				}
 			} else {
-				srv.Clients[sid].Transport.onRequest(req)
+				socket := srv.getClient(sid)
+				if socket == nil {
+					sendErrorMessage(res, UNKNOWN_SID)
+					return
+				}
+				if !srv.limitPoll(socket, req) {
+					return
+				}
+				socket.getTransport().onRequest(req)
 			}
 		} else {
 			srv.handshake(req.Query.Get("transport"), req)
@@ -250,9 +381,32 @@ func (srv *Server) ServeHTTP(res http.ResponseWriter, httpreq *http.Request) {
 
 func (srv *Server) Close() {
 	debug("closing all open clients")
+	srv.clientsLock.Lock()
+	sockets := make([]*Socket, 0, len(srv.Clients))
 	for _, socket := range srv.Clients {
+		sockets = append(sockets, socket)
+	}
+	srv.clientsLock.Unlock()
+	for _, socket := range sockets {
 		socket.Close()
 	}
+	if srv.unwatchSessions != nil {
+		srv.unwatchSessions()
+	}
+	srv.adapter.Close()
+}
+
+func (srv *Server) getClient(sid string) *Socket {
+	srv.clientsLock.Lock()
+	defer srv.clientsLock.Unlock()
+	return srv.Clients[sid]
+}
+
+// ClientsCount returns the number of connected clients.
+func (srv *Server) ClientsCount() int {
+	srv.clientsLock.Lock()
+	defer srv.clientsLock.Unlock()
+	return srv.clientsCount
 }
 
 func (srv *Server) handshake(transportName string, req *Request) {
@@ -265,9 +419,9 @@ func (srv *Server) handshake(transportName string, req *Request) {
 		*/
 	}()
 
-	id := generateId()
-
-	debug(fmt.Sprintf("handshaking client \"%s\"", id))
+	if !srv.limitHandshake(req) {
+		return
+	}
 
 	transport := srv.getTransport(transportName, req)
 
@@ -276,24 +430,79 @@ func (srv *Server) handshake(transportName string, req *Request) {
 		return
 	}
 
-	socket := newSocket(id, srv, transport, req)
+	if srv.recover(transport, req) != nil {
+		return
+	}
 
+	id := srv.newId()
+
+	debug(fmt.Sprintf("handshaking client \"%s\"", id))
+
+	srv.openSocket(id, transport, req)
+}
+
+// Handshake opens a new socket over transport, for transports that don't
+// come in through ServeHTTP, like a Pipe. req may be nil. If its query asks
+// for recovery and it succeeds, the recovered socket is returned instead.
+func (srv *Server) Handshake(transport Transport, req *Request) *Socket {
+	if req == nil {
+		req = &Request{Query: url.Values{}}
+	}
+	if srv.wrapTransport != nil {
+		transport = srv.wrapTransport(transport)
+		transport.setClock(srv.clock)
+	}
+	if socket := srv.recover(transport, req); socket != nil {
+		return socket
+	}
+	return srv.openSocket(srv.newId(), transport, req)
+}
+
+func (srv *Server) setCookie(transport Transport, id string) {
 	if len(srv.cookie) > 0 {
 		transport.On("headers", func(header http.Header) {
 			header.Set("Set-Cookie", srv.cookie+"="+id)
 		})
 	}
+}
 
-	transport.onRequest(req)
+func (srv *Server) openSocket(id string, transport Transport, req *Request) *Socket {
+	socket := newSocket(id, srv, transport, req)
 
+	srv.setCookie(transport, id)
+
+	srv.clientsLock.Lock()
 	srv.Clients[id] = socket
 	srv.clientsCount++
+	srv.clientsLock.Unlock()
+	srv.adapter.Add(socket)
+	if err := srv.sessions.Add(id, srv.node); err != nil {
+		debug("session store:", err)
+	}
 
 	socket.Once("close", func() {
+		srv.clientsLock.Lock()
 		delete(srv.Clients, id)
 		srv.clientsCount--
+		srv.clientsLock.Unlock()
+		srv.adapter.Remove(socket)
+		if err := srv.sessions.Remove(id); err != nil {
+			debug("session store:", err)
+		}
+	})
+
+	// "connection" is emitted on the socket's loop along with the open
+	// packet, so that its listeners are in place before any packet from the
+	// client is handled.
+	opened := make(chan bool)
+	socket.post(func() {
+		socket.onOpen()
+		debug("emitting 'connection'")
+		srv.Emit("connection", socket)
+		close(opened)
 	})
+	<-opened
 
-	debug("emitting 'connection'")
-	srv.Emit("connection", socket)
+	transport.onRequest(req)
+	return socket
 }
@@ -2,28 +2,166 @@ package engineio
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"net"
 	"net/http"
-	"runtime/debug"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kaicheng/engineio/client"
+	"github.com/kaicheng/engineio/parser"
 )
 
 func expect(t *testing.T, res bool, msgs ...interface{}) {
+	t.Helper()
 	if !res {
-		debug.PrintStack()
 		t.Error(msgs...)
 	}
 }
 
+// timeout bounds every wait in this file; nothing should take this long.
+const timeout = 5 * time.Second
+
+func listen(t *testing.T, opts Options) (*Server, string) {
+	srv := NewServer(opts)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(501)
+		res.Write([]byte("Not Implemented."))
+	})
+	mux.Handle(getPath(opts), srv)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		ts.CloseClientConnections()
+		ts.Close()
+	})
+	return srv, ts.URL
+}
+
+func dial(t *testing.T, addr string, opts *client.Options) *client.Client {
+	c := newClient(t, addr, opts)
+	if err := c.Open(); err != nil {
+		t.Fatal("open failed:", err)
+	}
+	return c
+}
+
+func newClient(t *testing.T, addr string, opts *client.Options) *client.Client {
+	c, err := client.New(addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func pollingOnly() *client.Options {
+	return &client.Options{Transports: []string{"polling"}}
+}
+
+func websocketOnly() *client.Options {
+	return &client.Options{Transports: []string{"websocket"}}
+}
+
+// onConnection returns a channel receiving every socket the server accepts.
+func onConnection(srv *Server) chan *Socket {
+	ch := make(chan *Socket, 16)
+	srv.On("connection", func(socket *Socket) {
+		ch <- socket
+	})
+	return ch
+}
+
+func onMessage(c *client.Client) chan string {
+	ch := make(chan string, 64)
+	c.On("message", func(data []byte) {
+		ch <- string(data)
+	})
+	return ch
+}
+
+func onClose(emitter interface {
+	On(string, interface{})
+}) chan string {
+	ch := make(chan string, 1)
+	emitter.On("close", func(reason string) {
+		ch <- reason
+	})
+	return ch
+}
+
+func wait(t *testing.T, ch interface{}) interface{} {
+	t.Helper()
+	switch c := ch.(type) {
+	case chan *Socket:
+		select {
+		case v := <-c:
+			return v
+		case <-time.After(timeout):
+		}
+	case chan string:
+		select {
+		case v := <-c:
+			return v
+		case <-time.After(timeout):
+		}
+	case chan bool:
+		select {
+		case v := <-c:
+			return v
+		case <-time.After(timeout):
+		}
+	case <-chan bool:
+		select {
+		case v := <-c:
+			return v
+		case <-time.After(timeout):
+		}
+	default:
+		t.Fatalf("unexpected channel type %T", ch)
+	}
+	t.Fatal("timed out")
+	return nil
+}
+
+func waitSocket(t *testing.T, ch chan *Socket) *Socket {
+	t.Helper()
+	return wait(t, ch).(*Socket)
+}
+
+func waitString(t *testing.T, ch chan string) string {
+	t.Helper()
+	return wait(t, ch).(string)
+}
+
 type simpleResponse struct {
 	code   int
 	header http.Header
 	body   string
 }
 
-func getResponse(res *http.Response) *simpleResponse {
+func get(t *testing.T, rawurl string, query url.Values, header http.Header) *simpleResponse {
+	req, err := http.NewRequest("GET", rawurl+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
 	sRes := new(simpleResponse)
 	sRes.code = res.StatusCode
 	sRes.header = res.Header
@@ -33,115 +171,1091 @@ func getResponse(res *http.Response) *simpleResponse {
 	return sRes
 }
 
-var base int32 = 1000
-var maxPort int32 = 65535
+func expectError(t *testing.T, res *simpleResponse, code int, message string) {
+	t.Helper()
+	var body struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal([]byte(res.body), &body)
+	expect(t, res.code == 400, "status should be 400:", res.code)
+	expect(t, body.Code == code, "code should be", code, "got", body.Code)
+	expect(t, body.Message == message, "message should be", message, "got", body.Message)
+}
+
+func TestAttachPreservesHandler(t *testing.T) {
+	var listeners int
+	srvMux := http.NewServeMux()
+	srvMux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		listeners++
+		res.WriteHeader(200)
+	})
+	server := &http.Server{Handler: srvMux}
+	srv := Attach(server, nil)
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	defer srv.Close()
+
+	res := get(t, ts.URL+"/engine.io/default/", nil, nil)
+	expect(t, res.code == 400, "engine.io path should be intercepted:", res.code)
+	expect(t, listeners == 0, "listeners should not be called")
+	res = get(t, ts.URL+"/test", nil, nil)
+	expect(t, res.code == 200 && listeners == 1, "other paths should reach the original handler")
+}
+
+func TestVerifyUnknownTransport(t *testing.T) {
+	_, addr := listen(t, nil)
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"tobi"}}, nil)
+	expectError(t, res, UNKNOWN_TRANSPORT, "Transport unknown")
+	res = get(t, addr+"/engine.io/default/", url.Values{"transport": {"constructor"}}, nil)
+	expectError(t, res, UNKNOWN_TRANSPORT, "Transport unknown")
+}
 
-func getPort() int {
-	return int(rand.Int31n(maxPort-base) + base)
+func TestVerifyUnknownSid(t *testing.T) {
+	_, addr := listen(t, nil)
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}, "sid": {"test"}}, nil)
+	expectError(t, res, UNKNOWN_SID, "Session ID unknown")
 }
 
-func sleep(sec float32) {
-	time.Sleep(time.Duration(sec * float32(time.Second)))
+func TestVerifyBadRequest(t *testing.T) {
+	_, addr := listen(t, nil)
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"websocket"}}, nil)
+	expectError(t, res, BAD_REQUEST, "Bad request")
+}
+
+func handshakeSid(t *testing.T, res *simpleResponse) string {
+	var sid string
+	parser.DecodePayload([]byte(res.body), func(pkt parser.Packet, index, total int) {
+		var hs client.Handshake
+		json.Unmarshal(pkt.Data, &hs)
+		sid = hs.Sid
+	})
+	return sid
 }
 
-func TestListen(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/", port))
-	sres := getResponse(res)
-	t.Log(sres.code, sres.body)
+func TestHandshakeCookie(t *testing.T) {
+	_, addr := listen(t, nil)
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}, "b64": {"1"}}, nil)
+	expect(t, res.header.Get("Set-Cookie") == "io="+handshakeSid(t, res), "should send the io cookie:", res.header)
 }
 
-func TestTransportUnknown(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/", port))
-	sres := getResponse(res)
-	t.Log(sres.code, sres.body)
+func TestHandshakeCustomCookie(t *testing.T) {
+	_, addr := listen(t, Options{"cookie": "woot"})
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}, "b64": {"1"}}, nil)
+	expect(t, res.header.Get("Set-Cookie") == "woot="+handshakeSid(t, res), "should send the custom cookie:", res.header)
 }
 
-// TODO: flash policy file tests.
+func TestHandshakeNoCookie(t *testing.T) {
+	_, addr := listen(t, Options{"cookie": ""})
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}, "b64": {"1"}}, nil)
+	expect(t, len(res.header.Get("Set-Cookie")) == 0, "should not send a cookie:", res.header)
+}
 
-// TODO: upgrades tests.
+func TestHandshakeData(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingTimeout": 123})
+	conns := onConnection(srv)
+	c := dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+	expect(t, len(c.Handshake.Sid) > 0 && c.Handshake.Sid == socket.id, "sid should match:", c.Handshake.Sid)
+	expect(t, c.Handshake.PingTimeout == 123, "pingTimeout should be 123:", c.Handshake.PingTimeout)
+	expect(t, c.Handshake.Upgrades != nil && len(c.Handshake.Upgrades) == 0, "upgrades should be empty")
+}
 
-func TestPreserveListeners(t *testing.T) {
-	var listeners int = 0
-	port := getPort()
-	srvMux := http.NewServeMux()
-	srvMux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		listeners++
-		res.WriteHeader(200)
-		res.Write(nil)
-		listeners++
+func TestHandshakeDefaultPolling(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+	expect(t, socket.TransportName() == "polling", "should open with polling by default")
+}
+
+func TestHandshakeWebSocket(t *testing.T) {
+	srv, addr := listen(t, Options{"transports": []interface{}{"websocket"}})
+	conns := onConnection(srv)
+	c := dial(t, addr, websocketOnly())
+	socket := waitSocket(t, conns)
+	expect(t, socket.TransportName() == "websocket", "should open with websocket directly")
+	expect(t, len(c.Handshake.Upgrades) == 0, "should not suggest upgrades for websocket")
+}
+
+func TestHandshakeUpgrades(t *testing.T) {
+	_, addr := listen(t, Options{"transports": []interface{}{"polling"}})
+	c := dial(t, addr, nil)
+	expect(t, len(c.Handshake.Upgrades) == 0, "should not suggest unavailable upgrades")
+
+	_, addr = listen(t, nil)
+	c = dial(t, addr, &client.Options{NoUpgrade: true})
+	expect(t, len(c.Handshake.Upgrades) == 1 && c.Handshake.Upgrades[0] == "websocket",
+		"should suggest all upgrades:", c.Handshake.Upgrades)
+}
+
+func TestHandshakeNoWebSocketProxy(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	c := dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+	socket.On("message", func(msg []byte) {
+		socket.Send(msg)
+	})
+
+	res := get(t, addr+"/engine.io/", url.Values{"transport": {"websocket"}, "sid": {c.Handshake.Sid}},
+		http.Header{"Connection": {"close"}})
+	expectError(t, res, BAD_REQUEST, "Bad request")
+
+	msgs := onMessage(c)
+	c.Send([]byte("echo"))
+	expect(t, waitString(t, msgs) == "echo", "should still echo over polling")
+}
+
+func TestHandshakeQuery(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	dial(t, addr, &client.Options{Query: url.Values{"a": {"b"}}})
+	query := waitSocket(t, conns).Request.Query
+	expect(t, query.Get("transport") == "polling", "query should have transport")
+	expect(t, query.Get("a") == "b", "query should have a=b")
+
+	dial(t, addr+"/engine.io/?c=d&e=f", nil)
+	query = waitSocket(t, conns).Request.Query
+	expect(t, len(query.Get("EIO")) > 0, "query should have EIO")
+	expect(t, query.Get("c") == "d" && query.Get("e") == "f", "query should keep the uri's values")
+}
+
+func TestHandshakeMetadata(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	dial(t, addr, &client.Options{Query: url.Values{"token": {"x"}}})
+	socket := waitSocket(t, conns)
+	hs := socket.Handshake()
+	expect(t, socket.ID() == hs.ID && len(hs.ID) > 0, "handshake should carry the id")
+	expect(t, socket.TransportName() == "polling" && hs.Transport == "polling", "should open with polling")
+	expect(t, strings.HasPrefix(socket.RemoteAddr(), "127.0.0.1:"), "remote address should be set, got", socket.RemoteAddr())
+	expect(t, socket.Query().Get("token") == "x", "query should have the token")
+	expect(t, len(socket.Header().Get("User-Agent")) > 0, "headers should be kept")
+	expect(t, !socket.ConnectedAt().IsZero() && !socket.Upgraded(), "should be connected and not upgraded")
+	_, err := json.Marshal(hs)
+	expect(t, err == nil, "handshake should marshal:", err)
+}
+
+func TestCloseWriteBuffer(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+
+	lens := make(chan int, 1)
+	socket.On("close", func(reason, desc string) {
+		lens <- len(socket.WriteBuffer())
+	})
+	socket.SetWriteBuffer(append(socket.WriteBuffer(), &parser.Packet{Type: "message", Data: []byte("foo")}))
+	socket.OnError("")
+	select {
+	case n := <-lens:
+		expect(t, n == 1, "writeBuffer should be accessible in close:", n)
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	<-socket.done
+	expect(t, len(socket.WriteBuffer()) == 0, "writeBuffer should be cleared after close")
+}
+
+func TestSocketValues(t *testing.T) {
+	pipe := NewPipe()
+	socket := NewServer(nil).Handshake(pipe, nil)
+	socket.Set("user", "alice")
+	socket.Set("gone", 1)
+	socket.Delete("gone")
+	val, ok := socket.Get("user")
+	expect(t, ok && val == "alice", "should get the value set:", val)
+	_, ok = socket.Get("gone")
+	expect(t, !ok, "deleted values should be gone")
+
+	inClose := make(chan string, 1)
+	socket.On("close", func(reason, desc string) {
+		val, _ := socket.Get("user")
+		user, _ := val.(string)
+		inClose <- user
+	})
+	socket.Close()
+	expect(t, waitString(t, inClose) == "alice", "values should be kept through close")
+	<-socket.done
+	_, ok = socket.Get("user")
+	expect(t, !ok, "values should be cleared after close")
+	socket.Set("late", true)
+	_, ok = socket.Get("late")
+	expect(t, !ok, "values should not be kept after close")
+}
+
+func TestClosePingTimeout(t *testing.T) {
+	// The client runs on the wall clock and times out on its own; the
+	// server only does once its clock is moved past the deadline.
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 5, "pingTimeout": 5, "clock": clock})
+	conns := onConnection(srv)
+	c := newClient(t, addr, &client.Options{NoHeartbeat: true})
+	clientClose := onClose(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	expect(t, waitString(t, clientClose) == "ping timeout", "client should close on ping timeout")
+	clock.Advance(10 * time.Millisecond)
+	expect(t, waitString(t, serverClose) == "ping timeout", "server should close on ping timeout")
+}
+
+func TestCloseByServer(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		conns := onConnection(srv)
+		c := dial(t, addr, opts)
+		clientClose := onClose(c)
+		socket := waitSocket(t, conns)
+		serverClose := onClose(socket)
+		socket.Close()
+		expect(t, waitString(t, serverClose) == "forced close", "server reason should be forced close")
+		expect(t, waitString(t, clientClose) == "transport close", "client reason should be transport close")
+	}
+}
+
+func TestCloseByClient(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		conns := onConnection(srv)
+		c := dial(t, addr, opts)
+		socket := waitSocket(t, conns)
+		serverClose := onClose(socket)
+		c.Close()
+		expect(t, c.CloseReason() == "forced close", "client reason should be forced close")
+		expect(t, waitString(t, serverClose) == "transport close", "server reason should be transport close")
+	}
+}
+
+func TestCloseBeforeOpenTransportError(t *testing.T) {
+	// Nothing listens on the address of a closed server.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		c := newClient(t, ts.URL, opts)
+		opened := make(chan bool, 1)
+		c.On("open", func() {
+			opened <- true
+		})
+		clientClose := onClose(c)
+		expect(t, c.Open() != nil, opts.Transports, "open should fail")
+		expect(t, waitString(t, clientClose) == "transport error", opts.Transports, "client reason should be transport error")
+		expect(t, len(opened) == 0, opts.Transports, "client should not open")
+	}
+}
+
+func TestCloseBeforeOpenForced(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		// The handshake hangs until the client gives up on it.
+		started := make(chan bool, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			started <- true
+			<-req.Context().Done()
+		}))
+		c := newClient(t, ts.URL, opts)
+		opened := make(chan bool, 1)
+		c.On("open", func() {
+			opened <- true
+		})
+		clientClose := onClose(c)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- c.Open()
+		}()
+		<-started
+		c.Close()
+		expect(t, waitString(t, clientClose) == "forced close", opts.Transports, "client reason should be forced close")
+		select {
+		case err := <-errs:
+			expect(t, err == client.ErrClosed, opts.Transports, "open should give up:", err)
+		case <-time.After(timeout):
+			t.Fatal(opts.Transports, "open should return once closed")
+		}
+		expect(t, len(opened) == 0, opts.Transports, "client should not open")
+		ts.Close()
+	}
+}
+
+func TestCloseDuringUpgrade(t *testing.T) {
+	// GH-35: closing right after open must not break the pending upgrade.
+	srv, addr := listen(t, Options{"allowUpgrades": true})
+	conns := onConnection(srv)
+	c := dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	c.Close()
+	expect(t, waitString(t, serverClose) == "transport close", "server should see the close")
+}
+
+func TestCloseConnectionHeader(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	conns := onConnection(srv)
+	c := newClient(t, addr, &client.Options{Header: http.Header{"Connection": {"close"}}})
+	msgs := onMessage(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	socket := waitSocket(t, conns)
+	socket.On("message", func(data []byte) {
+		if string(data) == "test" {
+			socket.Send([]byte("woot"))
+		}
+	})
+	c.Send([]byte("test"))
+	expect(t, waitString(t, msgs) == "woot", "should get a reply with connection: close")
+}
+
+func TestCloseNotEarlyAfterHandshake(t *testing.T) {
+	// The first timeout is pingInterval + pingTimeout, not just pingTimeout.
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 300, "pingTimeout": 100, "clock": clock})
+	conns := onConnection(srv)
+	c := dial(t, addr, &client.Options{NoHeartbeat: true})
+	clientClose := onClose(c)
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	clock.Advance(399 * time.Millisecond)
+	barrier(t, socket)
+	expect(t, socket.ReadyState() == StateOpen, "closed early")
+	clock.Advance(time.Millisecond)
+	expect(t, waitString(t, serverClose) == "ping timeout", "server should close on ping timeout")
+	// Depending on whether a poll was pending, the client sees either the
+	// close packet or an unknown sid.
+	reason := waitString(t, clientClose)
+	expect(t, reason == "transport close" || reason == "transport error", "client should close, got", reason)
+}
+
+func TestCloseHeartbeatResetsTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 50, "pingTimeout": 50, "clock": clock})
+	conns := onConnection(srv)
+	c := dial(t, addr, &client.Options{NoHeartbeat: true})
+	socket := waitSocket(t, conns)
+	heartbeats := make(chan bool, 1)
+	socket.On("heartbeat", func() {
+		heartbeats <- true
+	})
+	serverClose := onClose(socket)
+	clock.Advance(80 * time.Millisecond)
+	c.SendPacket(&parser.Packet{Type: "ping"})
+	wait(t, heartbeats)
+	clock.Advance(80 * time.Millisecond)
+	barrier(t, socket)
+	expect(t, socket.ReadyState() == StateOpen, "heartbeat should reset the ping timeout")
+	clock.Advance(20 * time.Millisecond)
+	expect(t, waitString(t, serverClose) == "ping timeout", "server should close on ping timeout")
+}
+
+func TestCloseAfterHeartbeat(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 80, "pingTimeout": 50})
+	conns := onConnection(srv)
+	c := dial(t, addr, nil)
+	clientClose := onClose(c)
+	socket := waitSocket(t, conns)
+	socket.On("heartbeat", func() {
+		time.AfterFunc(20*time.Millisecond, socket.Close)
+	})
+	expect(t, waitString(t, clientClose) == "transport close", "client should see transport close")
+}
+
+func TestStateChange(t *testing.T) {
+	pipe := NewPipe()
+	socket := NewServer(nil).Handshake(pipe, nil)
+	expect(t, socket.ReadyState() == StateOpen, "socket should be open, got", socket.ReadyState())
+	expect(t, pipe.readyState() == StateOpen, "transport should open with the socket, got", pipe.readyState())
+	changes := make(chan string, 4)
+	socket.On("stateChange", func(old, state ReadyState) {
+		changes <- old.String() + ">" + state.String()
+	})
+	socket.Close()
+	expect(t, waitString(t, changes) == "open>closing", "socket should be closing first")
+	expect(t, waitString(t, changes) == "closing>closed", "socket should then be closed")
+	expect(t, !canTransition(StateClosed, StateOpen), "closed should not go back to open")
+	expect(t, canTransition(StateOpening, StateClosing), "an opening transport should be able to close")
+	expect(t, !canTransition(StateClosed, StateClosing), "closed should not go back to closing")
+	expect(t, !pipe.setReadyState(StateOpen), "transport should reject closed to open")
+	expect(t, pipe.readyState() == StateClosed, "transport should stay closed")
+}
+
+func TestMessageToClient(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		srv.On("connection", func(socket *Socket) {
+			socket.Send([]byte("a"))
+			time.AfterFunc(50*time.Millisecond, func() {
+				socket.Send([]byte("b"))
+				time.AfterFunc(50*time.Millisecond, func() {
+					socket.Send([]byte("c"))
+				})
+			})
+		})
+		c := newClient(t, addr, opts)
+		msgs := onMessage(c)
+		if err := c.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"a", "b", "c"} {
+			got := waitString(t, msgs)
+			expect(t, got == want, opts.Transports, "want", want, "got", got)
+		}
+	}
+}
+
+func TestMessageInterleaveWithPongs(t *testing.T) {
+	// Many large messages buffered at open must not hold up the heartbeat.
+	// Pongs go out ahead of them, but still wait for the frames already in
+	// the connection's buffers, which take a while to read under the race
+	// detector; pingTimeout leaves room for that.
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 200, "pingTimeout": 400})
+	const count = 100
+	payload := bytes.Repeat([]byte("a"), 1024*1024)
+	srv.On("connection", func(socket *Socket) {
+		for i := 0; i < count; i++ {
+			socket.Send(payload)
+		}
+	})
+	c := newClient(t, addr, websocketOnly())
+	received := make(chan bool, count)
+	c.On("message", func(data []byte) {
+		received <- true
+	})
+	clientClose := onClose(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-received:
+		case reason := <-clientClose:
+			t.Fatal("client closed after", i, "messages:", reason)
+		case <-time.After(timeout):
+			t.Fatal("got only", i, "messages")
+		}
+	}
+}
+
+func TestMessageMaxHttpBufferSize(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false, "maxHttpBufferSize": 5})
+	conns := onConnection(srv)
+	c := dial(t, addr, pollingOnly())
+	socket := waitSocket(t, conns)
+	msgs := make(chan string, 2)
+	socket.On("message", func(data []byte) {
+		msgs <- string(data)
+	})
+	serverClose := onClose(socket)
+
+	c.Send([]byte("a"))
+	expect(t, waitString(t, msgs) == "a", "should receive a message shorter than maxHttpBufferSize")
+	c.Send([]byte("aasdasdakjhasdkjhasdkjhasdkjhasdkjhasdkjhasdkjha"))
+	expect(t, waitString(t, serverClose) == "parse error", "should drop a message longer than maxHttpBufferSize")
+	expect(t, len(msgs) == 0, "should not receive the long message")
+}
+
+func TestMessageMaxHttpBufferSizePayload(t *testing.T) {
+	for _, c := range []struct {
+		payload string
+		why     string
+	}{
+		{"4:4abc4:4def4:4ghi", "a payload longer than maxHttpBufferSize"},
+		{"2:4a99:4bcd", "a packet longer than maxHttpBufferSize"},
+	} {
+		srv, addr := listen(t, Options{"allowUpgrades": false, "maxHttpBufferSize": 10})
+		sockets := onConnection(srv)
+		sid := handshakeSid(t, get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}}, nil))
+		socket := waitSocket(t, sockets)
+		msgs := make(chan string, 4)
+		socket.On("message", func(data []byte) {
+			msgs <- string(data)
+		})
+		closed := onClose(socket)
+
+		rawurl := addr + "/engine.io/default/?" + url.Values{"transport": {"polling"}, "sid": {sid}}.Encode()
+		res, err := http.Post(rawurl, "text/plain;charset=UTF-8", strings.NewReader(c.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		expect(t, res.StatusCode == 413, c.why, "should be rejected, got", res.StatusCode)
+		expect(t, waitString(t, closed) == "parse error", c.why, "should close the socket")
+		expect(t, len(msgs) == 0, c.why, "should not deliver any of its packets")
+	}
+}
+
+func TestMessageBinary(t *testing.T) {
+	binaryData := []byte{0, 1, 2, 3, 4}
+	for _, opts := range []*client.Options{
+		pollingOnly(),
+		websocketOnly(),
+		&client.Options{Transports: []string{"polling"}, B64: true},
+		&client.Options{Transports: []string{"websocket"}, B64: true},
+	} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		srv.On("connection", func(socket *Socket) {
+			socket.Send([]byte("text"))
+			socket.SendBin(binaryData)
+		})
+		c := newClient(t, addr, opts)
+		type message struct {
+			data  []byte
+			isBin bool
+		}
+		msgs := make(chan message, 2)
+		c.On("message", func(data []byte, isBin bool) {
+			msgs <- message{data, isBin}
+		})
+		if err := c.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []message{{[]byte("text"), false}, {binaryData, true}} {
+			select {
+			case msg := <-msgs:
+				expect(t, bytes.Equal(msg.data, want.data) && msg.isBin == want.isBin,
+					opts.Transports, opts.B64, "want", want, "got", msg)
+			case <-time.After(timeout):
+				t.Fatal("timed out")
+			}
+		}
+	}
+}
+
+func TestMessageFromClientBinary(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		conns := onConnection(srv)
+		c := dial(t, addr, opts)
+		socket := waitSocket(t, conns)
+		msgs := make(chan bool, 2)
+		socket.On("message", func(data []byte, isBin bool) {
+			msgs <- isBin && bytes.Equal(data, []byte{1, 2, 3})
+		})
+		c.SendBin([]byte{1, 2, 3})
+		expect(t, wait(t, msgs).(bool), opts.Transports, "should receive binary data as binary")
+	}
+}
+
+func TestMessageFlushDrain(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false})
+	events := make(chan string, 4)
+	srv.On("connection", func(socket *Socket) {
+		srv.On("flush", func(buf []*parser.Packet) {
+			events <- "server flush"
+		})
+		socket.On("flush", func(buf []*parser.Packet) {
+			events <- "flush"
+		})
+		srv.On("drain", func(s *Socket) {
+			if s == socket && len(socket.WriteBuffer()) == 0 {
+				events <- "server drain"
+			}
+		})
+		socket.On("drain", func() {
+			if len(socket.WriteBuffer()) == 0 {
+				events <- "drain"
+			}
+		})
+		socket.Send([]byte("aaaa"))
+	})
+	dial(t, addr, nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[waitString(t, events)] = true
+	}
+	expect(t, len(seen) == 4, "should emit flush and drain on socket and server:", seen)
+}
+
+func TestMessageFlushKeep(t *testing.T) {
+	srv := NewServer(nil)
+	sockets, pipes := roomPipes(t, srv, 1)
+	flushed := make(chan []*parser.Packet, 2)
+	sockets[0].On("flush", func(buf []*parser.Packet) {
+		flushed <- buf
 	})
-	server := &http.Server{
-		Addr:           fmt.Sprintf(":%d", port),
-		Handler:        srvMux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-	Attach(server, nil)
-	go server.ListenAndServe()
-	sleep(1)
-	var res *http.Response
-	var sres *simpleResponse
-	res, _ = http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/", port))
-	sres = getResponse(res)
-	t.Log(sres.code, sres.body)
-	t.Log(listeners)
-	sleep(1)
-	res, _ = http.Get(fmt.Sprintf("http://localhost:%d/test", port))
-	sres = getResponse(res)
-	t.Log(sres.code, sres.body)
-	t.Log(listeners)
-}
-
-func TestTransportNonexistent(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/?transport=tobi", port))
-	sres := getResponse(res)
-	t.Log(sres.code, sres.body)
-}
-
-func TestTransportConstructior(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/?transport=constructor", port))
-	sres := getResponse(res)
-	t.Log(sres.code, sres.body)
-}
-
-func TestNonexistingSid(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/?transport=polling&sid=test", port))
-	sres := getResponse(res)
-	t.Log(sres.code, sres.body)
-}
-
-func TestHandshake(t *testing.T) {
-	port := getPort()
-	Listen(port, nil)
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/?transport=polling&b64=1", port))
-	sres := getResponse(res)
-	t.Log(sres.code, res.Header, sres.body)
-}
-
-func TestCustonCookie(t *testing.T) {
-	port := getPort()
-	Listen(port, Options{"cookie": "woot"})
-	sleep(1)
-	res, _ := http.Get(fmt.Sprintf("http://localhost:%d/engine.io/default/?transport=polling", port))
-	sres := getResponse(res)
-	t.Log(sres.code, res.Header, sres.body)
-}
-
-// FIXME: should not send the io cookie
+	sockets[0].Send([]byte("a"))
+	nextPacket(t, pipes[0])
+	sockets[0].Send([]byte("b"))
+	nextPacket(t, pipes[0])
+	first, second := <-flushed, <-flushed
+	expect(t, len(first) == 1 && first[0] != nil && string(first[0].Data) == "a",
+		"flush listeners should be able to keep the buffer")
+	expect(t, len(second) == 1 && second[0] != nil && string(second[0].Data) == "b", "each flush should get its own buffer")
+}
+
+func TestMessageFlushReuse(t *testing.T) {
+	// Without "flush" listeners, the two write buffers take turns.
+	srv := NewServer(nil)
+	sockets, pipes := roomPipes(t, srv, 1)
+	arrays := make([]**parser.Packet, 0, 3)
+	for _, data := range []string{"a", "b", "c"} {
+		sockets[0].Send([]byte(data))
+		nextPacket(t, pipes[0])
+		barrier(t, sockets[0])
+		buf := sockets[0].WriteBuffer()
+		arrays = append(arrays, &buf[:1][0])
+	}
+	expect(t, arrays[0] != arrays[1] && arrays[0] == arrays[2], "flushes should reuse the write buffers")
+}
+
+func TestSendInOrder(t *testing.T) {
+	for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+		srv, addr := listen(t, Options{"allowUpgrades": false})
+		srv.On("connection", func(socket *Socket) {
+			socket.On("message", func(msg []byte) {
+				socket.Send(msg)
+			})
+		})
+		c := newClient(t, addr, opts)
+		msgs := onMessage(c)
+		if err := c.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			c.Send([]byte(fmt.Sprint(i)))
+			got := waitString(t, msgs)
+			expect(t, got == fmt.Sprint(i), opts.Transports, "want", i, "got", got)
+		}
+		// Several packets in one payload keep their order too.
+		c.SendPacket(&parser.Packet{Type: "message", Data: []byte("3")},
+			&parser.Packet{Type: "message", Data: []byte("4")})
+		expect(t, waitString(t, msgs) == "3" && waitString(t, msgs) == "4", opts.Transports, "payload out of order")
+	}
+}
+
+func TestSendOnce(t *testing.T) {
+	srv, addr := listen(t, nil)
+	srv.On("connection", func(socket *Socket) {
+		socket.Send([]byte("a"))
+		socket.Send([]byte("b"))
+		socket.Send([]byte("c"))
+	})
+	c := newClient(t, addr, nil)
+	msgs := onMessage(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	count := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		count[waitString(t, msgs)]++
+	}
+	expect(t, count["a"] == 1 && count["b"] == 1 && count["c"] == 1, "each message should arrive once:", count)
+	select {
+	case msg := <-msgs:
+		t.Error("unexpected message", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPacketEvent(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 4})
+	conns := onConnection(srv)
+	c := dial(t, addr, nil)
+	socket := waitSocket(t, conns)
+	types := make(chan string, 16)
+	socket.On("packet", func(pkt *parser.Packet) {
+		types <- pkt.Type + ":" + string(pkt.Data)
+	})
+	c.Send([]byte("a"))
+	seen := make(map[string]bool)
+	for !seen["message:a"] || !seen["ping:"] {
+		seen[waitString(t, types)] = true
+	}
+}
+
+func TestPacketCreateEvent(t *testing.T) {
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pingInterval": 4})
+	types := make(chan string, 16)
+	srv.On("connection", func(socket *Socket) {
+		socket.On("packetCreate", func(pkt *parser.Packet) {
+			types <- pkt.Type + ":" + string(pkt.Data)
+		})
+		socket.Send([]byte("a"))
+	})
+	dial(t, addr, nil)
+	seen := make(map[string]bool)
+	for !seen["message:a"] || !seen["pong:"] {
+		seen[waitString(t, types)] = true
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	srv, addr := listen(t, nil)
+	conns := onConnection(srv)
+	c := newClient(t, addr, &client.Options{NoUpgrade: true})
+	msgs := onMessage(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	socket := waitSocket(t, conns)
+	expect(t, socket.Request.Query.Get("transport") == "polling", "should open with polling")
+
+	var lock sync.Mutex
+	received := make([]string, 0)
+	socket.On("message", func(msg []byte) {
+		lock.Lock()
+		received = append(received, string(msg))
+		lock.Unlock()
+	})
+	upgraded := make(chan bool, 1)
+	socket.On("upgrade", func(transport Transport) {
+		upgraded <- transport.Name() == "websocket" && transport.readyState() == StateOpen
+	})
+	serverClose := onClose(socket)
+
+	// Both ends keep sending while the upgrade happens.
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 50; i++ {
+			socket.Send([]byte(fmt.Sprint(i)))
+			c.Send([]byte(fmt.Sprint(i)))
+			if i == 10 {
+				go func() {
+					expect(t, c.Upgrade() == nil, "client upgrade failed")
+				}()
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		close(done)
+	}()
+
+	expect(t, wait(t, upgraded).(bool), "should upgrade to an open websocket")
+	<-done
+	for i := 1; i <= 50; i++ {
+		got := waitString(t, msgs)
+		expect(t, got == fmt.Sprint(i), "client want", i, "got", got)
+	}
+	c.Close()
+	expect(t, waitString(t, serverClose) == "transport close", "server should see transport close")
+	expect(t, socket.Upgraded() && socket.TransportName() == "websocket", "socket should be upgraded")
+	lock.Lock()
+	defer lock.Unlock()
+	expect(t, len(received) == 50, "server should get every message:", len(received))
+	for i, msg := range received {
+		expect(t, msg == fmt.Sprint(i+1), "server want", i+1, "got", msg)
+	}
+}
+
+func TestUpgradeEcho(t *testing.T) {
+	// The client answers from its message listener while the poll loop is
+	// being paused for the upgrade.
+	srv, addr := listen(t, nil)
+	conns := onConnection(srv)
+	c := newClient(t, addr, &client.Options{NoUpgrade: true})
+	c.On("message", func(data []byte) {
+		c.Send(data)
+	})
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	socket := waitSocket(t, conns)
+	echoes := make(chan string, 50)
+	socket.On("message", func(data []byte) {
+		echoes <- string(data)
+	})
+
+	upgraded := make(chan error, 1)
+	for i := 0; i < 50; i++ {
+		socket.Send([]byte(fmt.Sprint(i)))
+		if i == 10 {
+			go func() {
+				upgraded <- c.Upgrade()
+			}()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-upgraded:
+		expect(t, err == nil, "upgrade failed:", err)
+	case <-time.After(timeout):
+		t.Fatal("upgrade did not finish")
+	}
+	for i := 0; i < 50; i++ {
+		got := waitString(t, echoes)
+		expect(t, got == fmt.Sprint(i), "echo want", i, "got", got)
+	}
+}
+
+func TestUpgradeAutomatic(t *testing.T) {
+	srv, addr := listen(t, nil)
+	conns := onConnection(srv)
+	c := newClient(t, addr, nil)
+	upgraded := make(chan string, 1)
+	c.On("upgrade", func(transport string) {
+		upgraded <- transport
+	})
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	waitSocket(t, conns)
+	expect(t, waitString(t, upgraded) == "websocket", "client should upgrade on its own")
+	expect(t, !strings.Contains(c.TransportName(), "polling"), "client should leave polling")
+}
+
+// probe opens a websocket for sid and completes the probe ping/pong, leaving
+// the upgrade pending.
+func probe(t *testing.T, addr, sid string) *websocket.Conn {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(addr, "http") + "/engine.io/?EIO=3&transport=websocket&sid=" + sid
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("2probe")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, string(msg) == "3probe", "should get pong probe, got", string(msg))
+	return conn
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"upgradeTimeout": 1000, "clock": clock})
+	conns := onConnection(srv)
+	c := newClient(t, addr, &client.Options{NoUpgrade: true})
+	noops := make(chan bool, 16)
+	c.On("packet", func(pkt *parser.Packet) {
+		if pkt.Type == "noop" {
+			noops <- true
+		}
+	})
+	msgs := onMessage(c)
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	socket := waitSocket(t, conns)
+	conn := probe(t, addr, c.Handshake.Sid)
+
+	// The pending poll gets a noop every 100ms until the upgrade completes.
+	clock.Advance(100 * time.Millisecond)
+	wait(t, noops)
+
+	clock.Advance(900 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	ne, isNetErr := err.(net.Error)
+	expect(t, err != nil && !(isNetErr && ne.Timeout()), "websocket should be closed after upgradeTimeout:", err)
+
+	expect(t, socket.ReadyState() == StateOpen, "socket should stay open")
+	expect(t, !socket.Upgraded() && socket.TransportName() == "polling", "socket should stay on polling")
+	socket.Send([]byte("still here"))
+	expect(t, waitString(t, msgs) == "still here", "polling should keep working")
+}
+
+func TestUpgradeFailedHandshake(t *testing.T) {
+	srv, addr := listen(t, nil)
+	sockets := onConnection(srv)
+	sid := handshakeSid(t, get(t, addr+"/engine.io/default/", url.Values{"transport": {"polling"}}, nil))
+	socket := waitSocket(t, sockets)
+	closed := onClose(socket)
+
+	// Without the websocket handshake headers, the upgrade can't complete.
+	res := get(t, addr+"/engine.io/default/", url.Values{"transport": {"websocket"}, "sid": {sid}},
+		http.Header{"Upgrade": {"websocket"}})
+	expectError(t, res, BAD_REQUEST, "Bad request")
+	expect(t, socket.ReadyState() == StateOpen && !socket.Upgraded(), "the socket should stay open on polling")
+	expect(t, len(closed) == 0, "the socket should not close")
+}
+
+func TestUpgradeCloseStopsTimers(t *testing.T) {
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"clock": clock, "pollTimeout": 0})
+	conns := onConnection(srv)
+	c := dial(t, addr, &client.Options{NoUpgrade: true, NoHeartbeat: true})
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+	probe(t, addr, c.Handshake.Sid)
+	expect(t, clock.Pending() == 3, "ping timeout, upgrade timeout and noop ticker should be armed:", clock.Pending())
+	c.Close()
+	expect(t, waitString(t, serverClose) == "transport close", "server should see transport close")
+	expect(t, clock.Pending() == 0, "close should stop every timer:", clock.Pending())
+
+	// A late deadline must not fire on the closed socket.
+	clock.Advance(time.Hour)
+}
+
+// waitPending waits for n timers to be armed on clock, e.g. by a poll that
+// reached the server.
+func waitPending(t *testing.T, clock *FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for clock.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", n, "timers, have", clock.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// barrier waits until the loop of socket has run what was posted before, such
+// as the callbacks of timers fired by FakeClock.Advance.
+func barrier(t *testing.T, socket *Socket) {
+	t.Helper()
+	done := make(chan bool)
+	if !socket.post(func() { close(done) }) {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the socket loop")
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"allowUpgrades": false, "pollTimeout": 1000, "clock": clock})
+	conns := onConnection(srv)
+	query := url.Values{"transport": {"polling"}, "b64": {"1"}}
+	query.Set("sid", handshakeSid(t, get(t, addr+"/engine.io/", query, nil)))
+	socket := waitSocket(t, conns)
+
+	res := make(chan *simpleResponse, 1)
+	go func() {
+		r := new(simpleResponse)
+		if hr, err := http.Get(addr + "/engine.io/?" + query.Encode()); err == nil {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(hr.Body)
+			hr.Body.Close()
+			r.code, r.body = hr.StatusCode, buf.String()
+		}
+		res <- r
+	}()
+	// The ping timeout, and the poll's timeout once it is in.
+	waitPending(t, clock, 2)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case r := <-res:
+		t.Fatal("poll answered early:", r.body)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case r := <-res:
+		expect(t, r.code == 200 && r.body == "1:6", "should answer with a noop, got", r.code, r.body)
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	expect(t, socket.ReadyState() == StateOpen, "socket should stay open")
+}
+
+func TestPollClientDisconnect(t *testing.T) {
+	clock := NewFakeClock()
+	srv, addr := listen(t, Options{"allowUpgrades": false, "clock": clock})
+	conns := onConnection(srv)
+	query := url.Values{"transport": {"polling"}, "b64": {"1"}}
+	query.Set("sid", handshakeSid(t, get(t, addr+"/engine.io/", query, nil)))
+	socket := waitSocket(t, conns)
+	serverClose := onClose(socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", addr+"/engine.io/?"+query.Encode(), nil)
+	go http.DefaultClient.Do(req)
+	waitPending(t, clock, 2)
+	cancel()
+	expect(t, waitString(t, serverClose) == "transport error", "server should close on an aborted poll")
+	waitPending(t, clock, 0)
+}
+
+// checkLeaks fails t if goroutines started during the test are still running
+// once the test and its cleanups are done. Call it before anything that
+// registers a cleanup.
+func checkLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		http.DefaultClient.CloseIdleConnections()
+		deadline := time.Now().Add(timeout)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestLeakLifecycle(t *testing.T) {
+	lifecycles := map[string]func(t *testing.T, srv *Server, addr string){
+		"client close": func(t *testing.T, srv *Server, addr string) {
+			for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+				conns := onConnection(srv)
+				c := dial(t, addr, opts)
+				serverClose := onClose(waitSocket(t, conns))
+				c.Close()
+				waitString(t, serverClose)
+			}
+		},
+		"server close": func(t *testing.T, srv *Server, addr string) {
+			for _, opts := range []*client.Options{pollingOnly(), websocketOnly()} {
+				conns := onConnection(srv)
+				c := dial(t, addr, opts)
+				waitSocket(t, conns).Close()
+				wait(t, c.Done())
+			}
+		},
+		"upgrade": func(t *testing.T, srv *Server, addr string) {
+			conns := onConnection(srv)
+			c := dial(t, addr, &client.Options{NoUpgrade: true})
+			socket := waitSocket(t, conns)
+			serverClose := onClose(socket)
+			expect(t, c.Upgrade() == nil, "upgrade failed")
+			c.Send([]byte("a"))
+			socket.Send([]byte("b"))
+			c.Close()
+			waitString(t, serverClose)
+		},
+		"aborted upgrade": func(t *testing.T, srv *Server, addr string) {
+			conns := onConnection(srv)
+			c := dial(t, addr, &client.Options{NoUpgrade: true})
+			socket := waitSocket(t, conns)
+			serverClose := onClose(socket)
+			probe(t, addr, c.Handshake.Sid).Close()
+			c.Close()
+			waitString(t, serverClose)
+		},
+		"ping timeout": func(t *testing.T, srv *Server, addr string) {
+			for _, transports := range []string{"polling", "websocket"} {
+				conns := onConnection(srv)
+				c := dial(t, addr, &client.Options{Transports: []string{transports}, NoHeartbeat: true})
+				serverClose := onClose(waitSocket(t, conns))
+				expect(t, waitString(t, serverClose) == "ping timeout", "server should time out")
+				wait(t, c.Done())
+			}
+		},
+		"stalled reader": func(t *testing.T, srv *Server, addr string) {
+			conns := onConnection(srv)
+			u := "ws" + strings.TrimPrefix(addr, "http") + "/engine.io/?EIO=3&transport=websocket"
+			conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			socket := waitSocket(t, conns)
+			serverClose := onClose(socket)
+			// More than the socket buffers hold, with nobody reading.
+			data := make([]byte, 1<<20)
+			for i := 0; i < 32; i++ {
+				socket.Send(data)
+			}
+			expect(t, waitString(t, serverClose) == "ping timeout", "server should time out")
+		},
+	}
+	for name, lifecycle := range lifecycles {
+		t.Run(name, func(t *testing.T) {
+			checkLeaks(t)
+			srv, addr := listen(t, Options{"pingInterval": 200, "pingTimeout": 100})
+			lifecycle(t, srv, addr)
+		})
+	}
+}
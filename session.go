@@ -0,0 +1,212 @@
+package engineio
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// forwardedHeader marks requests forwarded from another node, which are
+// never forwarded again.
+const forwardedHeader = "X-Engineio-Forwarded"
+
+// ErrUnknownSession is returned by SendTo for a session no node owns.
+var ErrUnknownSession = errors.New("engineio: unknown session")
+
+// SessionStore is shared by the nodes of a cluster. It knows which node owns
+// each session, so that requests don't have to stick to the node that did
+// the handshake, and buffers the packets other nodes send to a session until
+// its owner takes them. Every method may be called from several goroutines.
+type SessionStore interface {
+	// Add records that node owns the session sid.
+	Add(sid, node string) error
+	// Owner returns the node owning sid, or "" if the session is unknown.
+	Owner(sid string) (string, error)
+	// Remove forgets sid and its buffered packets.
+	Remove(sid string) error
+
+	// Push buffers pkts for sid, after the ones buffered before, and
+	// notifies the owner's watcher. It returns ErrUnknownSession if sid is
+	// unknown.
+	Push(sid string, pkts []*parser.Packet) error
+	// Drain returns the packets buffered for sid and forgets them.
+	Drain(sid string) ([]*parser.Packet, error)
+	// Watch calls fn with the sid of a session of node whenever packets are
+	// pushed for it, until unwatch is called.
+	Watch(node string, fn func(sid string)) (unwatch func(), err error)
+}
+
+// MemoryStore is a SessionStore within one process, for tests and for
+// running several servers side by side. Push notifies the watcher before it
+// returns.
+type MemoryStore struct {
+	lock     sync.Mutex
+	sessions map[string]*storedSession
+	watchers map[string]func(string)
+}
+
+type storedSession struct {
+	node    string
+	pending []*parser.Packet
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]*storedSession),
+		watchers: make(map[string]func(string)),
+	}
+}
+
+func (store *MemoryStore) Add(sid, node string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.sessions[sid] = &storedSession{node: node}
+	return nil
+}
+
+func (store *MemoryStore) Owner(sid string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if session := store.sessions[sid]; session != nil {
+		return session.node, nil
+	}
+	return "", nil
+}
+
+func (store *MemoryStore) Remove(sid string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.sessions, sid)
+	return nil
+}
+
+func (store *MemoryStore) Push(sid string, pkts []*parser.Packet) error {
+	store.lock.Lock()
+	session := store.sessions[sid]
+	if session == nil {
+		store.lock.Unlock()
+		return ErrUnknownSession
+	}
+	session.pending = append(session.pending, pkts...)
+	fn := store.watchers[session.node]
+	store.lock.Unlock()
+	if fn != nil {
+		fn(sid)
+	}
+	return nil
+}
+
+func (store *MemoryStore) Drain(sid string) ([]*parser.Packet, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	session := store.sessions[sid]
+	if session == nil {
+		return nil, nil
+	}
+	pkts := session.pending
+	session.pending = nil
+	return pkts, nil
+}
+
+func (store *MemoryStore) Watch(node string, fn func(string)) (func(), error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.watchers[node] = fn
+	return func() {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		delete(store.watchers, node)
+	}, nil
+}
+
+// newId returns a session id. The ids of a cluster's nodes are random, as
+// the process-wide counter would hand out the same ones on every node.
+func (srv *Server) newId() string {
+	if srv.node == "" {
+		return generateId()
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return generateId()
+	}
+	return hex.EncodeToString(id)
+}
+
+// SendTo sends data to the session sid, whichever node owns it. For a
+// session of another node, the packet waits in the session store until the
+// owner, notified by the store, drains it into the socket.
+func (srv *Server) SendTo(sid string, data []byte) error {
+	if socket := srv.getClient(sid); socket != nil {
+		socket.Send(data)
+		return nil
+	}
+	if srv.node == "" {
+		return ErrUnknownSession
+	}
+	return srv.sessions.Push(sid, []*parser.Packet{&parser.Packet{Type: "message", Data: data}})
+}
+
+// drainSession moves the packets buffered in the store for sid into its
+// socket, if it lives here. Otherwise they stay buffered for the owner.
+func (srv *Server) drainSession(sid string) {
+	socket := srv.getClient(sid)
+	if socket == nil {
+		return
+	}
+	// Drains racing each other must queue their packets in order.
+	socket.drainLock.Lock()
+	defer socket.drainLock.Unlock()
+	pkts, err := srv.sessions.Drain(sid)
+	if err != nil {
+		debug("session store:", err)
+		return
+	}
+	if len(pkts) > 0 {
+		socket.SendPackets(pkts...)
+	}
+}
+
+// owner returns the node to forward a request for sid to, or "" if it is
+// served here.
+func (srv *Server) owner(req *http.Request, sid string) string {
+	if srv.node == "" || len(req.Header.Get(forwardedHeader)) > 0 || srv.getClient(sid) != nil {
+		return ""
+	}
+	node, err := srv.sessions.Owner(sid)
+	if err != nil {
+		debug("session store:", err)
+		return ""
+	}
+	if node == srv.node {
+		return ""
+	}
+	return node
+}
+
+// forward proxies a request to the node owning its session, websocket
+// upgrades included.
+func (srv *Server) forward(res http.ResponseWriter, req *http.Request, node string) {
+	srv.proxiesLock.Lock()
+	proxy := srv.proxies[node]
+	if proxy == nil {
+		target, err := url.Parse(node)
+		if err != nil {
+			srv.proxiesLock.Unlock()
+			debug("bad node address:", node)
+			sendErrorMessage(res, UNKNOWN_SID)
+			return
+		}
+		proxy = httputil.NewSingleHostReverseProxy(target)
+		srv.proxies[node] = proxy
+	}
+	srv.proxiesLock.Unlock()
+	debug("forwarding request to", node)
+	req.Header.Set(forwardedHeader, srv.node)
+	proxy.ServeHTTP(res, req)
+}
@@ -0,0 +1,155 @@
+package engineio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio/parser"
+)
+
+// cluster starts n servers sharing a session store and a bus behind a
+// round-robin balancer, and returns them with the balancer's address.
+func cluster(t *testing.T, n int) ([]*Server, string) {
+	store := NewMemoryStore()
+	bus := NewMemoryBus()
+	servers := make([]*Server, n)
+	proxies := make([]*httputil.ReverseProxy, n)
+	for i := range servers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			servers[i].ServeHTTP(res, req)
+		}))
+		adapter, err := NewBusAdapter(bus, "cluster")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = NewServer(Options{"sessionStore": store, "node": ts.URL, "adapter": adapter})
+		target, _ := url.Parse(ts.URL)
+		proxies[i] = httputil.NewSingleHostReverseProxy(target)
+		t.Cleanup(func() {
+			servers[i].Close()
+			ts.CloseClientConnections()
+			ts.Close()
+		})
+	}
+	var next uint32
+	lb := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		proxies[int(atomic.AddUint32(&next, 1))%n].ServeHTTP(res, req)
+	}))
+	t.Cleanup(lb.Close)
+	return servers, lb.URL
+}
+
+func TestSessionForwarding(t *testing.T) {
+	servers, addr := cluster(t, 2)
+	conns := make(chan *Socket, 1)
+	for _, srv := range servers {
+		srv.On("connection", func(socket *Socket) {
+			conns <- socket
+		})
+	}
+	c := dial(t, addr, pollingOnly())
+	socket := wait(t, conns).(*Socket)
+	received := make(chan string, 4)
+	socket.On("message", func(data []byte) {
+		received <- string(data)
+	})
+	messages := onMessage(c)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		c.Send([]byte(msg))
+		expect(t, wait(t, received) == msg, "every request should reach the owner")
+	}
+	socket.Send([]byte("d"))
+	expect(t, wait(t, messages) == "d", "polls should be served by the owner")
+
+	var other *Server
+	for _, srv := range servers {
+		if srv != socket.server {
+			other = srv
+		}
+	}
+	expect(t, other.getClient(socket.ID()) == nil, "the session should only live on its owner")
+	expect(t, other.SendTo(socket.ID(), []byte("remote")) == nil, "SendTo should reach the owner")
+	expect(t, wait(t, messages) == "remote", "the owner should deliver at once")
+
+	// Sends wait in the store while the owner isn't listening to it.
+	socket.server.unwatchSessions()
+	for _, msg := range []string{"e", "f"} {
+		expect(t, other.SendTo(socket.ID(), []byte(msg)) == nil, "SendTo should buffer in the store")
+	}
+	expectNoMessage(t, messages)
+	socket.server.drainSession(socket.ID())
+	expect(t, wait(t, messages) == "e" && wait(t, messages) == "f", "buffered sends should arrive in order")
+
+	c.Close()
+	waitClosed(t, socket)
+	owner, _ := other.sessions.Owner(socket.ID())
+	expect(t, owner == "", "closed sessions should leave the store")
+	expect(t, other.SendTo(socket.ID(), []byte("gone")) == ErrUnknownSession, "closed sessions should be unknown")
+}
+
+func TestSessionForwardingUpgrade(t *testing.T) {
+	servers, addr := cluster(t, 2)
+	conns := make(chan *Socket, 1)
+	for _, srv := range servers {
+		srv.On("connection", func(socket *Socket) {
+			conns <- socket
+		})
+	}
+	c := newClient(t, addr, nil)
+	upgraded := make(chan string, 1)
+	c.On("upgrade", func(transport string) {
+		upgraded <- transport
+	})
+	if err := c.Open(); err != nil {
+		t.Fatal("open failed:", err)
+	}
+	socket := wait(t, conns).(*Socket)
+	expect(t, wait(t, upgraded) == "websocket", "the upgrade should be forwarded to the owner")
+	messages := onMessage(c)
+	socket.Send([]byte("ws"))
+	expect(t, wait(t, messages) == "ws", "the upgraded socket should deliver")
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	pkt := func(data string) []*parser.Packet {
+		return []*parser.Packet{&parser.Packet{Type: "message", Data: []byte(data)}}
+	}
+	expect(t, store.Push("1", pkt("a")) == ErrUnknownSession, "unknown sessions should not buffer")
+
+	notified := make(chan string, 4)
+	unwatch, _ := store.Watch("node", func(sid string) {
+		notified <- sid
+	})
+	store.Add("1", "node")
+	store.Push("1", pkt("a"))
+	store.Push("1", pkt("b"))
+	expect(t, waitString(t, notified) == "1" && waitString(t, notified) == "1", "the owner should be notified of each push")
+	pkts, _ := store.Drain("1")
+	expect(t, len(pkts) == 2 && string(pkts[0].Data) == "a" && string(pkts[1].Data) == "b", "drain should keep the order:", pkts)
+	pkts, _ = store.Drain("1")
+	expect(t, len(pkts) == 0, "drained packets should be gone")
+
+	unwatch()
+	store.Push("1", pkt("c"))
+	expectNoMessage(t, notified)
+	store.Remove("1")
+	pkts, _ = store.Drain("1")
+	expect(t, len(pkts) == 0, "removed sessions should drop their packets")
+}
+
+func waitClosed(t *testing.T, socket *Socket) {
+	t.Helper()
+	select {
+	case <-socket.done:
+	case <-time.After(timeout):
+		t.Fatal("socket did not close")
+	}
+}
@@ -3,33 +3,88 @@ package engineio
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaicheng/engineio/parser"
 	"github.com/kaicheng/events"
 )
 
+// Socket is one client connection. Its state is owned by a single goroutine,
+// the socket's loop: transport packets, drains, closes and errors, timer
+// expiries, and calls such as Send or Close are all queued to it and handled
+// one at a time. This gives the following guarantees:
+//
+//   - Every socket event ("open", "packet", "message", "heartbeat", "flush",
+//     "drain", "upgrade", "recovered", "stateChange", "close") is emitted
+//     from the loop, one at a time.
+//     Listeners may call back into the socket; such calls are queued and run
+//     once the listener returns.
+//   - Packets from a transport are handled in the order it delivered them.
+//   - Calls made from one goroutine are applied in the order they were made.
+//     Send returns before the packet is written out.
+//   - "close" is the last event. Inputs arriving after it are dropped, and
+//     the loop goroutine exits.
 type Socket struct {
 	events.EventEmitter
-
-	id         string
-	server     *Server
-	upgraded   bool
-	readyState string
-	Request    *Request
-	Transport  Transport
-
-	writeBuffer []*parser.Packet
+	flushListened int32
+
+	id        string
+	server    *Server
+	Request   *Request
+	Transport Transport
+	handshake Handshake
+
+	// Owned by the loop. The loop holds stateLock only to write the fields
+	// that other goroutines read through accessors.
+	upgraded      bool
+	readyState    ReadyState
+	lastHeartbeat time.Time
+	writeBuffer   []*parser.Packet
+	spareBuffer   []*parser.Packet
+	upgrading     Transport
 
 	checkIntervalTimer  *ticker
-	upgradeTimeoutTimer *time.Timer
-	pingTimeoutTimer    *time.Timer
-
-	bufferLock     sync.Mutex
-	timerLock      sync.Mutex
-	readyStateLock sync.Mutex
-	transportLock  sync.Mutex
+	upgradeTimeoutTimer Timer
+	pingTimeoutTimer    Timer
+
+	// Connection state recovery, see recovery.go. suspended is published
+	// under stateLock.
+	recoveryToken string
+	suspended     bool
+	recoveryTimer Timer
+	sent          int
+	history       []*parser.Packet
+
+	capture *Capture
+
+	// Rate limits, see ratelimit.go. pollBucket is used by HTTP handlers.
+	messageBucket *bucket
+	byteBucket    *bucket
+	pollBucket    *bucket
+	delayed       []delayedPacket
+	delayTimer    Timer
+
+	stateLock sync.Mutex
+
+	valuesLock    sync.Mutex
+	values        map[interface{}]interface{}
+	valuesCleared bool
+
+	// drainLock orders the drains of packets sent to the socket from other
+	// nodes, see session.go.
+	drainLock sync.Mutex
+
+	// The inbox is a slice rather than a buffered channel so that posting
+	// from the loop itself never blocks.
+	inboxLock sync.Mutex
+	inbox     []func()
+	stopped   bool
+	wake      chan bool
+	done      chan bool
 }
 
 func newSocket(id string, srv *Server, transport Transport, req *Request) *Socket {
@@ -38,115 +93,363 @@ func newSocket(id string, srv *Server, transport Transport, req *Request) *Socke
 	socket.id = id
 	socket.server = srv
 	socket.upgraded = false
-	socket.readyState = "opening"
+	socket.readyState = StateOpening
 	socket.Request = req
-	socket.setTransport(transport)
+	socket.Transport = transport
+	socket.handshake = newHandshake(id, transport, req, srv.clock.Now())
+	socket.lastHeartbeat = socket.handshake.Time
+	socket.capture = srv.capture
+	if srv.recoveryTimeout > 0 {
+		socket.recoveryToken = newRecoveryToken()
+	}
+	now := socket.handshake.Time
+	if srv.messageLimit != nil {
+		socket.messageBucket = newBucket(srv.messageLimit, now)
+	}
+	if srv.byteLimit != nil {
+		socket.byteBucket = newBucket(srv.byteLimit, now)
+	}
+	if srv.pollLimit != nil {
+		socket.pollBucket = newBucket(srv.pollLimit, now)
+	}
 
 	// TODO: make capacity configurable
 	socket.writeBuffer = make([]*parser.Packet, 10)[0:0]
+	socket.spareBuffer = make([]*parser.Packet, 10)[0:0]
 
-	socket.onOpen()
+	socket.wake = make(chan bool, 1)
+	socket.done = make(chan bool)
+	socket.listen(transport)
+	go socket.run()
 	return socket
 }
 
+// post queues fn to run on the loop. It reports false once the socket is
+// closed.
+func (socket *Socket) post(fn func()) bool {
+	socket.inboxLock.Lock()
+	if socket.stopped {
+		socket.inboxLock.Unlock()
+		return false
+	}
+	socket.inbox = append(socket.inbox, fn)
+	socket.inboxLock.Unlock()
+	select {
+	case socket.wake <- true:
+	default:
+	}
+	return true
+}
+
+func (socket *Socket) run() {
+	defer close(socket.done)
+	for range socket.wake {
+		socket.inboxLock.Lock()
+		fns := socket.inbox
+		socket.inbox = nil
+		socket.inboxLock.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+		if StateClosed == socket.readyState {
+			socket.inboxLock.Lock()
+			socket.stopped = true
+			socket.inbox = nil
+			socket.inboxLock.Unlock()
+			return
+		}
+	}
+}
+
+// setState moves the socket to state and emits "stateChange" with the old and
+// new states. It reports false, leaving the state alone, if the transition
+// isn't allowed.
+func (socket *Socket) setState(state ReadyState) bool {
+	old := socket.readyState
+	if !canTransition(old, state) {
+		debug(fmt.Sprintf("socket: invalid transition from %s to %s", old, state))
+		return false
+	}
+	socket.stateLock.Lock()
+	socket.readyState = state
+	socket.stateLock.Unlock()
+	socket.Emit("stateChange", old, state)
+	return true
+}
+
+// ReadyState returns the state of the socket.
+func (socket *Socket) ReadyState() ReadyState {
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
+	return socket.readyState
+}
+
+// WriteBuffer returns the packets waiting to be flushed. The socket reuses
+// the slice after a flush.
 func (socket *Socket) WriteBuffer() []*parser.Packet {
-	socket.bufferLock.Lock()
-	defer socket.bufferLock.Unlock()
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
 	return socket.writeBuffer
 }
 
+// SetWriteBuffer replaces the write buffer. Like Send, it is queued to the
+// loop.
 func (socket *Socket) SetWriteBuffer(buf []*parser.Packet) {
-	socket.bufferLock.Lock()
-	defer socket.bufferLock.Unlock()
+	socket.post(func() {
+		socket.setWriteBuffer(buf)
+	})
+}
+
+func (socket *Socket) setWriteBuffer(buf []*parser.Packet) {
+	socket.stateLock.Lock()
 	socket.writeBuffer = buf
+	socket.stateLock.Unlock()
 }
 
 func (socket *Socket) getTransport() Transport {
-	socket.transportLock.Lock()
-	defer socket.transportLock.Unlock()
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
 	return socket.Transport
 }
 
+// ID returns the session id of the socket.
+func (socket *Socket) ID() string {
+	return socket.id
+}
+
+// Handshake returns the snapshot of the request that opened the socket.
+func (socket *Socket) Handshake() Handshake {
+	return socket.handshake
+}
+
+// RemoteAddr returns the address of the client at the handshake.
+func (socket *Socket) RemoteAddr() string {
+	return socket.handshake.RemoteAddr
+}
+
+// Header returns the headers of the handshake request. It must not be
+// modified.
+func (socket *Socket) Header() http.Header {
+	return socket.handshake.Header
+}
+
+// Query returns the query of the handshake request. It must not be modified.
+func (socket *Socket) Query() url.Values {
+	return socket.handshake.Query
+}
+
+// ConnectedAt returns when the socket was opened.
+func (socket *Socket) ConnectedAt() time.Time {
+	return socket.handshake.Time
+}
+
+// Upgraded reports whether the socket has moved to another transport since
+// the handshake.
+func (socket *Socket) Upgraded() bool {
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
+	return socket.upgraded
+}
+
+// Set stores val under key for the life of the socket. Values are kept
+// through the "close" event and dropped right after it.
+func (socket *Socket) Set(key, val interface{}) {
+	socket.valuesLock.Lock()
+	defer socket.valuesLock.Unlock()
+	if socket.valuesCleared {
+		return
+	}
+	if socket.values == nil {
+		socket.values = make(map[interface{}]interface{})
+	}
+	socket.values[key] = val
+}
+
+// Get returns the value stored under key, and whether there was one.
+func (socket *Socket) Get(key interface{}) (interface{}, bool) {
+	socket.valuesLock.Lock()
+	defer socket.valuesLock.Unlock()
+	val, ok := socket.values[key]
+	return val, ok
+}
+
+// Delete removes the value stored under key.
+func (socket *Socket) Delete(key interface{}) {
+	socket.valuesLock.Lock()
+	defer socket.valuesLock.Unlock()
+	delete(socket.values, key)
+}
+
+// LastHeartbeat returns when the client last pinged, or the handshake time
+// if it hasn't yet.
+func (socket *Socket) LastHeartbeat() time.Time {
+	socket.stateLock.Lock()
+	defer socket.stateLock.Unlock()
+	return socket.lastHeartbeat
+}
+
+// TransportName returns the name of the current transport.
+func (socket *Socket) TransportName() string {
+	return socket.getTransport().Name()
+}
+
+// listen forwards the events of transport to the loop. Events from a
+// transport that is neither the socket's nor the one being upgraded to are
+// ignored there.
+func (socket *Socket) listen(transport Transport) {
+	transport.On("packet", func(pkt *parser.Packet) {
+		socket.post(func() {
+			socket.onTransportPacket(transport, pkt)
+		})
+	})
+	transport.On("drain", func() {
+		socket.post(func() {
+			if socket.Transport == transport {
+				socket.flush()
+			}
+		})
+	})
+	transport.Once("error", func(err *Error) {
+		desc := ""
+		if err != nil {
+			desc = err.Desc
+		}
+		socket.post(func() {
+			if socket.Transport == transport {
+				debug("transport error")
+				socket.onClose("transport error", desc)
+			}
+		})
+	})
+	transport.Once("close", func() {
+		socket.post(func() {
+			socket.onTransportClose(transport)
+		})
+	})
+}
+
 func (socket *Socket) onOpen() {
-	socket.readyState = "open"
-	socket.getTransport().setSid(socket.id)
-	pingInterval := (int64)(socket.server.pingInterval / time.Millisecond)
-	pingTimeout := (int64)(socket.server.pingTimeout / time.Millisecond)
-	upgrades, _ := json.Marshal(socket.getAvailableUpgrades())
-	socket.sendPacket("open", []byte(fmt.Sprintf("{\"sid\":\"%s\",\"upgrades\":%s,\"pingInterval\":%d, \"pingTimeout\":%d}",
-		socket.id, upgrades, pingInterval, pingTimeout)))
+	socket.setState(StateOpen)
+	socket.Transport.setReadyState(StateOpen)
+	socket.Transport.setSid(socket.id)
+	socket.queuePacket(socket.openPacket())
 
 	socket.Emit("open")
 	socket.setPingTimeout()
 }
 
+func (socket *Socket) openPacket() *parser.Packet {
+	pingInterval := (int64)(socket.server.pingInterval / time.Millisecond)
+	pingTimeout := (int64)(socket.server.pingTimeout / time.Millisecond)
+	upgrades, _ := json.Marshal(socket.getAvailableUpgrades())
+	pid := ""
+	if len(socket.recoveryToken) > 0 {
+		pid = fmt.Sprintf(",\"pid\":\"%s\"", socket.recoveryToken)
+	}
+	return &parser.Packet{Type: "open", Data: []byte(fmt.Sprintf("{\"sid\":\"%s\",\"upgrades\":%s,\"pingInterval\":%d, \"pingTimeout\":%d%s}",
+		socket.id, upgrades, pingInterval, pingTimeout, pid))}
+}
+
 func (socket *Socket) onClose(reason, desc string) {
-	socket.readyStateLock.Lock()
-	if "closed" != socket.readyState {
-		socket.timerLock.Lock()
-		if socket.pingTimeoutTimer != nil {
-			socket.pingTimeoutTimer.Stop()
-		}
-		socket.pingTimeoutTimer = nil
-		if socket.checkIntervalTimer != nil {
-			socket.checkIntervalTimer.stop()
+	if socket.suspended && recoverable(reason) {
+		// The lost transport closing or failing again.
+		return
+	}
+	if !socket.suspended && socket.suspend(reason, desc) {
+		return
+	}
+	socket.doClose(reason, desc)
+}
+
+func (socket *Socket) doClose(reason, desc string) {
+	if StateClosed == socket.readyState {
+		return
+	}
+	socket.stopRecovery()
+	socket.stopDelayed()
+	if socket.pingTimeoutTimer != nil {
+		socket.pingTimeoutTimer.Stop()
+	}
+	socket.pingTimeoutTimer = nil
+	if socket.upgrading != nil {
+		debug("socket closed during upgrade")
+		candidate := socket.upgrading
+		socket.stopUpgrade()
+		candidate.close(nil)
+	}
+	socket.clearTransport()
+	socket.setState(StateClosed)
+	socket.Emit("close", reason, desc)
+	socket.setWriteBuffer(socket.writeBuffer[0:0])
+	socket.valuesLock.Lock()
+	socket.values = nil
+	socket.valuesCleared = true
+	socket.valuesLock.Unlock()
+}
+
+func (socket *Socket) onTransportClose(transport Transport) {
+	switch transport {
+	case socket.Transport:
+		debug("transport on close, closing")
+		if StateClosing == socket.readyState {
+			socket.onClose("forced close", "")
+		} else {
+			socket.onClose("transport close", "")
 		}
-		socket.checkIntervalTimer = nil
-		if socket.upgradeTimeoutTimer != nil {
-			socket.upgradeTimeoutTimer.Stop()
+	case socket.upgrading:
+		debug("upgrade transport closed")
+		socket.stopUpgrade()
+	}
+}
+
+func (socket *Socket) onTransportPacket(transport Transport, pkt *parser.Packet) {
+	switch transport {
+	case socket.Transport:
+		if socket.suspended {
+			debug("packet from a lost transport")
+			return
 		}
-		socket.upgradeTimeoutTimer = nil
-		socket.timerLock.Unlock()
-		socket.clearTransport()
-		socket.readyState = "closed"
-		socket.readyStateLock.Unlock()
-		socket.Emit("close", reason, desc)
-		socket.bufferLock.Lock()
-		socket.writeBuffer = socket.writeBuffer[0:0]
-		socket.bufferLock.Unlock()
-	} else {
-		socket.readyStateLock.Unlock()
+		socket.onPacket(pkt)
+	case socket.upgrading:
+		socket.onUpgradePacket(pkt)
+	default:
+		debug("packet from a discarded transport")
 	}
 }
 
 func (socket *Socket) sendPacket(strType string, data []byte) {
-	socket.readyStateLock.Lock()
-	state := socket.readyState
-	socket.readyStateLock.Unlock()
-	if "closing" != state {
-		debug(fmt.Sprintf("sending packet \"%s\" (\"%s\")", strType, string(data)))
-		packet := &parser.Packet{Type: strType, Data: data}
-		socket.Emit("packetCreate", packet)
-		socket.bufferLock.Lock()
-		socket.writeBuffer = append(socket.writeBuffer, packet)
-		socket.bufferLock.Unlock()
-		socket.flush()
-	}
+	socket.queuePacket(&parser.Packet{Type: strType, Data: data})
 }
 
 func (socket *Socket) sendBinPacket(strType string, data []byte) {
-	socket.readyStateLock.Lock()
-	state := socket.readyState
-	socket.readyStateLock.Unlock()
-	if "closing" != state {
-		debug(fmt.Sprintf("sending packet \"%s\" (\"%s\")", strType, string(data)))
-		packet := &parser.Packet{Type: strType, Data: data, IsBin: true}
+	socket.queuePacket(&parser.Packet{Type: strType, Data: data, IsBin: true})
+}
+
+func (socket *Socket) queuePacket(packet *parser.Packet) {
+	if StateClosing != socket.readyState && StateClosed != socket.readyState {
+		if eioDebug {
+			debug(fmt.Sprintf("sending packet \"%s\" (\"%s\")", packet.Type, string(packet.Data)))
+		}
 		socket.Emit("packetCreate", packet)
-		socket.bufferLock.Lock()
-		socket.writeBuffer = append(socket.writeBuffer, packet)
-		socket.bufferLock.Unlock()
+		socket.setWriteBuffer(append(socket.writeBuffer, packet))
 		socket.flush()
 	}
 }
 
 func (socket *Socket) onPacket(packet *parser.Packet) {
-	socket.readyStateLock.Lock()
-	state := socket.readyState
-	socket.readyStateLock.Unlock()
+	socket.capturePacket("in", socket.Transport, packet)
+	if StateOpen == socket.readyState && !socket.admitPacket(packet) {
+		return
+	}
+	socket.handlePacket(packet)
+}
 
-	if "open" == state {
+func (socket *Socket) handlePacket(packet *parser.Packet) {
+	if StateOpen == socket.readyState {
 		debug("packet ", packet.Type)
-		debug("packet.Data", string(packet.Data))
+		if eioDebug {
+			debug("packet.Data", string(packet.Data))
+		}
 		socket.Emit("packet", packet)
 
 		socket.setPingTimeout()
@@ -154,56 +457,103 @@ func (socket *Socket) onPacket(packet *parser.Packet) {
 		switch packet.Type {
 		case "ping":
 			debug("got ping")
+			socket.stateLock.Lock()
+			socket.lastHeartbeat = socket.server.clock.Now()
+			socket.stateLock.Unlock()
 			socket.sendPacket("pong", nil)
 			socket.Emit("heartbeat")
 		case "error":
 			socket.onClose("parse error", "")
+		case "close":
+			// The client is leaving, so there is nothing to recover.
+			socket.doClose("transport close", "")
 		case "message":
-			socket.Emit("data", packet.Data)
-			socket.Emit("message", packet.Data)
+			// Listeners may take a second bool argument telling binary
+			// messages from text ones.
+			socket.Emit("data", packet.Data, packet.IsBin)
+			socket.Emit("message", packet.Data, packet.IsBin)
 		}
 	} else {
 		debug("packet received with closed socket")
 	}
 }
 
+// On adds listener for event. Only with "flush" listeners do flushes copy
+// their buffer to hand it out.
+func (socket *Socket) On(event string, listener interface{}) {
+	socket.noteListener(event)
+	socket.EventEmitter.On(event, listener)
+}
+
+func (socket *Socket) Once(event string, listener interface{}) {
+	socket.noteListener(event)
+	socket.EventEmitter.Once(event, listener)
+}
+
+func (socket *Socket) noteListener(event string) {
+	if "flush" == event {
+		atomic.StoreInt32(&socket.flushListened, 1)
+	}
+}
+
+func (socket *Socket) hasFlushListener() bool {
+	return atomic.LoadInt32(&socket.flushListened) != 0
+}
+
 func (socket *Socket) OnError(err string) {
-	debug("transport error")
-	socket.onClose("transport error", err)
+	socket.post(func() {
+		debug("transport error")
+		socket.onClose("transport error", err)
+	})
 }
 
 func (socket *Socket) setPingTimeout() {
-	socket.timerLock.Lock()
-	defer socket.timerLock.Unlock()
 	if socket.pingTimeoutTimer != nil {
 		socket.pingTimeoutTimer.Stop()
 	}
-	socket.pingTimeoutTimer = time.AfterFunc(socket.server.pingInterval+socket.server.pingTimeout, func() {
-		socket.onClose("ping timeout", "")
+	var timer Timer
+	timer = socket.server.clock.AfterFunc(socket.server.pingInterval+socket.server.pingTimeout, func() {
+		socket.post(func() {
+			// A timer stopped too late to keep its callback from running
+			// is no longer the current one.
+			if socket.pingTimeoutTimer == timer {
+				socket.onClose("ping timeout", "")
+			}
+		})
 	})
+	socket.pingTimeoutTimer = timer
 }
 
 func (socket *Socket) clearTransport() {
-	socket.getTransport().On("error", func(arg interface{}) {
-		debug("error triggered by discarded transport")
-	})
-	socket.timerLock.Lock()
-	defer socket.timerLock.Unlock()
+	// ensure transport won't stay open
+	socket.Transport.close(nil)
 	if socket.pingTimeoutTimer != nil {
 		socket.pingTimeoutTimer.Stop()
 	}
 	socket.pingTimeoutTimer = nil
 }
 
-func (socket *Socket) setupSendCallback() {
+func (socket *Socket) Send(data []byte) {
+	socket.post(func() {
+		socket.sendPacket("message", data)
+	})
 }
 
-func (socket *Socket) Send(data []byte) {
-	socket.sendPacket("message", data)
+// SendPackets sends pkts back to back: nothing sent from other goroutines
+// comes between them. The packets may be shared with other sockets, like the
+// ones made by parser.Shared, and must not be modified afterwards.
+func (socket *Socket) SendPackets(pkts ...*parser.Packet) {
+	socket.post(func() {
+		for _, pkt := range pkts {
+			socket.queuePacket(pkt)
+		}
+	})
 }
 
 func (socket *Socket) SendBin(data []byte) {
-	socket.sendBinPacket("message", data)
+	socket.post(func() {
+		socket.sendBinPacket("message", data)
+	})
 }
 
 func (socket *Socket) Write(data []byte) {
@@ -211,132 +561,168 @@ func (socket *Socket) Write(data []byte) {
 }
 
 func (socket *Socket) flush() {
-	socket.readyStateLock.Lock()
-	state := socket.readyState
-	socket.readyStateLock.Unlock()
-	socket.bufferLock.Lock()
-	if "closed" != state && len(socket.writeBuffer) > 0 {
-		socket.bufferLock.Unlock()
-		trans := socket.getTransport()
-		trans.tryWritable(func() {
-			debug("flusing buffer to transport")
-			socket.bufferLock.Lock()
-			buf := socket.writeBuffer
-			socket.writeBuffer = make([]*parser.Packet, 10)[0:0]
-			socket.bufferLock.Unlock()
-			socket.Emit("flush", buf)
-			socket.server.Emit("flush", buf)
-			trans.send(buf)
-			socket.Emit("drain")
-			socket.server.Emit("drain", socket)
-		}, nil)
-	} else {
-		socket.bufferLock.Unlock()
+	if StateClosed == socket.readyState {
+		return
+	}
+	if socket.suspended || len(socket.writeBuffer) == 0 {
+		return
 	}
+	trans := socket.Transport
+	trans.tryWritable(func() {
+		debug("flusing buffer to transport")
+		buf := socket.writeBuffer
+		socket.setWriteBuffer(socket.spareBuffer[0:0])
+		if socket.hasFlushListener() || socket.server.hasFlushListener() {
+			// Listeners get their own copy, as buf is reused.
+			kept := append([]*parser.Packet(nil), buf...)
+			socket.Emit("flush", kept)
+			socket.server.Emit("flush", kept)
+		}
+		trans.send(buf)
+		for _, packet := range buf {
+			socket.capturePacket("out", trans, packet)
+		}
+		socket.remember(buf)
+		// Transports are done with buf once send returns, so it is kept
+		// as the next write buffer.
+		for i := range buf {
+			buf[i] = nil
+		}
+		socket.spareBuffer = buf[0:0]
+		socket.Emit("drain")
+		socket.server.Emit("drain", socket)
+	}, nil)
 }
 
 func (socket *Socket) getAvailableUpgrades() []string {
 	return socket.server.upgrades(socket.Transport.Name())
 }
 
+// setTransport adopts transport, which opens it.
 func (socket *Socket) setTransport(transport Transport) {
-	socket.transportLock.Lock()
+	socket.stateLock.Lock()
 	socket.Transport = transport
-	socket.transportLock.Unlock()
-	transport.Once("error", socket.OnError)
-	transport.On("packet", socket.onPacket)
-	transport.On("drain", socket.flush)
-	transport.Once("close", func() {
-		debug("transport on close, closing")
-		socket.onClose("transport close", "")
-	})
-	socket.setupSendCallback()
+	socket.stateLock.Unlock()
+	transport.setReadyState(StateOpen)
 }
 
-type funcBag struct {
-	fn func(*parser.Packet)
+// maybeUpgrade starts probing transport as a replacement for the current
+// one. It may be called from any goroutine.
+func (socket *Socket) maybeUpgrade(transport Transport) {
+	// Queued before the transport's events, so that it runs first.
+	socket.post(func() {
+		socket.startUpgrade(transport)
+	})
+	socket.listen(transport)
 }
 
-func (socket *Socket) maybeUpgrade(transport Transport) {
+func (socket *Socket) startUpgrade(transport Transport) {
 	debug(fmt.Sprintf("might upgrade socket transport from \"%s\" to \"%s\"",
-		socket.getTransport().Name(), transport.Name()))
+		socket.Transport.Name(), transport.Name()))
+
+	if StateOpen != socket.readyState || socket.suspended || socket.upgrading != nil {
+		debug("upgrade not possible")
+		transport.close(nil)
+		return
+	}
+	socket.upgrading = transport
 
-	socket.timerLock.Lock()
-	socket.upgradeTimeoutTimer = time.AfterFunc(socket.server.upgradeTimeout,
-		func() {
+	var timer Timer
+	timer = socket.server.clock.AfterFunc(socket.server.upgradeTimeout, func() {
+		socket.post(func() {
+			if socket.upgradeTimeoutTimer != timer {
+				return
+			}
 			debug("client did not complete upgrade - closing tansport")
-			if "open" == transport.readyState() {
+			socket.stopUpgrade()
+			if state := transport.readyState(); StateClosing != state && StateClosed != state {
 				transport.close(nil)
 			}
 		})
-	socket.timerLock.Unlock()
-
-	onPacket := new(funcBag)
-	onPacket.fn = func(pkt *parser.Packet) {
-		if "ping" == pkt.Type && "probe" == string(pkt.Data) {
-			transport.send([]*parser.Packet{&parser.Packet{Type: "pong", Data: []byte("probe")}})
-			socket.timerLock.Lock()
-			if socket.checkIntervalTimer != nil {
-				socket.checkIntervalTimer.stop()
-			}
-			// TODO: set as a parameter
-			socket.checkIntervalTimer = newTicker(100 * time.Millisecond)
-			go func(c <-chan time.Time, end <-chan bool) {
-				for {
-					select {
-					case <-c:
-						trans := socket.getTransport()
-						if "polling" == trans.Name() {
-							trans.tryWritable(func() {
-								debug("writing a noop packet to polling for fast upgrade")
-								trans.send([]*parser.Packet{&parser.Packet{Type: "noop"}})
-							}, nil)
+	})
+	socket.upgradeTimeoutTimer = timer
+}
+
+// stopUpgrade forgets the transport being upgraded to and stops its timers.
+func (socket *Socket) stopUpgrade() {
+	if socket.checkIntervalTimer != nil {
+		socket.checkIntervalTimer.stop()
+	}
+	socket.checkIntervalTimer = nil
+	if socket.upgradeTimeoutTimer != nil {
+		socket.upgradeTimeoutTimer.Stop()
+	}
+	socket.upgradeTimeoutTimer = nil
+	socket.upgrading = nil
+}
+
+func (socket *Socket) onUpgradePacket(pkt *parser.Packet) {
+	transport := socket.upgrading
+	if "ping" == pkt.Type && "probe" == string(pkt.Data) {
+		if socket.checkIntervalTimer != nil {
+			socket.checkIntervalTimer.stop()
+		}
+		// TODO: set as a parameter
+		check := newTicker(socket.server.clock, 100*time.Millisecond)
+		socket.checkIntervalTimer = check
+		go func() {
+			for {
+				select {
+				case <-check.c:
+					socket.post(func() {
+						if socket.checkIntervalTimer == check {
+							socket.checkUpgrade()
 						}
-					case <-end:
-						return
-					}
+					})
+				case <-check.end:
+					return
 				}
-			}(socket.checkIntervalTimer.c, socket.checkIntervalTimer.end)
-			socket.timerLock.Unlock()
-		} else if "upgrade" == pkt.Type {
-			socket.readyStateLock.Lock()
-			state := socket.readyState
-			socket.readyStateLock.Unlock()
-			if state == "open" {
-				debug("got upgrade packet - upgrading")
-				socket.timerLock.Lock()
-				socket.upgradeTimeoutTimer.Stop()
-				socket.timerLock.Unlock()
-				transport.RemoveListener("packet", onPacket.fn)
-				socket.upgraded = true
-				socket.clearTransport()
-				socket.setTransport(transport)
-				socket.Emit("upgrade", transport)
-				socket.flush()
-				socket.timerLock.Lock()
-				socket.checkIntervalTimer.stop()
-				socket.checkIntervalTimer = nil
-				socket.timerLock.Unlock()
-				debug(fmt.Sprintf("upgrade to \"%s\" finishes", transport.Name()))
 			}
-		} else {
-			debug("invalid packet during upgrade")
-			transport.close(nil)
+		}()
+		transport.send([]*parser.Packet{&parser.Packet{Type: "pong", Data: []byte("probe")}})
+	} else if "upgrade" == pkt.Type {
+		if StateOpen == socket.readyState {
+			debug("got upgrade packet - upgrading")
+			socket.stopUpgrade()
+			socket.stateLock.Lock()
+			socket.upgraded = true
+			socket.stateLock.Unlock()
+			socket.clearTransport()
+			socket.setTransport(transport)
+			socket.setPingTimeout()
+			socket.Emit("upgrade", transport)
+			socket.flush()
+			debug(fmt.Sprintf("upgrade to \"%s\" finishes", transport.Name()))
 		}
+	} else {
+		debug("invalid packet during upgrade")
+		socket.stopUpgrade()
+		transport.close(nil)
 	}
+}
 
-	transport.On("packet", onPacket.fn)
+// checkUpgrade answers a pending poll with a noop, so that the client can
+// pause polling and complete the upgrade quickly.
+func (socket *Socket) checkUpgrade() {
+	trans := socket.Transport
+	if "polling" == trans.Name() {
+		trans.tryWritable(func() {
+			debug("writing a noop packet to polling for fast upgrade")
+			trans.send([]*parser.Packet{&parser.Packet{Type: "noop"}})
+		}, nil)
+	}
 }
 
 func (socket *Socket) Close() {
-	socket.readyStateLock.Lock()
-	if "open" == socket.readyState {
-		socket.readyState = "closing"
-		socket.readyStateLock.Unlock()
-		socket.getTransport().close(func() {
-			socket.onClose("forced close", "")
-		})
-	} else {
-		socket.readyStateLock.Unlock()
-	}
+	socket.post(func() {
+		if socket.suspended {
+			socket.doClose("forced close", "")
+		} else if socket.setState(StateClosing) {
+			socket.Transport.close(func() {
+				socket.post(func() {
+					socket.onClose("forced close", "")
+				})
+			})
+		}
+	})
 }
@@ -0,0 +1,15 @@
+package socketio
+
+import (
+	"fmt"
+	"os"
+)
+
+var sioDebug bool = len(os.Getenv("SIO_DEBUG")) > 0
+
+func debug(msg ...interface{}) {
+	if sioDebug {
+		fmt.Print("[\x1b[36;1mSIO DEBUG\x1b[0m] ")
+		fmt.Println(msg...)
+	}
+}
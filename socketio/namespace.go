@@ -0,0 +1,254 @@
+package socketio
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/events"
+)
+
+var (
+	ErrReserved     = errors.New("socketio: reserved event name")
+	ErrBroadcastAck = errors.New("socketio: broadcasts can't ask for acks")
+)
+
+// reserved events are emitted by the package itself and can't be sent.
+var reserved = map[string]bool{
+	"connect":       true,
+	"connection":    true,
+	"disconnect":    true,
+	"disconnecting": true,
+	"error":         true,
+}
+
+// Middleware runs before a socket joins a namespace. It calls next with nil
+// to let the socket in, or with an error that is sent to the client. next
+// may be called from another goroutine.
+type Middleware func(socket *Socket, next func(error))
+
+// Namespace is a channel of sockets sharing one engine.io connection per
+// client. It emits "connection" with each *Socket that joins it.
+//
+// Rooms and broadcasts go through the adapter of the engine.io server, so
+// that with a cluster-wide adapter like engineio.BusAdapter they reach the
+// sockets of every node. The engine.io connection of a socket is in the room
+// named after the namespace, and in "<namespace>#<room>" for each of the
+// socket's rooms.
+type Namespace struct {
+	events.EventEmitter
+
+	name   string
+	server *Server
+
+	lock       sync.Mutex
+	middleware []Middleware
+	// sockets are the sockets of this process, by engine.io session id.
+	sockets map[string]*Socket
+}
+
+func newNamespace(srv *Server, name string) *Namespace {
+	return &Namespace{
+		name:    name,
+		server:  srv,
+		sockets: make(map[string]*Socket),
+	}
+}
+
+func (nsp *Namespace) Name() string {
+	return nsp.name
+}
+
+// Use appends fn to the middleware run on every connection.
+func (nsp *Namespace) Use(fn Middleware) {
+	nsp.lock.Lock()
+	defer nsp.lock.Unlock()
+	nsp.middleware = append(nsp.middleware, fn)
+}
+
+// run passes socket through the middleware, then calls fn with the first
+// error or nil.
+func (nsp *Namespace) run(socket *Socket, fn func(error)) {
+	nsp.lock.Lock()
+	chain := append([]Middleware(nil), nsp.middleware...)
+	nsp.lock.Unlock()
+	var step func(i int)
+	step = func(i int) {
+		if i == len(chain) {
+			fn(nil)
+			return
+		}
+		chain[i](socket, func(err error) {
+			if err != nil {
+				fn(err)
+				return
+			}
+			step(i + 1)
+		})
+	}
+	step(0)
+}
+
+// roomKey returns the engine.io room holding the sockets in room.
+func (nsp *Namespace) roomKey(room string) string {
+	return nsp.name + "#" + room
+}
+
+// sid returns the engine.io session id of the socket with id.
+func (nsp *Namespace) sid(id string) string {
+	if nsp.name == "/" {
+		return id
+	}
+	return strings.TrimPrefix(id, nsp.name+"#")
+}
+
+func (nsp *Namespace) add(socket *Socket) {
+	nsp.lock.Lock()
+	defer nsp.lock.Unlock()
+	nsp.sockets[socket.Conn().ID()] = socket
+	socket.Conn().Join(nsp.name)
+	// Every socket is in the room named after its id.
+	socket.Conn().Join(nsp.roomKey(socket.id))
+}
+
+func (nsp *Namespace) remove(socket *Socket) {
+	nsp.lock.Lock()
+	defer nsp.lock.Unlock()
+	conn := socket.Conn()
+	if nsp.sockets[conn.ID()] != socket {
+		return
+	}
+	delete(nsp.sockets, conn.ID())
+	for _, room := range nsp.rooms(conn) {
+		conn.Leave(nsp.roomKey(room))
+	}
+	conn.Leave(nsp.name)
+}
+
+// rooms returns the rooms conn is in within the namespace.
+func (nsp *Namespace) rooms(conn *engineio.Socket) []string {
+	prefix := nsp.roomKey("")
+	var rooms []string
+	for _, key := range conn.Rooms() {
+		if strings.HasPrefix(key, prefix) {
+			rooms = append(rooms, key[len(prefix):])
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Sockets returns the sockets of this process connected to the namespace.
+func (nsp *Namespace) Sockets() []*Socket {
+	return nsp.To().Sockets()
+}
+
+func (nsp *Namespace) join(socket *Socket, room string) {
+	nsp.lock.Lock()
+	defer nsp.lock.Unlock()
+	if nsp.sockets[socket.Conn().ID()] != socket {
+		return
+	}
+	socket.Conn().Join(nsp.roomKey(room))
+}
+
+func (nsp *Namespace) leave(socket *Socket, room string) {
+	nsp.lock.Lock()
+	defer nsp.lock.Unlock()
+	socket.Conn().Leave(nsp.roomKey(room))
+}
+
+// Emit sends an event to every socket of the namespace.
+func (nsp *Namespace) Emit(event string, args ...interface{}) error {
+	return nsp.To().Emit(event, args...)
+}
+
+// To returns an operator sending to the sockets in any of rooms.
+func (nsp *Namespace) To(rooms ...string) *BroadcastOperator {
+	return &BroadcastOperator{nsp: nsp, rooms: rooms}
+}
+
+// Except returns an operator sending to every socket but those with ids.
+func (nsp *Namespace) Except(ids ...string) *BroadcastOperator {
+	return &BroadcastOperator{nsp: nsp, except: ids}
+}
+
+// BroadcastOperator sends events to a set of sockets of a namespace.
+type BroadcastOperator struct {
+	nsp    *Namespace
+	rooms  []string
+	except []string
+}
+
+// To adds rooms to the ones the operator sends to.
+func (op *BroadcastOperator) To(rooms ...string) *BroadcastOperator {
+	return &BroadcastOperator{
+		nsp:    op.nsp,
+		rooms:  append(op.rooms[:len(op.rooms):len(op.rooms)], rooms...),
+		except: op.except,
+	}
+}
+
+// Except leaves out the sockets with ids.
+func (op *BroadcastOperator) Except(ids ...string) *BroadcastOperator {
+	return &BroadcastOperator{
+		nsp:    op.nsp,
+		rooms:  op.rooms,
+		except: append(op.except[:len(op.except):len(op.except)], ids...),
+	}
+}
+
+// engine returns the engine.io operator selecting the same sockets.
+func (op *BroadcastOperator) engine() *engineio.BroadcastOperator {
+	nsp := op.nsp
+	keys := make([]string, 0, len(op.rooms))
+	for _, room := range op.rooms {
+		keys = append(keys, nsp.roomKey(room))
+	}
+	if len(keys) == 0 {
+		keys = append(keys, nsp.name)
+	}
+	sids := make([]string, 0, len(op.except))
+	for _, id := range op.except {
+		sids = append(sids, nsp.sid(id))
+	}
+	return nsp.server.eio.To(keys...).Except(sids...)
+}
+
+// Sockets returns the sockets of this process the operator sends to.
+// Without rooms, that is every socket of the namespace.
+func (op *BroadcastOperator) Sockets() []*Socket {
+	nsp := op.nsp
+	conns := op.engine().Sockets()
+	sockets := make([]*Socket, 0, len(conns))
+	nsp.lock.Lock()
+	for _, conn := range conns {
+		if socket := nsp.sockets[conn.ID()]; socket != nil {
+			sockets = append(sockets, socket)
+		}
+	}
+	nsp.lock.Unlock()
+	return sockets
+}
+
+// Emit sends an event to the sockets, on every node the adapter reaches. The
+// packet is encoded once for all of them.
+func (op *BroadcastOperator) Emit(event string, args ...interface{}) error {
+	if reserved[event] {
+		return ErrReserved
+	}
+	if len(args) > 0 {
+		if _, ok := args[len(args)-1].(func(...interface{})); ok {
+			return ErrBroadcastAck
+		}
+	}
+	data := append([]interface{}{event}, args...)
+	pkts, err := encodePackets(&Packet{Type: Event, Nsp: op.nsp.name, ID: -1, Data: data})
+	if err != nil {
+		return err
+	}
+	op.engine().SendPackets(pkts...)
+	return nil
+}
@@ -0,0 +1,216 @@
+package socketio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// PacketType is the type of a socket.io packet.
+type PacketType int
+
+const (
+	Connect PacketType = iota
+	Disconnect
+	Event
+	Ack
+	Error
+	BinaryEvent
+	BinaryAck
+)
+
+// MaxAttachments bounds the binary attachments of a single packet.
+var MaxAttachments = 64
+
+var (
+	ErrBadPacket      = errors.New("socketio: bad packet")
+	ErrTooManyBuffers = errors.New("socketio: too many attachments")
+	ErrUnexpectedBin  = errors.New("socketio: unexpected binary message")
+)
+
+// Packet is a socket.io packet. ID is -1 when no ack is asked for. Data holds
+// decoded JSON values, with binary attachments as []byte.
+type Packet struct {
+	Type        PacketType
+	Nsp         string
+	ID          int
+	Data        interface{}
+	Attachments int
+}
+
+// Encode encodes pkt into a text message followed by its binary
+// attachments. []byte values found in Data, in []interface{} and
+// map[string]interface{} values, are sent as attachments, and the packet type
+// is turned into its binary form.
+func Encode(pkt *Packet) (string, [][]byte, error) {
+	var buffers [][]byte
+	data := deconstruct(pkt.Data, &buffers)
+	typ := pkt.Type
+	if len(buffers) > 0 {
+		switch typ {
+		case Event:
+			typ = BinaryEvent
+		case Ack:
+			typ = BinaryAck
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(int(typ)))
+	if typ == BinaryEvent || typ == BinaryAck {
+		buf.WriteString(strconv.Itoa(len(buffers)))
+		buf.WriteByte('-')
+	}
+	if pkt.Nsp != "" && pkt.Nsp != "/" {
+		buf.WriteString(pkt.Nsp)
+		buf.WriteByte(',')
+	}
+	if pkt.ID >= 0 {
+		buf.WriteString(strconv.Itoa(pkt.ID))
+	}
+	if data != nil {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return "", nil, err
+		}
+		buf.Write(js)
+	}
+	return buf.String(), buffers, nil
+}
+
+func deconstruct(data interface{}, buffers *[][]byte) interface{} {
+	switch v := data.(type) {
+	case []byte:
+		placeholder := map[string]interface{}{"_placeholder": true, "num": len(*buffers)}
+		*buffers = append(*buffers, v)
+		return placeholder
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = deconstruct(e, buffers)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[k] = deconstruct(e, buffers)
+		}
+		return res
+	}
+	return data
+}
+
+// Decoder reassembles packets from engine.io messages. A binary packet comes
+// as a text message announcing its attachments, followed by one binary
+// message per attachment.
+type Decoder struct {
+	pending *Packet
+	buffers [][]byte
+}
+
+// Add feeds a message to the decoder. It returns the packet it completes, or
+// nil while attachments are still expected.
+func (dec *Decoder) Add(data []byte, isBin bool) (*Packet, error) {
+	if isBin {
+		if dec.pending == nil {
+			return nil, ErrUnexpectedBin
+		}
+		dec.buffers = append(dec.buffers, data)
+		if len(dec.buffers) < dec.pending.Attachments {
+			return nil, nil
+		}
+		pkt := dec.pending
+		pkt.Data = reconstruct(pkt.Data, dec.buffers)
+		dec.pending, dec.buffers = nil, nil
+		return pkt, nil
+	}
+	if dec.pending != nil {
+		return nil, ErrBadPacket
+	}
+	pkt, err := decodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if (pkt.Type == BinaryEvent || pkt.Type == BinaryAck) && pkt.Attachments > 0 {
+		dec.pending = pkt
+		return nil, nil
+	}
+	return pkt, nil
+}
+
+func decodeString(str string) (*Packet, error) {
+	if len(str) == 0 || str[0] < '0' || str[0] > '6' {
+		return nil, ErrBadPacket
+	}
+	pkt := &Packet{Type: PacketType(str[0] - '0'), Nsp: "/", ID: -1}
+	i := 1
+	if pkt.Type == BinaryEvent || pkt.Type == BinaryAck {
+		j := strings.IndexByte(str[i:], '-')
+		if j < 0 {
+			return nil, ErrBadPacket
+		}
+		n, err := strconv.Atoi(str[i : i+j])
+		if err != nil || n < 0 {
+			return nil, ErrBadPacket
+		}
+		if n > MaxAttachments {
+			return nil, ErrTooManyBuffers
+		}
+		pkt.Attachments = n
+		i += j + 1
+	}
+	if i < len(str) && str[i] == '/' {
+		j := strings.IndexByte(str[i:], ',')
+		if j < 0 {
+			j = len(str) - i
+		}
+		pkt.Nsp = str[i : i+j]
+		i += j
+		if i < len(str) {
+			i++
+		}
+		// Clients put the connect query after the namespace.
+		if q := strings.IndexByte(pkt.Nsp, '?'); q >= 0 {
+			pkt.Nsp = pkt.Nsp[:q]
+		}
+	}
+	j := i
+	for j < len(str) && str[j] >= '0' && str[j] <= '9' {
+		j++
+	}
+	if j > i {
+		id, err := strconv.Atoi(str[i:j])
+		if err != nil {
+			return nil, ErrBadPacket
+		}
+		pkt.ID = id
+		i = j
+	}
+	if i < len(str) {
+		if err := json.Unmarshal([]byte(str[i:]), &pkt.Data); err != nil {
+			return nil, ErrBadPacket
+		}
+	}
+	return pkt, nil
+}
+
+func reconstruct(data interface{}, buffers [][]byte) interface{} {
+	switch v := data.(type) {
+	case []interface{}:
+		for i, e := range v {
+			v[i] = reconstruct(e, buffers)
+		}
+	case map[string]interface{}:
+		if v["_placeholder"] == true {
+			if num, ok := v["num"].(float64); ok && num >= 0 && int(num) < len(buffers) {
+				return buffers[int(num)]
+			}
+		}
+		for k, e := range v {
+			v[k] = reconstruct(e, buffers)
+		}
+	}
+	return data
+}
@@ -0,0 +1,76 @@
+package socketio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func expect(t *testing.T, res bool, msgs ...interface{}) {
+	t.Helper()
+	if !res {
+		t.Error(msgs...)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, c := range []struct {
+		pkt  Packet
+		want string
+	}{
+		{Packet{Type: Connect, Nsp: "/", ID: -1}, "0"},
+		{Packet{Type: Connect, Nsp: "/admin", ID: -1}, "0/admin,"},
+		{Packet{Type: Event, Nsp: "/", ID: -1, Data: []interface{}{"a", 1}}, `2["a",1]`},
+		{Packet{Type: Event, Nsp: "/chat", ID: 12, Data: []interface{}{"a"}}, `2/chat,12["a"]`},
+		{Packet{Type: Ack, Nsp: "/", ID: 3, Data: []interface{}{}}, `33[]`},
+		{Packet{Type: Error, Nsp: "/admin", ID: -1, Data: "nope"}, `4/admin,"nope"`},
+	} {
+		str, buffers, err := Encode(&c.pkt)
+		expect(t, err == nil && str == c.want && len(buffers) == 0, "want", c.want, "got", str, err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var dec Decoder
+	pkt, err := dec.Add([]byte(`2/chat?token=x,7["msg",{"a":[1,null]}]`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, pkt.Type == Event && pkt.Nsp == "/chat" && pkt.ID == 7, "bad header:", pkt)
+	args := pkt.Data.([]interface{})
+	expect(t, args[0] == "msg" && args[1].(map[string]interface{})["a"].([]interface{})[0] == 1.0, "bad data:", args)
+
+	pkt, err = dec.Add([]byte("1"), false)
+	expect(t, err == nil && pkt.Type == Disconnect && pkt.Nsp == "/" && pkt.ID == -1, "bad disconnect:", pkt, err)
+
+	for _, bad := range []string{"", "9", "5x-[]", `2["a"`} {
+		_, err := dec.Add([]byte(bad), false)
+		expect(t, err != nil, "should reject", bad)
+	}
+	_, err = dec.Add([]byte{1}, true)
+	expect(t, err == ErrUnexpectedBin, "should reject a stray attachment")
+	_, err = dec.Add([]byte("5999-[]"), false)
+	expect(t, err == ErrTooManyBuffers, "should bound the attachments")
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	data := []interface{}{"file", map[string]interface{}{"name": "a", "body": []byte{0, 1}}, []byte{2}}
+	str, buffers, err := Encode(&Packet{Type: Event, Nsp: "/", ID: 4, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, str[:3] == "52-" && len(buffers) == 2, "should announce 2 attachments:", str)
+
+	var dec Decoder
+	pkt, err := dec.Add([]byte(str), false)
+	expect(t, pkt == nil && err == nil, "should wait for the attachments")
+	pkt, err = dec.Add(buffers[0], true)
+	expect(t, pkt == nil && err == nil, "should wait for the second attachment")
+	pkt, err = dec.Add(buffers[1], true)
+	if err != nil || pkt == nil {
+		t.Fatal("should complete the packet", err)
+	}
+	args := pkt.Data.([]interface{})
+	body := args[1].(map[string]interface{})["body"].([]byte)
+	expect(t, pkt.Type == BinaryEvent && pkt.ID == 4, "bad header:", pkt)
+	expect(t, bytes.Equal(body, []byte{0, 1}) && bytes.Equal(args[2].([]byte), []byte{2}), "attachments should be put back:", args)
+}
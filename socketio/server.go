@@ -0,0 +1,198 @@
+// Package socketio speaks the socket.io protocol (version 4 of the parser,
+// as used by socket.io-client 2.x) over an engineio.Server: namespaces, named
+// events with JSON arguments, acknowledgements, binary attachments and
+// connect middleware.
+//
+//	srv := socketio.NewServer(engineio.NewServer(nil))
+//	srv.Of("/").On("connection", func(socket *socketio.Socket) {
+//		socket.On("chat", func(msg string, ack func(...interface{})) {
+//			ack("got it")
+//		})
+//	})
+//	http.Handle("/socket.io/", srv)
+package socketio
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/parser"
+)
+
+// Server dispatches the engine.io connections of an engineio.Server to
+// namespaces.
+type Server struct {
+	eio *engineio.Server
+
+	lock sync.Mutex
+	nsps map[string]*Namespace
+}
+
+// NewServer serves socket.io on the connections of eio. The default
+// namespace "/" always exists.
+func NewServer(eio *engineio.Server) *Server {
+	srv := &Server{eio: eio, nsps: make(map[string]*Namespace)}
+	srv.Of("/")
+	eio.On("connection", srv.onConnection)
+	return srv
+}
+
+// Engine returns the underlying engine.io server.
+func (srv *Server) Engine() *engineio.Server {
+	return srv.eio
+}
+
+func (srv *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	srv.eio.ServeHTTP(res, req)
+}
+
+// Of returns the namespace called name, creating it if needed.
+func (srv *Server) Of(name string) *Namespace {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	nsp := srv.nsps[name]
+	if nsp == nil {
+		nsp = newNamespace(srv, name)
+		srv.nsps[name] = nsp
+	}
+	return nsp
+}
+
+func (srv *Server) namespace(name string) *Namespace {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.nsps[name]
+}
+
+func (srv *Server) onConnection(conn *engineio.Socket) {
+	c := &client{server: srv, conn: conn, sockets: make(map[string]*Socket)}
+	conn.On("message", c.onMessage)
+	conn.Once("close", c.onClose)
+	c.connect("/")
+}
+
+// client is one engine.io connection, carrying a socket per namespace.
+type client struct {
+	server *Server
+	conn   *engineio.Socket
+
+	// decoder is only used from the connection's "message" listener.
+	decoder Decoder
+
+	lock    sync.Mutex
+	sockets map[string]*Socket
+	closed  bool
+}
+
+func (c *client) packet(pkt *Packet) error {
+	pkts, err := encodePackets(pkt)
+	if err != nil {
+		return err
+	}
+	c.conn.SendPackets(pkts...)
+	return nil
+}
+
+// encodePackets encodes pkt into engine.io messages, ready to be shared by
+// every socket it is sent to.
+func encodePackets(pkt *Packet) ([]*parser.Packet, error) {
+	str, buffers, err := Encode(pkt)
+	if err != nil {
+		return nil, err
+	}
+	pkts := make([]*parser.Packet, 0, 1+len(buffers))
+	pkts = append(pkts, parser.Shared(parser.Packet{Type: "message", Data: []byte(str)}))
+	for _, buf := range buffers {
+		pkts = append(pkts, parser.Shared(parser.Packet{Type: "message", Data: buf, IsBin: true}))
+	}
+	return pkts, nil
+}
+
+func (c *client) connect(name string) {
+	nsp := c.server.namespace(name)
+	if nsp == nil {
+		c.packet(&Packet{Type: Error, Nsp: name, ID: -1, Data: "Invalid namespace"})
+		return
+	}
+	c.lock.Lock()
+	_, dup := c.sockets[name]
+	c.lock.Unlock()
+	if dup {
+		return
+	}
+	socket := newSocket(nsp, c)
+	nsp.run(socket, func(err error) {
+		if err != nil {
+			c.packet(&Packet{Type: Error, Nsp: name, ID: -1, Data: err.Error()})
+			return
+		}
+		// Registered under the lock, so that a close that comes in the
+		// meantime either sees the socket or stops it here.
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return
+		}
+		c.sockets[name] = socket
+		socket.lock.Lock()
+		socket.connected = true
+		socket.lock.Unlock()
+		nsp.add(socket)
+		c.lock.Unlock()
+		socket.onConnect()
+	})
+}
+
+func (c *client) socket(name string) *Socket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sockets[name]
+}
+
+func (c *client) remove(socket *Socket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.sockets[socket.nsp.name] == socket {
+		delete(c.sockets, socket.nsp.name)
+	}
+}
+
+func (c *client) onMessage(data []byte, isBin bool) {
+	pkt, err := c.decoder.Add(data, isBin)
+	if err != nil {
+		debug(fmt.Sprintf("closing client \"%s\": %v", c.conn.ID(), err))
+		c.conn.Close()
+		return
+	}
+	if pkt == nil {
+		return
+	}
+	if pkt.Type == Connect {
+		c.connect(pkt.Nsp)
+		return
+	}
+	if socket := c.socket(pkt.Nsp); socket != nil {
+		socket.onPacket(pkt)
+	} else {
+		debug("packet for a namespace the client is not in:", pkt.Nsp)
+	}
+}
+
+func (c *client) onClose(reason string) {
+	c.lock.Lock()
+	c.closed = true
+	sockets := make([]*Socket, 0, len(c.sockets))
+	for _, socket := range c.sockets {
+		sockets = append(sockets, socket)
+	}
+	c.sockets = make(map[string]*Socket)
+	c.lock.Unlock()
+	for _, socket := range sockets {
+		socket.onClose(reason)
+	}
+}
@@ -0,0 +1,206 @@
+package socketio
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/engineio/enginetest"
+)
+
+const timeout = 5 * time.Second
+
+func newServer() *Server {
+	return NewServer(engineio.NewServer(nil))
+}
+
+// connect opens a client and reads the connect packet of the default
+// namespace.
+func connect(t *testing.T, srv *Server) *enginetest.Client {
+	t.Helper()
+	_, c := enginetest.NewPair(srv.Engine())
+	expectMessage(t, c, "0")
+	return c
+}
+
+func expectMessage(t *testing.T, c *enginetest.Client, want string) {
+	t.Helper()
+	msg, err := c.NextMessage(timeout)
+	expect(t, err == nil && string(msg) == want, "want", want, "got", string(msg), err)
+}
+
+func sockets(srv *Server) chan *Socket {
+	ch := make(chan *Socket, 4)
+	srv.Of("/").On("connection", func(socket *Socket) {
+		ch <- socket
+	})
+	return ch
+}
+
+func waitSocket(t *testing.T, ch chan *Socket) *Socket {
+	t.Helper()
+	select {
+	case socket := <-ch:
+		return socket
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	return nil
+}
+
+func TestEventAck(t *testing.T) {
+	srv := newServer()
+	srv.Of("/").On("connection", func(socket *Socket) {
+		socket.On("hi", func(name string, ack func(...interface{})) {
+			ack("hello " + name)
+		})
+	})
+	c := connect(t, srv)
+	c.Send([]byte(`21["hi","bob"]`))
+	expectMessage(t, c, `31["hello bob"]`)
+}
+
+func TestEmitWithAck(t *testing.T) {
+	srv := newServer()
+	conns := sockets(srv)
+	c := connect(t, srv)
+	socket := waitSocket(t, conns)
+	answers := make(chan interface{}, 1)
+	socket.Emit("question", 6, func(args ...interface{}) {
+		answers <- args[0]
+	})
+	expectMessage(t, c, `20["question",6]`)
+	c.Send([]byte(`30[42]`))
+	select {
+	case answer := <-answers:
+		expect(t, answer == 42.0, "want 42, got", answer)
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	expect(t, socket.Emit("disconnect") == ErrReserved, "reserved events can't be sent")
+}
+
+func TestNamespaceMiddleware(t *testing.T) {
+	srv := newServer()
+	admin := srv.Of("/admin")
+	order := make([]string, 0)
+	admin.Use(func(socket *Socket, next func(error)) {
+		order = append(order, "first")
+		next(nil)
+	})
+	admin.Use(func(socket *Socket, next func(error)) {
+		order = append(order, "second")
+		if socket.Handshake().Query.Get("token") != "" {
+			next(nil)
+			return
+		}
+		// Middleware may answer later, from elsewhere.
+		go next(errors.New("not allowed"))
+	})
+	c := connect(t, srv)
+	c.Send([]byte("0/admin,"))
+	expectMessage(t, c, `4/admin,"not allowed"`)
+	expect(t, len(order) == 2 && order[0] == "first", "middleware should run in order:", order)
+
+	c.Send([]byte("0/nope,"))
+	expectMessage(t, c, `4/nope,"Invalid namespace"`)
+	expect(t, len(admin.Sockets()) == 0, "rejected socket should not be in the namespace")
+}
+
+func TestNamespaceEvents(t *testing.T) {
+	srv := newServer()
+	chat := srv.Of("chat")
+	joined := make(chan *Socket, 1)
+	chat.On("connection", func(socket *Socket) {
+		socket.On("say", func(msg string) {
+			chat.Emit("said", msg)
+		})
+		joined <- socket
+	})
+	c := connect(t, srv)
+	c.Send([]byte("0/chat,"))
+	expectMessage(t, c, "0/chat,")
+	socket := waitSocket(t, joined)
+	expect(t, socket.ID() == "/chat#"+c.Sid, "namespace socket id should be prefixed:", socket.ID())
+	c.Send([]byte(`2/chat,["say","hi"]`))
+	expectMessage(t, c, `2/chat,["said","hi"]`)
+}
+
+func TestBinaryEvents(t *testing.T) {
+	srv := newServer()
+	srv.Of("/").On("connection", func(socket *Socket) {
+		socket.On("upload", func(name string, body []byte) {
+			socket.Emit("stored", name, append(body, 9))
+		})
+	})
+	c := connect(t, srv)
+	c.Send([]byte(`51-["upload","f",{"_placeholder":true,"num":0}]`))
+	c.SendBin([]byte{1, 2})
+	expectMessage(t, c, `51-["stored","f",{"_placeholder":true,"num":0}]`)
+	pkt, err := c.Next(timeout)
+	expect(t, err == nil && pkt.IsBin && string(pkt.Data) == "\x01\x02\x09", "should get the attachment, got", pkt, err)
+}
+
+func TestRoomsAndDisconnect(t *testing.T) {
+	srv := newServer()
+	conns := sockets(srv)
+	a := connect(t, srv)
+	sa := waitSocket(t, conns)
+	b := connect(t, srv)
+	sb := waitSocket(t, conns)
+	sa.Join("r")
+	sb.Join("r")
+	sa.To("r").Emit("news", "x")
+	expectMessage(t, b, `2["news","x"]`)
+	srv.Of("/").To(sb.ID()).Emit("direct")
+	expectMessage(t, b, `2["direct"]`)
+
+	reasons := make(chan string, 1)
+	sb.On("disconnect", func(reason string) {
+		reasons <- reason
+	})
+	b.Send([]byte("1"))
+	select {
+	case reason := <-reasons:
+		expect(t, reason == "client namespace disconnect", "bad reason:", reason)
+	case <-time.After(timeout):
+		t.Fatal("timed out")
+	}
+	members := srv.Of("/").To("r").Sockets()
+	expect(t, len(members) == 1 && members[0] == sa, "disconnected socket should leave its rooms")
+
+	sa.Disconnect(true)
+	expectMessage(t, a, "1")
+	expect(t, len(srv.Of("/").Sockets()) == 0, "namespace should be empty")
+}
+
+func TestRoomsAcrossNodes(t *testing.T) {
+	bus := engineio.NewMemoryBus()
+	var nodes []*Server
+	for i := 0; i < 2; i++ {
+		adapter, err := engineio.NewBusAdapter(bus, "socket.io")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, NewServer(engineio.NewServer(engineio.Options{"adapter": adapter})))
+	}
+	conns := sockets(nodes[1])
+	c := connect(t, nodes[1])
+	waitSocket(t, conns).Join("r")
+	chat := nodes[1].Of("/chat")
+	joined := make(chan *Socket, 1)
+	chat.On("connection", func(socket *Socket) {
+		socket.Join("r")
+		joined <- socket
+	})
+	c.Send([]byte("0/chat,"))
+	expectMessage(t, c, "0/chat,")
+	waitSocket(t, joined)
+
+	nodes[0].Of("/").To("r").Emit("news", "x")
+	expectMessage(t, c, `2["news","x"]`)
+	nodes[0].Of("/chat").Emit("all")
+	expectMessage(t, c, `2/chat,["all"]`)
+	expect(t, len(nodes[0].Of("/").To("r").Sockets()) == 0, "Sockets should only list local sockets")
+}
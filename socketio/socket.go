@@ -0,0 +1,198 @@
+package socketio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kaicheng/engineio"
+	"github.com/kaicheng/events"
+)
+
+// Socket is a client connected to a namespace. Events from the client are
+// emitted on it with their JSON arguments, decoded into string, float64,
+// bool, nil, []interface{} and map[string]interface{} values, and binary
+// attachments as []byte. When the client asks for an acknowledgement, a
+// func(...interface{}) that sends it comes last:
+//
+//	socket.On("chat", func(msg string, ack func(...interface{})) {
+//		ack("ok")
+//	})
+//
+// Listeners run on the engine.io socket's loop, one at a time. The socket
+// also emits "disconnecting" and "disconnect" with the reason.
+type Socket struct {
+	events.EventEmitter
+
+	id     string
+	nsp    *Namespace
+	client *client
+
+	lock      sync.Mutex
+	connected bool
+	acks      map[int]func(...interface{})
+	nextAck   int
+}
+
+func newSocket(nsp *Namespace, c *client) *Socket {
+	id := c.conn.ID()
+	if nsp.name != "/" {
+		id = nsp.name + "#" + id
+	}
+	return &Socket{
+		id:     id,
+		nsp:    nsp,
+		client: c,
+		acks:   make(map[int]func(...interface{})),
+	}
+}
+
+// ID returns the id of the socket, which is the engine.io session id in the
+// default namespace and "<namespace>#<session id>" in the others.
+func (socket *Socket) ID() string {
+	return socket.id
+}
+
+func (socket *Socket) Namespace() *Namespace {
+	return socket.nsp
+}
+
+// Conn returns the engine.io socket carrying this one.
+func (socket *Socket) Conn() *engineio.Socket {
+	return socket.client.conn
+}
+
+// Handshake returns the handshake of the engine.io connection.
+func (socket *Socket) Handshake() engineio.Handshake {
+	return socket.client.conn.Handshake()
+}
+
+func (socket *Socket) Connected() bool {
+	socket.lock.Lock()
+	defer socket.lock.Unlock()
+	return socket.connected
+}
+
+func (socket *Socket) onConnect() {
+	socket.client.packet(&Packet{Type: Connect, Nsp: socket.nsp.name, ID: -1})
+	debug(fmt.Sprintf("socket \"%s\" connected", socket.id))
+	socket.nsp.EventEmitter.Emit("connection", socket)
+	socket.nsp.EventEmitter.Emit("connect", socket)
+}
+
+func (socket *Socket) onPacket(pkt *Packet) {
+	switch pkt.Type {
+	case Event, BinaryEvent:
+		args, _ := pkt.Data.([]interface{})
+		if len(args) == 0 {
+			debug("event without a name")
+			return
+		}
+		event, ok := args[0].(string)
+		if !ok {
+			debug("event name is not a string")
+			return
+		}
+		args = args[1:]
+		if pkt.ID >= 0 {
+			args = append(args, socket.ack(pkt.ID))
+		}
+		socket.EventEmitter.Emit(event, args...)
+	case Ack, BinaryAck:
+		socket.lock.Lock()
+		fn := socket.acks[pkt.ID]
+		delete(socket.acks, pkt.ID)
+		socket.lock.Unlock()
+		if fn == nil {
+			debug("bad ack", pkt.ID)
+			return
+		}
+		args, _ := pkt.Data.([]interface{})
+		fn(args...)
+	case Disconnect:
+		socket.onClose("client namespace disconnect")
+	case Error:
+		socket.EventEmitter.Emit("error", pkt.Data)
+	}
+}
+
+// ack returns the function answering the client's ack id. Only its first
+// call is sent.
+func (socket *Socket) ack(id int) func(...interface{}) {
+	var once sync.Once
+	return func(args ...interface{}) {
+		once.Do(func() {
+			data := append([]interface{}{}, args...)
+			socket.client.packet(&Packet{Type: Ack, Nsp: socket.nsp.name, ID: id, Data: data})
+		})
+	}
+}
+
+// Emit sends an event to the client. If the last argument is a
+// func(...interface{}), it is called with the arguments of the client's
+// acknowledgement. []byte arguments are sent as binary attachments.
+func (socket *Socket) Emit(event string, args ...interface{}) error {
+	if reserved[event] {
+		return ErrReserved
+	}
+	pkt := &Packet{Type: Event, Nsp: socket.nsp.name, ID: -1}
+	if len(args) > 0 {
+		if fn, ok := args[len(args)-1].(func(...interface{})); ok {
+			args = args[:len(args)-1]
+			socket.lock.Lock()
+			pkt.ID = socket.nextAck
+			socket.nextAck++
+			socket.acks[pkt.ID] = fn
+			socket.lock.Unlock()
+		}
+	}
+	pkt.Data = append([]interface{}{event}, args...)
+	return socket.client.packet(pkt)
+}
+
+// To returns an operator sending to the sockets in rooms, except this one.
+func (socket *Socket) To(rooms ...string) *BroadcastOperator {
+	return socket.nsp.To(rooms...).Except(socket.id)
+}
+
+// Join adds the socket to room. Sockets leave their rooms on disconnect.
+func (socket *Socket) Join(room string) {
+	socket.nsp.join(socket, room)
+}
+
+// Leave removes the socket from room.
+func (socket *Socket) Leave(room string) {
+	socket.nsp.leave(socket, room)
+}
+
+// Rooms returns the rooms the socket is in, sorted.
+func (socket *Socket) Rooms() []string {
+	return socket.nsp.rooms(socket.Conn())
+}
+
+// Disconnect disconnects the socket from its namespace. With close, the
+// whole engine.io connection is closed too.
+func (socket *Socket) Disconnect(close bool) {
+	if socket.Connected() {
+		socket.client.packet(&Packet{Type: Disconnect, Nsp: socket.nsp.name, ID: -1})
+		socket.onClose("server namespace disconnect")
+	}
+	if close {
+		socket.client.conn.Close()
+	}
+}
+
+func (socket *Socket) onClose(reason string) {
+	socket.lock.Lock()
+	if !socket.connected {
+		socket.lock.Unlock()
+		return
+	}
+	socket.connected = false
+	socket.acks = make(map[int]func(...interface{}))
+	socket.lock.Unlock()
+	debug(fmt.Sprintf("socket \"%s\" disconnected: %s", socket.id, reason))
+	socket.EventEmitter.Emit("disconnecting", reason)
+	socket.nsp.remove(socket)
+	socket.client.remove(socket)
+	socket.EventEmitter.Emit("disconnect", reason)
+}
@@ -0,0 +1,60 @@
+package engineio
+
+import (
+	"fmt"
+)
+
+// ReadyState is the state of a socket or a transport. Both start out opening
+// and only move forward. A transport opens once a socket adopts it, at the
+// handshake or when an upgrade to it completes; one that is dropped before
+// that, like a failed upgrade, closes straight from opening.
+type ReadyState int
+
+const (
+	StateOpening ReadyState = iota
+	StateOpen
+	StateClosing
+	StateClosed
+)
+
+var readyStateNames = [...]string{
+	StateOpening: "opening",
+	StateOpen:    "open",
+	StateClosing: "closing",
+	StateClosed:  "closed",
+}
+
+func (state ReadyState) String() string {
+	if state < 0 || int(state) >= len(readyStateNames) {
+		return "unknown"
+	}
+	return readyStateNames[state]
+}
+
+func (state ReadyState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+func (state *ReadyState) UnmarshalText(text []byte) error {
+	for i, name := range readyStateNames {
+		if name == string(text) {
+			*state = ReadyState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("engineio: unknown ready state %q", text)
+}
+
+// canTransition reports whether a socket or transport may go from one state
+// to the other. States never go back.
+func canTransition(from, to ReadyState) bool {
+	switch to {
+	case StateOpen:
+		return from == StateOpening
+	case StateClosing:
+		return from == StateOpening || from == StateOpen
+	case StateClosed:
+		return from != StateClosed
+	}
+	return false
+}
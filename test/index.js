@@ -1,7 +0,0 @@
-var listen = require('./common').listen
-
-describe('base', function() {
-	it('should start go server', function(done) {
-		listen("default", function(port){done()})
-	})
-})
\ No newline at end of file
@@ -1,6 +1,10 @@
 package engineio
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/kaicheng/engineio/parser"
 	"github.com/kaicheng/events"
 )
@@ -8,8 +12,8 @@ import (
 type Transport interface {
 	events.EventEmitterInt
 
-	setReadyState(string)
-	readyState() string
+	setReadyState(ReadyState) bool
+	readyState() ReadyState
 	tryWritable(do, def func())
 
 	onRequest(*Request)
@@ -23,7 +27,11 @@ type Transport interface {
 	Name() string
 	setSid(sid string)
 	setMaxHTTPBufferSize(size int)
+	setLenientPayload(b bool)
+	setPollTimeout(d time.Duration, clock Clock)
+	setClock(clock Clock)
 	setSupportsBinary(b bool)
+	getSupportsBinary() bool
 }
 
 type transportCreator func(*Request) Transport
@@ -43,7 +51,8 @@ type TransportBase struct {
 	events.EventEmitter
 
 	doClose         func(func())
-	transReadyState string
+	transReadyState ReadyState
+	stateLock       sync.Mutex
 	req             *Request
 	name            string
 	sid             string
@@ -51,15 +60,32 @@ type TransportBase struct {
 }
 
 func (trans *TransportBase) initTransportBase(req *Request) {
-	trans.transReadyState = "opening"
+	trans.transReadyState = StateOpening
 	trans.doClose = func(func()) {}
 }
 
-func (trans *TransportBase) setReadyState(state string) {
+// setReadyState moves the transport to state and emits "stateChange" with the
+// old and new states. It reports false, leaving the state alone, if the
+// transition isn't allowed.
+func (trans *TransportBase) setReadyState(state ReadyState) bool {
+	trans.stateLock.Lock()
+	old := trans.transReadyState
+	if !canTransition(old, state) {
+		trans.stateLock.Unlock()
+		if old != state {
+			debug(fmt.Sprintf("transport: invalid transition from %s to %s", old, state))
+		}
+		return false
+	}
 	trans.transReadyState = state
+	trans.stateLock.Unlock()
+	trans.Emit("stateChange", old, state)
+	return true
 }
 
-func (trans *TransportBase) readyState() string {
+func (trans *TransportBase) readyState() ReadyState {
+	trans.stateLock.Lock()
+	defer trans.stateLock.Unlock()
 	return trans.transReadyState
 }
 
@@ -69,7 +95,7 @@ func (trans *TransportBase) onRequest(req *Request) {
 }
 
 func (trans *TransportBase) close(fn func()) {
-	trans.transReadyState = "closing"
+	trans.setReadyState(StateClosing)
 	if fn == nil {
 		fn = func() {}
 	}
@@ -91,7 +117,7 @@ func (trans *TransportBase) onData(data []byte) {
 }
 
 func (trans *TransportBase) onClose() {
-	trans.transReadyState = "closed"
+	trans.setReadyState(StateClosed)
 	trans.Emit("close")
 }
 
@@ -105,6 +131,16 @@ func (trans *TransportBase) setSid(sid string) {
 
 func (trans *TransportBase) setMaxHTTPBufferSize(size int) {}
 
+func (trans *TransportBase) setLenientPayload(b bool) {}
+
+func (trans *TransportBase) setPollTimeout(d time.Duration, clock Clock) {}
+
+func (trans *TransportBase) setClock(clock Clock) {}
+
 func (trans *TransportBase) setSupportsBinary(b bool) {
 	trans.supportsBinary = b
 }
+
+func (trans *TransportBase) getSupportsBinary() bool {
+	return trans.supportsBinary
+}
@@ -1,19 +1,20 @@
 package engineio
 
 import (
+	"sync"
 	"time"
 )
 
 type ticker struct {
-	t   *time.Ticker
+	t   Ticker
 	c   <-chan time.Time
 	end chan bool
 }
 
-func newTicker(d time.Duration) *ticker {
+func newTicker(clock Clock, d time.Duration) *ticker {
 	t := new(ticker)
-	t.t = time.NewTicker(d)
-	t.c = t.t.C
+	t.t = clock.NewTicker(d)
+	t.c = t.t.C()
 	t.end = make(chan bool, 1)
 	return t
 }
@@ -26,3 +27,26 @@ func (t *ticker) stop() {
 	default:
 	}
 }
+
+// bufferPool holds encode buffers shared by the transports. A buffer is taken
+// in send and given back once its bytes have been written out.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	// Don't let a single huge payload pin its memory in the pool.
+	if cap(*buf) > 64*1024 {
+		return
+	}
+	bufferPool.Put(buf)
+}
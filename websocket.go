@@ -4,14 +4,28 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/kaicheng/engineio/parser"
 	"net/http"
+	"sync"
 )
 
+// WebSocket runs a read and a write worker per connection. Both exit once
+// done is closed or the connection fails, and nothing blocks on them after
+// that.
 type WebSocket struct {
 	TransportBase
 
-	conn    *websocket.Conn
-	writeCh chan []byte
-	stopCh  chan bool
+	conn *websocket.Conn
+	// send queues packets for the write worker, which encodes them, rather
+	// than handing them over, so that a peer that stops reading never
+	// blocks the socket's loop: its ping timeout can still close the
+	// connection, which fails the stalled write. Pongs are written ahead of
+	// the other packets, so that the client's heartbeat goes on while a long
+	// backlog of messages is written.
+	writeLock  sync.Mutex
+	writeQueue []*parser.Packet
+	pongQueue  []*parser.Packet
+	writeWake  chan bool
+	done       chan bool
+	doneOnce   sync.Once
 }
 
 func NewWebSocketTransport(req *Request) Transport {
@@ -22,17 +36,17 @@ func NewWebSocketTransport(req *Request) Transport {
 
 func websocketReadWorker(ws *WebSocket) {
 	for {
-		select {
-		case <-ws.stopCh:
-			return
-		default:
-		}
+		// Closing the connection is what unblocks ReadMessage.
 		_, p, err := ws.conn.ReadMessage()
 		if err != nil {
 			debug("websocket: read error", err)
-			break
+			ws.finish()
+			ws.onClose()
+			return
+		}
+		if eioDebug {
+			debug("websocket received ", string(p))
 		}
-		debug("websocket received ", string(p))
 		ws.onData(p)
 	}
 }
@@ -40,22 +54,51 @@ func websocketReadWorker(ws *WebSocket) {
 func websocketWriteWorker(ws *WebSocket) {
 	for {
 		select {
-		case data := <-ws.writeCh:
-			debug("websocket writing ", string(data))
+		case <-ws.writeWake:
+		case <-ws.done:
+			return
+		}
+		for pkt := ws.nextWrite(); pkt != nil; pkt = ws.nextWrite() {
+			buf := getBuffer()
+			*buf = parser.AppendPacket(*buf, pkt, ws.supportsBinary)
+			data := *buf
+			if eioDebug {
+				debug("websocket writing ", string(data))
+			}
 			msgType := websocket.TextMessage
 			if data[0] < 20 {
 				msgType = websocket.BinaryMessage
 			}
-			if err := ws.conn.WriteMessage(msgType, data); err != nil {
+			err := ws.conn.WriteMessage(msgType, data)
+			putBuffer(buf)
+			if err != nil {
 				debug("websocket: write error", err)
+				// Let the read worker report the close.
+				ws.conn.Close()
 				return
 			}
-		case <-ws.stopCh:
-			return
 		}
 	}
 }
 
+// nextWrite takes the next packet to write off the queues, pongs first. It
+// returns nil once both are empty.
+func (ws *WebSocket) nextWrite() *parser.Packet {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	queue := &ws.writeQueue
+	if len(ws.pongQueue) > 0 {
+		queue = &ws.pongQueue
+	}
+	if len(*queue) == 0 {
+		return nil
+	}
+	pkt := (*queue)[0]
+	(*queue)[0] = nil
+	*queue = (*queue)[1:]
+	return pkt
+}
+
 var upgrader websocket.Upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -73,13 +116,13 @@ func (ws *WebSocket) InitWebSocket(req *Request) {
 	conn, err := upgrader.Upgrade(req.res, req.httpReq, nil)
 	if err != nil {
 		debug("InitWebSocket: upgrade fail with err", err)
-		ws.transReadyState = "closed"
+		ws.setReadyState(StateClosed)
 		return
 	}
 	ws.conn = conn
 
-	ws.writeCh = make(chan []byte, 1)
-	ws.stopCh = make(chan bool, 2)
+	ws.writeWake = make(chan bool, 1)
+	ws.done = make(chan bool)
 
 	go websocketReadWorker(ws)
 	go websocketWriteWorker(ws)
@@ -87,28 +130,46 @@ func (ws *WebSocket) InitWebSocket(req *Request) {
 	ws.doClose = func(fn func()) {
 		debug("websocket closing")
 		fn()
-		select {
-		case ws.stopCh <- true:
-		default:
-		}
-		select {
-		case ws.stopCh <- true:
-		default:
-		}
+		ws.finish()
 		ws.conn.Close()
 	}
 }
 
+func (ws *WebSocket) finish() {
+	ws.doneOnce.Do(func() {
+		close(ws.done)
+	})
+}
+
 func (ws *WebSocket) send(pkts []*parser.Packet) {
 	for _, pkt := range pkts {
-		parser.EncodePacket(pkt, ws.supportsBinary, func(data []byte) {
-			ws.writeCh <- data
-			ws.Emit("drain")
-		})
+		select {
+		case <-ws.done:
+			return
+		default:
+		}
+		ws.writeLock.Lock()
+		if "pong" == pkt.Type {
+			ws.pongQueue = append(ws.pongQueue, pkt)
+		} else {
+			ws.writeQueue = append(ws.writeQueue, pkt)
+		}
+		ws.writeLock.Unlock()
+		select {
+		case ws.writeWake <- true:
+		default:
+		}
+		ws.Emit("drain")
 	}
 }
 
 func (ws *WebSocket) tryWritable(fn, def func()) {
-	// FIXME: may block if closed.
-	fn()
+	select {
+	case <-ws.done:
+		if def != nil {
+			def()
+		}
+	default:
+		fn()
+	}
 }
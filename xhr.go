@@ -12,7 +12,9 @@ func (xhr *XHR) InitXHR(req *Request) {
 	xhr.InitPolling(req)
 
 	xhr.Polling.doWrite = func(req *Request, data []byte) {
-		debug(fmt.Sprintf("xhr writing \"%s\"", string(data)))
+		if eioDebug {
+			debug(fmt.Sprintf("xhr writing \"%s\"", string(data)))
+		}
 		contentType := "text/plains; charset=UTF-8"
 		if data[0] < 20 {
 			contentType = "application/octet-stream"